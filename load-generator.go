@@ -3,8 +3,17 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,67 +30,317 @@ type Event struct {
 	Attributes map[string]string `json:"attributes"`
 }
 
+// statusWeight is one entry of the weighted status code distribution.
+type statusWeight struct {
+	code   int
+	weight float64
+}
+
+// distributions controls how synthetic latencies and status codes are drawn.
+type distributions struct {
+	latencyDist string  // lognormal or exponential
+	medianMs    float64 // lognormal median
+	sigma       float64 // lognormal shape; larger means a longer tail
+	meanMs      float64 // exponential mean
+	statuses    []statusWeight
+	total       float64
+}
+
+type result struct {
+	latency time.Duration
+	err     error
+}
+
 func main() {
-	url := "http://localhost:8081/ingest"
-
-	services := []string{
-		"auth-service",
-		"payments-service",
-		"orders-service",
-	}
-
-	customers := []string{
-		"cust_200",
-		"cust_201",
-		"cust_202",
-		"cust_203",
-	}
-
-	fmt.Println("🚀 Sending demo telemetry events...")
-
-	for i := 1; i <= 50; i++ {
-		event := Event{
-			Timestamp:  time.Now().UTC().Format(time.RFC3339),
-			Service:    services[i%len(services)],
-			CustomerID: customers[i%len(customers)],
-			Endpoint:   "/api/demo",
-			Method:     "POST",
-			StatusCode: pickStatus(i),
-			LatencyMs:  50 + (i % 300),
-			TraceID:    fmt.Sprintf("trace-%d", i),
-			Attributes: map[string]string{
-				"build":  "v0.1.0",
-				"region": "us-east-1",
-			},
-		}
+	url := flag.String("url", "http://localhost:8081/ingest", "ingestion endpoint")
+	count := flag.Int("count", 50, "total events to send")
+	concurrency := flag.Int("concurrency", 1, "number of sending workers")
+	rate := flag.Float64("rate", 20, "events per second across all workers (0 = unlimited)")
+	errorRate := flag.Float64("error-rate", 0.03, "fraction of events with a 5xx status; rescales the 5xx share of -status-weights when set")
+	statusFlag := flag.String("status-weights", "200:95,400:2,500:3", "weighted status codes as code:weight pairs")
+	latencyDist := flag.String("latency-dist", "lognormal", "latency distribution: lognormal or exponential")
+	medianMs := flag.Float64("latency-median-ms", 80, "median latency for -latency-dist=lognormal")
+	sigma := flag.Float64("latency-sigma", 0.6, "log-space standard deviation for -latency-dist=lognormal")
+	meanMs := flag.Float64("latency-mean-ms", 100, "mean latency for -latency-dist=exponential")
+	servicesFlag := flag.String("services", "auth-service,payments-service,orders-service", "comma-separated service names")
+	customersFlag := flag.String("customers", "cust_200,cust_201,cust_202,cust_203", "comma-separated customer IDs")
+	flag.Parse()
+
+	services := splitList(*servicesFlag)
+	customers := splitList(*customersFlag)
+	if len(services) == 0 || len(customers) == 0 {
+		usageError("-services and -customers must not be empty")
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	statuses, err := parseStatusWeights(*statusFlag)
+	if err != nil {
+		usageError("invalid -status-weights:", err)
+	}
+	if flagSet("error-rate") {
+		statuses = withErrorRate(statuses, *errorRate)
+	}
+	if *latencyDist != "lognormal" && *latencyDist != "exponential" {
+		usageError("-latency-dist must be lognormal or exponential")
+	}
+	if *medianMs <= 0 || *meanMs <= 0 || *sigma < 0 {
+		usageError("latency parameters must be positive")
+	}
+	dists := newDistributions(*latencyDist, *medianMs, *sigma, *meanMs, statuses)
+
+	fmt.Printf("🚀 Sending %d telemetry events to %s (concurrency=%d, rate=%g/s)...\n", *count, *url, *concurrency, *rate)
+
+	jobs := make(chan int)
+	results := make(chan result, *count)
+	// One shared client so workers reuse keep-alive connections instead of
+	// paying a TCP handshake per event
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        *concurrency,
+			MaxIdleConnsPerHost: *concurrency,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				event := buildEvent(i, services, customers, dists)
+				start := time.Now()
+				err := sendEvent(client, *url, event)
+				results <- result{latency: time.Since(start), err: err}
+			}
+		}()
+	}
 
-		if event.StatusCode >= 500 {
-			event.Error = "simulated_failure"
+	// Pace job hand-out so the aggregate send rate stays at -rate. Rates
+	// above one event per nanosecond can't be paced and run unlimited.
+	var tick <-chan time.Time
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Duration(float64(time.Second) / *rate)
+	}
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	began := time.Now()
+	for i := 1; i <= *count; i++ {
+		if tick != nil {
+			<-tick
 		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	printSummary(results, time.Since(began))
+}
+
+// usageError reports an invalid flag and exits with status 2, as flag does.
+func usageError(a ...any) {
+	fmt.Fprintln(os.Stderr, append([]any{"❌"}, a...)...)
+	os.Exit(2)
+}
+
+func buildEvent(i int, services, customers []string, d *distributions) Event {
+	event := Event{
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Service:    services[i%len(services)],
+		CustomerID: customers[i%len(customers)],
+		Endpoint:   "/api/demo",
+		Method:     "POST",
+		StatusCode: d.status(),
+		LatencyMs:  d.latencyMs(),
+		TraceID:    fmt.Sprintf("trace-%d", i),
+		Attributes: map[string]string{
+			"build":  "v0.1.0",
+			"region": "us-east-1",
+		},
+	}
+
+	if event.StatusCode >= 500 {
+		event.Error = "simulated_failure"
+	}
+	return event
+}
+
+func newDistributions(latencyDist string, medianMs, sigma, meanMs float64, statuses []statusWeight) *distributions {
+	d := &distributions{
+		latencyDist: latencyDist,
+		medianMs:    medianMs,
+		sigma:       sigma,
+		meanMs:      meanMs,
+		statuses:    statuses,
+	}
+	for _, s := range statuses {
+		d.total += s.weight
+	}
+	return d
+}
 
-		sendEvent(url, event)
-		time.Sleep(50 * time.Millisecond)
+// latencyMs draws a latency, at least 1ms.
+func (d *distributions) latencyMs() int {
+	var v float64
+	switch d.latencyDist {
+	case "exponential":
+		v = rand.ExpFloat64() * d.meanMs
+	default:
+		v = math.Exp(math.Log(d.medianMs) + d.sigma*rand.NormFloat64())
 	}
+	return max(int(math.Round(v)), 1)
+}
 
-	fmt.Println("✅ Done sending events")
+// status samples a status code from the weighted set.
+func (d *distributions) status() int {
+	r := rand.Float64() * d.total
+	for _, s := range d.statuses {
+		if r < s.weight {
+			return s.code
+		}
+		r -= s.weight
+	}
+	return d.statuses[len(d.statuses)-1].code
+}
+
+// parseStatusWeights reads "200:95,400:2,500:3".
+func parseStatusWeights(v string) ([]statusWeight, error) {
+	var out []statusWeight
+	for _, pair := range splitList(v) {
+		code, weight, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not code:weight", pair)
+		}
+		c, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil || c < 100 || c > 599 {
+			return nil, fmt.Errorf("bad status code in %q", pair)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("bad weight in %q", pair)
+		}
+		out = append(out, statusWeight{code: c, weight: w})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no status codes given")
+	}
+	return out, nil
 }
 
-func pickStatus(i int) int {
-	if i%10 == 0 {
-		return 500 // inject some failures
+// withErrorRate rescales weights so 5xx codes make up rate of the total while
+// keeping the relative mix within the 5xx and non-5xx groups. A plain 500 is
+// added if the set has no 5xx code to scale.
+func withErrorRate(statuses []statusWeight, rate float64) []statusWeight {
+	rate = math.Min(math.Max(rate, 0), 1)
+
+	var errTotal, okTotal float64
+	for _, s := range statuses {
+		if s.code >= 500 {
+			errTotal += s.weight
+		} else {
+			okTotal += s.weight
+		}
+	}
+	if errTotal == 0 {
+		statuses = append(statuses, statusWeight{code: 500, weight: 1})
+		errTotal = 1
 	}
-	return 200
+
+	out := make([]statusWeight, 0, len(statuses))
+	for _, s := range statuses {
+		switch {
+		case s.code >= 500:
+			s.weight = s.weight / errTotal * rate
+		case okTotal > 0:
+			s.weight = s.weight / okTotal * (1 - rate)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-func sendEvent(url string, event Event) {
+func sendEvent(client *http.Client, url string, event Event) error {
 	body, _ := json.Marshal(event)
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		fmt.Println("❌ Failed:", err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
+	// Read to EOF so the connection goes back to the idle pool
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: status %d", event.TraceID, resp.StatusCode)
+	}
+	return nil
+}
+
+func printSummary(results <-chan result, elapsed time.Duration) {
+	var (
+		sent, failed int
+		latencies    []time.Duration
+	)
+	for r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Println("❌ Failed:", r.err)
+			continue
+		}
+		sent++
+		latencies = append(latencies, r.latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(sent) / elapsed.Seconds()
+	}
+	fmt.Printf("✅ Done in %s: sent=%d failed=%d rate=%.1f/s p50=%s p95=%s\n",
+		elapsed.Round(time.Millisecond), sent, failed, rate, percentile(latencies, 0.50), percentile(latencies, 0.95))
+}
 
-	fmt.Println("Sent:", event.Service, event.CustomerID, event.StatusCode)
+// percentile returns the nearest-rank percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx].Round(time.Microsecond)
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
 }
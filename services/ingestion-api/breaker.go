@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned instead of publishing while the breaker is open.
+var errBreakerOpen = errors.New("kafka unavailable: circuit breaker open")
+
+// Breaker states, also the values of the breaker state gauge.
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// breaker fails publishes fast during a broker outage instead of letting every
+// request sit through sarama's retries. After threshold consecutive failures
+// it opens for cooldown; then a single request is let through as a probe,
+// and its outcome closes the breaker or opens it for another cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// newBreaker returns nil when threshold is 0, which disables the breaker.
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	breakerState.Set(breakerClosed)
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a publish may go ahead. A nil breaker always allows.
+func (b *breaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// Only the probe gets through until it reports back
+		return false
+	}
+	return true
+}
+
+// record reports the outcome of a publish that allow let through.
+func (b *breaker) record(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+// retryAfter is how long until the breaker next lets a probe through.
+func (b *breaker) retryAfter(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.cooldown-now.Sub(b.openedAt), time.Second)
+}
+
+func (b *breaker) setState(state int) {
+	b.state = state
+	breakerState.Set(float64(state))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// legacyFieldAliases maps field names sent by old producers onto the
+// TelemetryEvent field they mean. With COMPAT_MODE=true they are renamed before
+// the strict decode (which would otherwise reject them as unknown fields) and
+// before schema validation.
+var legacyFieldAliases = map[string]string{
+	"latency": "latency_ms",
+	"status":  "status_code",
+}
+
+// migrateLegacyFields rewrites raw with legacy aliases renamed. An event that
+// sets both an alias and its canonical field is rejected rather than guessing
+// which one is right. raw is returned unchanged when it has no aliases.
+func migrateLegacyFields(raw json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	renamed := false
+	for alias, canonical := range legacyFieldAliases {
+		v, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		if _, dup := fields[canonical]; dup {
+			return nil, fmt.Errorf("both %q and its legacy alias %q are set", canonical, alias)
+		}
+		delete(fields, alias)
+		fields[canonical] = v
+		legacyFieldsMapped.WithLabelValues(alias).Inc()
+		renamed = true
+	}
+	if !renamed {
+		return raw, nil
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMigrateLegacyFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]any
+		wantErr bool
+	}{
+		{"canonical unchanged", `{"latency_ms":5,"status_code":200}`, map[string]any{"latency_ms": 5.0, "status_code": 200.0}, false},
+		{"both aliases", `{"latency":5,"status":503,"service":"s"}`, map[string]any{"latency_ms": 5.0, "status_code": 503.0, "service": "s"}, false},
+		{"one alias", `{"latency":7,"status_code":200}`, map[string]any{"latency_ms": 7.0, "status_code": 200.0}, false},
+		{"alias and canonical", `{"latency":7,"latency_ms":8}`, nil, true},
+		{"not an object", `[1]`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := migrateLegacyFields(json.RawMessage(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got map[string]any
+			if err := json.Unmarshal(out, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngestCompatMode(t *testing.T) {
+	legacy := `{"service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST","status":503,"latency":12}`
+	tests := []struct {
+		name   string
+		compat bool
+		want   int
+	}{
+		{"off rejects legacy names", false, http.StatusBadRequest},
+		{"on accepts legacy names", true, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, p := testServer()
+			s.compat = tt.compat
+			rec := postIngest(s, legacy, nil)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if !tt.compat {
+				return
+			}
+
+			// The published event carries the canonical fields, and the
+			// response has the usual accepted shape
+			b, err := p.msgs[0].Value.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ev TelemetryEvent
+			if err := json.Unmarshal(b, &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.StatusCode != 503 || ev.LatencyMs != 12 {
+				t.Errorf("published status_code=%d latency_ms=%d, want 503 and 12", ev.StatusCode, ev.LatencyMs)
+			}
+			var resp map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			keys := make([]string, 0, len(resp))
+			for k := range resp {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			want := []string{"offset", "partition", "request_id", "status", "topic", "trace_id"}
+			if !reflect.DeepEqual(keys, want) || resp["status"] != "accepted" {
+				t.Errorf("response %v, want keys %v with status accepted", resp, want)
+			}
+		})
+	}
+}
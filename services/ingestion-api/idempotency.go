@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyCache remembers the response to each Idempotency-Key for ttl so a
+// retried request gets the original answer instead of publishing again. It is
+// a bounded LRU held in process memory: best-effort, per instance, and empty
+// after a restart. Two concurrent requests with the same new key can both
+// publish; only requests that arrive after the first completes are deduplicated.
+type idempotencyCache struct {
+	ttl      time.Duration
+	capacity int
+
+	mu    sync.Mutex
+	order *list.List // front = most recently used
+	items map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newIdempotencyCache(capacity int, ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:      ttl,
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *idempotencyCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	resp := el.Value.(*cachedResponse)
+	if now.After(resp.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return resp, true
+}
+
+func (c *idempotencyCache) put(resp *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[resp.key]; ok {
+		el.Value = resp
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[resp.key] = c.order.PushFront(resp)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// wrap replays the cached response for a repeated Idempotency-Key. Requests
+// without the header pass straight through. 5xx and 429 responses aren't
+// cached, so a retry after a failed publish or a rate limit tries again.
+func (c *idempotencyCache) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || c.capacity <= 0 {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		if resp, ok := c.get(key, now); ok {
+			for k, v := range resp.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		if rec.status < 500 && rec.status != http.StatusTooManyRequests {
+			c.put(&cachedResponse{
+				key:     key,
+				status:  rec.status,
+				header:  w.Header().Clone(),
+				body:    rec.body.Bytes(),
+				expires: now.Add(c.ttl),
+			})
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentIngestReplaysResponse(t *testing.T) {
+	s, p := testServer()
+	handler := newIdempotencyCache(10, time.Minute).wrap(s.handleIngest)
+	body := eventJSON(t, validEvent())
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(idempotencyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	first := send("k1")
+	second := send("k1")
+	if first.Code != http.StatusAccepted || second.Code != first.Code {
+		t.Fatalf("status %d then %d, want 202 twice", first.Code, second.Code)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("replayed body %q, want %q", second.Body.String(), first.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Idempotent-Replayed not set on the replay only")
+	}
+	if p.sent() != 1 {
+		t.Fatalf("published %d messages, want 1", p.sent())
+	}
+
+	send("k2")
+	send("")
+	send("")
+	if p.sent() != 4 {
+		t.Errorf("published %d messages, want a new key and unkeyed requests to publish", p.sent())
+	}
+}
+
+func TestIdempotentIngestRetriesFailures(t *testing.T) {
+	s, p := testServer()
+	handler := newIdempotencyCache(10, time.Minute).wrap(s.handleIngest)
+	body := eventJSON(t, validEvent())
+
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+		req.Header.Set(idempotencyHeader, "k")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	p.err = errors.New("broker down")
+	if code := send(); code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502 while kafka fails", code)
+	}
+	p.err = nil
+	if code := send(); code != http.StatusAccepted {
+		t.Fatalf("status = %d, want the retry to publish", code)
+	}
+	if p.sent() != 1 {
+		t.Errorf("published %d messages, want 1", p.sent())
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		puts    []string
+		getAt   time.Duration
+		key     string
+		wantHit bool
+	}{
+		{"hit", []string{"a"}, 0, "a", true},
+		{"miss", []string{"a"}, 0, "b", false},
+		{"expired", []string{"a"}, 2 * time.Minute, "a", false},
+		{"evicted as least recent", []string{"a", "b", "c"}, 0, "a", false},
+		{"kept within capacity", []string{"a", "b", "c"}, 0, "b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newIdempotencyCache(2, time.Minute)
+			for _, key := range tt.puts {
+				c.put(&cachedResponse{key: key, status: http.StatusAccepted, expires: now.Add(time.Minute)})
+			}
+			if _, ok := c.get(tt.key, now.Add(tt.getAt)); ok != tt.wantHit {
+				t.Errorf("hit = %v, want %v", ok, tt.wantHit)
+			}
+		})
+	}
+}
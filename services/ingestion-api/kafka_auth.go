@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// kafkaAuth holds the optional SASL and TLS settings for talking to a secured
+// cluster. The zero value leaves sarama's plaintext defaults alone, which is
+// what local docker-compose expects.
+type kafkaAuth struct {
+	mechanism string // PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512; empty disables SASL
+	user      string
+	password  string
+	tls       bool
+}
+
+// kafkaAuthFromEnv reads KAFKA_SASL_MECHANISM, KAFKA_SASL_USER,
+// KAFKA_SASL_PASSWORD and KAFKA_TLS_ENABLE.
+func kafkaAuthFromEnv() (kafkaAuth, error) {
+	a := kafkaAuth{
+		mechanism: strings.ToUpper(strings.TrimSpace(os.Getenv("KAFKA_SASL_MECHANISM"))),
+		user:      os.Getenv("KAFKA_SASL_USER"),
+		password:  os.Getenv("KAFKA_SASL_PASSWORD"),
+		tls:       getenv("KAFKA_TLS_ENABLE", "false") == "true",
+	}
+	switch a.mechanism {
+	case "":
+		return a, nil
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+	default:
+		return kafkaAuth{}, fmt.Errorf("unsupported KAFKA_SASL_MECHANISM %q (want PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512)", a.mechanism)
+	}
+	if a.user == "" || a.password == "" {
+		return kafkaAuth{}, fmt.Errorf("KAFKA_SASL_USER and KAFKA_SASL_PASSWORD are required with KAFKA_SASL_MECHANISM=%s", a.mechanism)
+	}
+	return a, nil
+}
+
+func (a kafkaAuth) apply(cfg *sarama.Config) {
+	if a.tls {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if a.mechanism == "" {
+		return
+	}
+
+	cfg.Net.SASL.Enable = true
+	cfg.Net.SASL.Handshake = true
+	cfg.Net.SASL.User = a.user
+	cfg.Net.SASL.Password = a.password
+	cfg.Net.SASL.Mechanism = sarama.SASLMechanism(a.mechanism)
+	switch a.mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA512}
+		}
+	}
+}
+
+// scramClient adapts xdg-go/scram to sarama.SCRAMClient.
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
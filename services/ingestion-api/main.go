@@ -1,18 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TelemetryEvent struct {
@@ -30,11 +45,58 @@ type TelemetryEvent struct {
 	IngestedAt  time.Time         `json:"ingested_at"`
 	SchemaVer   int               `json:"schema_version"`
 	Environment string            `json:"environment"`
+	// Fraction of traffic kept by head sampling; consumers scale counts by 1/SamplingRate
+	SamplingRate float64 `json:"sampling_rate"`
 }
 
 type Server struct {
-	producer sarama.SyncProducer
-	topic    string
+	producer     Producer
+	async        bool
+	topic        string
+	env          string
+	format       string // MESSAGE_FORMAT: formatJSON or formatProtobuf
+	maxBatchSize int
+	maxLatencyMs int // 0 disables the upper bound
+	maxBodyBytes int64
+	partitionKey string // see messageKey
+
+	// Failed sync publishes are retried publishRetries more times, then
+	// written to spool (nil disables spooling)
+	publishRetries int
+	retryBackoff   time.Duration
+	spool          *spool
+
+	// Timestamp bounds: events further than maxFutureSkew ahead are rejected;
+	// events older than maxEventAge are handled per oldPolicy (0 disables).
+	maxFutureSkew time.Duration
+	maxEventAge   time.Duration
+	oldPolicy     string
+
+	// Optional allowlists; empty accepts any service or customer
+	allowedServices         map[string]bool
+	allowedCustomerPrefixes []string
+
+	// Environments a request may pick with the X-Environment header; nil
+	// ignores the header and tags every event with env
+	allowedEnvironments map[string]bool
+
+	// limits is nil when RATE_LIMIT_PER_CUSTOMER is unset
+	limits *customerLimiter
+
+	// schema replaces the built-in required-field check when EVENT_SCHEMA_PATH is set
+	schema *eventSchema
+
+	// compat accepts legacy field names (COMPAT_MODE=true)
+	compat bool
+
+	// Fraction of non-error events kept; see sampling.go
+	sampleRate float64
+
+	// breaker is nil when BREAKER_FAILURES is 0
+	breaker *breaker
+
+	// enrich stamps server-derived metadata onto every accepted event
+	enrich func(ev *TelemetryEvent)
 }
 
 func main() {
@@ -42,126 +104,888 @@ func main() {
 	topic := getenv("KAFKA_TOPIC", "telemetry.events")
 	port := getenv("PORT", "8080")
 	env := getenv("ENVIRONMENT", "local")
+	mode := getenv("PRODUCER_MODE", "sync")
 
-	producer, err := newProducer(strings.Split(kafkaBrokers, ","))
+	if mode != "sync" && mode != "async" {
+		log.Fatalf("invalid PRODUCER_MODE %q (want sync or async)", mode)
+	}
+	format := strings.ToLower(getenv("MESSAGE_FORMAT", formatJSON))
+	if format != formatJSON && format != formatProtobuf {
+		log.Fatalf("invalid MESSAGE_FORMAT %q (want %s or %s)", format, formatJSON, formatProtobuf)
+	}
+	auth, err := kafkaAuthFromEnv()
+	if err != nil {
+		log.Fatalf("invalid kafka auth config: %v", err)
+	}
+	// KAFKA_COMPRESSION is none, gzip, snappy, lz4 or zstd
+	var compression sarama.CompressionCodec
+	if err := compression.UnmarshalText([]byte(strings.ToLower(getenv("KAFKA_COMPRESSION", "snappy")))); err != nil {
+		log.Fatalf("invalid KAFKA_COMPRESSION: %v", err)
+	}
+	producer, async, err := newProducer(strings.Split(kafkaBrokers, ","), mode, auth, compression)
 	if err != nil {
 		log.Fatalf("failed to create kafka producer: %v", err)
 	}
 	defer func() { _ = producer.Close() }()
 
-	s := &Server{producer: producer, topic: topic}
+	ready, err := newReadinessChecker(strings.Split(kafkaBrokers, ","), topic, getenvDuration("READINESS_CACHE_TTL", 5*time.Second), auth)
+	if err != nil {
+		log.Fatalf("failed to create kafka readiness client: %v", err)
+	}
+	defer func() { _ = ready.Close() }()
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
+
+	s := &Server{
+		producer:     producer,
+		async:        async,
+		topic:        topic,
+		env:          env,
+		format:       format,
+		maxBatchSize: getenvInt("MAX_BATCH_SIZE", 1000),
+		maxLatencyMs: getenvInt("MAX_LATENCY_MS", 600000),
+		maxBodyBytes: int64(getenvInt("MAX_REQUEST_BYTES", 1<<20)),
+		partitionKey: strings.ToLower(getenv("PARTITION_KEY", partitionKeyCustomer)),
+
+		maxFutureSkew: getenvDuration("MAX_FUTURE_SKEW", 24*time.Hour),
+		maxEventAge:   getenvDuration("MAX_EVENT_AGE", 0),
+		oldPolicy:     getenv("OLD_TIMESTAMP_POLICY", "reject"),
+
+		allowedCustomerPrefixes: getenvList("ALLOWED_CUSTOMER_PREFIXES"),
+
+		publishRetries: getenvInt("PUBLISH_RETRIES", 2),
+		retryBackoff:   getenvDuration("PUBLISH_RETRY_BACKOFF", 200*time.Millisecond),
+
+		limits:  newCustomerLimiter(getenvFloat("RATE_LIMIT_PER_CUSTOMER", 0), getenvInt("RATE_LIMIT_BURST", 0)),
+		breaker: newBreaker(getenvInt("BREAKER_FAILURES", 5), getenvDuration("BREAKER_COOLDOWN", 30*time.Second)),
+
+		compat:     getenv("COMPAT_MODE", "false") == "true",
+		sampleRate: getenvFloat("SAMPLE_RATE", 1),
+	}
+	if s.sampleRate < 0 || s.sampleRate > 1 {
+		log.Fatalf("SAMPLE_RATE must be between 0 and 1, got %g", s.sampleRate)
+	}
+	if services := getenvList("ALLOWED_SERVICES"); len(services) > 0 {
+		s.allowedServices = make(map[string]bool, len(services))
+		for _, svc := range services {
+			s.allowedServices[svc] = true
+		}
+	}
+	if envs := getenvList("ENVIRONMENT_HEADER_ALLOWLIST"); len(envs) > 0 {
+		s.allowedEnvironments = make(map[string]bool, len(envs))
+		for _, e := range envs {
+			s.allowedEnvironments[e] = true
+		}
+		log.Printf("%s header accepted for environments %s", environmentHeader, strings.Join(envs, ","))
+	}
+	if path := getenv("EVENT_SCHEMA_PATH", ""); path != "" {
+		if s.schema, err = loadEventSchema(path); err != nil {
+			log.Fatalf("invalid EVENT_SCHEMA_PATH: %v", err)
+		}
+		log.Printf("validating events against %s", path)
+	}
+	if !validPartitionKey(s.partitionKey) {
+		log.Fatalf("invalid PARTITION_KEY %q (want customer, service, trace or random)", s.partitionKey)
+	}
+	if s.oldPolicy != "reject" && s.oldPolicy != "clamp" {
+		log.Fatalf("invalid OLD_TIMESTAMP_POLICY %q (want reject or clamp)", s.oldPolicy)
+	}
+	s.enrich = func(ev *TelemetryEvent) {
+		ev.SamplingRate = s.samplingRate(ev)
+	}
 
 	mux := http.NewServeMux()
+	// Liveness only: restarting the pod won't fix an unreachable broker
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	})
-	mux.HandleFunc("/ingest", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+	mux.Handle("/readyz", ready)
+	mux.Handle("/metrics", metricsHandler())
+	// Best-effort per instance; a shared store would be needed to dedupe across replicas
+	idem := newIdempotencyCache(getenvInt("IDEMPOTENCY_CACHE_SIZE", 10000), getenvDuration("IDEMPOTENCY_TTL", 10*time.Minute))
+	mux.HandleFunc("/ingest", idem.wrap(s.handleIngest))
+	mux.HandleFunc("/ingest/batch", s.handleIngestBatch)
+	mux.HandleFunc("/ingest/validate", s.handleValidate)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if s.limits != nil {
+		go s.limits.cleanup(ctx, getenvDuration("RATE_LIMIT_IDLE_TTL", 10*time.Minute))
+	}
+
+	if dir := getenv("SPOOL_DIR", ""); dir != "" && !async {
+		s.spool, err = newSpool(dir, int64(getenvInt("SPOOL_MAX_BYTES", 256<<20)))
+		if err != nil {
+			log.Fatalf("spool dir error: %v", err)
 		}
-		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
-		defer cancel()
+		go s.spool.replay(ctx, producer, getenvDuration("SPOOL_REPLAY_INTERVAL", 30*time.Second))
+		log.Printf("events that fail to publish will spool to %s", dir)
+	}
 
-		var ev TelemetryEvent
-		dec := json.NewDecoder(r.Body)
-		dec.DisallowUnknownFields()
-		if err := dec.Decode(&ev); err != nil {
-			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
-			return
+	addr := ":" + port
+	srv := &http.Server{Addr: addr, Handler: withLogging(mux)}
+	go func() {
+		log.Printf("ingestion-api listening on %s (kafka=%s topic=%s env=%s producer=%s)", addr, kafkaBrokers, topic, env, mode)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("http server error: %v", err)
 		}
+	}()
 
-		// Fill defaults / enforce required fields
-		now := time.Now().UTC()
-		if ev.Timestamp.IsZero() {
-			ev.Timestamp = now
-		} else {
-			ev.Timestamp = ev.Timestamp.UTC()
-		}
-		ev.IngestedAt = now
-		ev.SchemaVer = 1
-		ev.Environment = env
-
-		if strings.TrimSpace(ev.Service) == "" ||
-			strings.TrimSpace(ev.CustomerID) == "" ||
-			strings.TrimSpace(ev.Endpoint) == "" ||
-			strings.TrimSpace(ev.Method) == "" ||
-			ev.StatusCode == 0 {
-			http.Error(w, "missing required fields: service, customer_id, endpoint, method, status_code", http.StatusBadRequest)
+	<-ctx.Done()
+	stop()
+
+	// Drain requests first; the deferred producer Close then publishes (or, in
+	// async mode, flushes) everything those requests accepted.
+	drain := time.Duration(getenvInt("SHUTDOWN_TIMEOUT_SECS", 20)) * time.Second
+	log.Printf("shutdown: draining in-flight requests (timeout %s)", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: drain incomplete: %v", err)
+	}
+	log.Printf("shutdown: http server stopped, closing kafka producer")
+}
+
+func (s *Server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	env, err := s.environment(r)
+	if err != nil {
+		eventsRejected.WithLabelValues(rejectReason(err)).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// NDJSON goes through the same Idempotency-Key cache as single events:
+	// a repeated key replays the summary. A stream that fails part-way gets a
+	// 5xx, which isn't cached, so retrying it re-publishes the chunks that
+	// already went out.
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/x-ndjson" {
+		s.handleIngestNDJSON(w, r, env)
+		return
+	}
+	// Continue the caller's trace when it sent a traceparent header
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "ingest", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var ev TelemetryEvent
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	raw, err := s.decodeEvent(dec, &ev)
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid json")
+		writeDecodeError(w, "invalid json", err)
+		return
+	}
+
+	// Events without their own trace_id share the span's, so the stored
+	// event and the exported trace can be joined
+	if sc := span.SpanContext(); ev.TraceID == "" && sc.HasTraceID() {
+		ev.TraceID = sc.TraceID().String()
+	}
+
+	now := time.Now().UTC()
+	if err := s.prepare(&ev, raw, env, now); err != nil {
+		eventsRejected.WithLabelValues(rejectReason(err)).Inc()
+		span.SetStatus(codes.Error, err.Error())
+		var rle *rateLimitError
+		if errors.As(err, &rle) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rle.retryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
 			return
 		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(
+		attribute.String("tigerscope.service", ev.Service),
+		attribute.String("tigerscope.customer_id", ev.CustomerID),
+		attribute.Int("tigerscope.status_code", ev.StatusCode),
+		attribute.String("tigerscope.trace_id", ev.TraceID),
+		attribute.String("tigerscope.request_id", ev.RequestID),
+	)
 
-		if ev.TraceID == "" {
-			ev.TraceID = randomHex(16)
+	if !s.sampledIn(&ev) {
+		eventsSampledOut.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status":     "dropped",
+			"sampled":    false,
+			"trace_id":   ev.TraceID,
+			"request_id": ev.RequestID,
+		})
+		return
+	}
+
+	msg, err := s.message(ev, now)
+	if err != nil {
+		span.SetStatus(codes.Error, "marshal error")
+		http.Error(w, "marshal error", http.StatusInternalServerError)
+		return
+	}
+
+	partition, offset, err := s.sendWithRetry(ctx, msg)
+	if err != nil {
+		publishFailures.Inc()
+		span.RecordError(err)
+		if s.spool != nil {
+			serr := s.spool.write(msg)
+			if serr == nil {
+				// Accepted for later delivery, not yet in Kafka
+				span.SetStatus(codes.Error, "kafka publish failed, spooled")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"status":     "spooled",
+					"trace_id":   ev.TraceID,
+					"request_id": ev.RequestID,
+				})
+				return
+			}
+			log.Printf("spool write failed: %v", serr)
 		}
-		ev.RequestID = randomHex(12)
+		span.SetStatus(codes.Error, "kafka publish failed")
+		s.writePublishError(w, err)
+		return
+	}
+	eventsAccepted.Inc()
+	if !s.async {
+		span.SetAttributes(
+			attribute.Int("messaging.kafka.partition", int(partition)),
+			attribute.Int64("messaging.kafka.offset", offset),
+		)
+	}
+
+	select {
+	case <-ctx.Done():
+		http.Error(w, "request timeout", http.StatusGatewayTimeout)
+		return
+	default:
+	}
+
+	resp := map[string]any{
+		"status":     "accepted",
+		"topic":      s.topic,
+		"partition":  partition,
+		"offset":     offset,
+		"trace_id":   ev.TraceID,
+		"request_id": ev.RequestID,
+	}
+	if s.async {
+		// Only queued so far; delivery failures surface in metrics, not here
+		resp["status"] = "queued"
+		delete(resp, "partition")
+		delete(resp, "offset")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleValidate is a dry run of /ingest for producers' CI: the event goes
+// through the same decode and prepare steps but is never published, and the
+// normalized event (or the rejection) is returned. trace_id and request_id in
+// the response are generated for the dry run only. Validations count against
+// the customer's rate limit like real events, but not towards the ingest
+// metrics.
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	env, err := s.environment(r)
+	if err != nil {
+		writeValidation(w, http.StatusBadRequest, map[string]any{"valid": false, "reason": rejectReason(err), "error": err.Error()})
+		return
+	}
+
+	var ev TelemetryEvent
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	raw, err := s.decodeEvent(dec, &ev)
+	if err != nil {
+		code := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		writeValidation(w, code, map[string]any{"valid": false, "reason": "invalid_json", "error": err.Error()})
+		return
+	}
+
+	if err := s.prepare(&ev, raw, env, time.Now().UTC()); err != nil {
+		code := http.StatusBadRequest
+		var rle *rateLimitError
+		if errors.As(err, &rle) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rle.retryAfter.Seconds()))))
+			code = http.StatusTooManyRequests
+		}
+		writeValidation(w, code, map[string]any{"valid": false, "reason": rejectReason(err), "error": err.Error()})
+		return
+	}
+	writeValidation(w, http.StatusOK, map[string]any{"valid": true, "event": ev})
+}
 
-		b, err := json.Marshal(ev)
+func writeValidation(w http.ResponseWriter, code int, body map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+type batchRejection struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// handleIngestBatch accepts a JSON array of events. Each element is validated
+// on its own; valid events are published with a single SendMessages call and
+// invalid ones are reported back by index rather than failing the batch.
+func (s *Server) handleIngestBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	env, err := s.environment(r)
+	if err != nil {
+		eventsRejected.WithLabelValues(rejectReason(err)).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	tok, err := dec.Token()
+	if err != nil {
+		writeDecodeError(w, "invalid json", err)
+		return
+	}
+	if tok != json.Delim('[') {
+		http.Error(w, "invalid json: expected an array of events", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	var (
+		msgs       []*sarama.ProducerMessage
+		rejected   []batchRejection
+		total      int
+		sampledOut int
+	)
+	for dec.More() {
+		if total >= s.maxBatchSize {
+			eventsRejected.WithLabelValues("batch_too_large").Inc()
+			http.Error(w, "batch exceeds MAX_BATCH_SIZE of "+strconv.Itoa(s.maxBatchSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		idx := total
+		total++
+
+		var ev TelemetryEvent
+		raw, err := s.decodeEvent(dec, &ev)
 		if err != nil {
-			http.Error(w, "marshal error", http.StatusInternalServerError)
+			writeDecodeError(w, "invalid json at index "+strconv.Itoa(idx), err)
 			return
 		}
+		if err := s.prepare(&ev, raw, env, now); err != nil {
+			eventsRejected.WithLabelValues(rejectReason(err)).Inc()
+			rejected = append(rejected, batchRejection{Index: idx, Reason: err.Error()})
+			continue
+		}
+		if !s.sampledIn(&ev) {
+			eventsSampledOut.Inc()
+			sampledOut++
+			continue
+		}
+		msg, err := s.message(ev, now)
+		if err != nil {
+			rejected = append(rejected, batchRejection{Index: idx, Reason: "marshal error"})
+			continue
+		}
+		msg.Metadata = idx
+		msgs = append(msgs, msg)
+	}
+	if _, err := dec.Token(); err != nil {
+		writeDecodeError(w, "invalid json", err)
+		return
+	}
+
+	accepted, failed, err := s.publish(msgs)
+	if err != nil {
+		s.writePublishError(w, err)
+		return
+	}
+	if len(failed) > 0 {
+		rejected = append(rejected, failed...)
+		sort.Slice(rejected, func(i, j int) bool { return rejected[i].Index < rejected[j].Index })
+	}
+
+	status := http.StatusAccepted
+	switch {
+	case accepted+sampledOut == 0 && total > 0:
+		status = http.StatusBadRequest
+	case len(rejected) > 0:
+		status = http.StatusMultiStatus
+	}
+
+	if rejected == nil {
+		rejected = []batchRejection{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"accepted":    accepted,
+		"sampled_out": sampledOut,
+		"rejected":    rejected,
+		"topic":       s.topic,
+	})
+}
+
+// publish sends msgs in one SendMessages call. Messages must carry their
+// request index in Metadata; per-message failures come back as rejections.
+// A non-nil error means the whole call failed and nothing can be assumed sent.
+func (s *Server) publish(msgs []*sarama.ProducerMessage) (int, []batchRejection, error) {
+	if len(msgs) == 0 {
+		return 0, nil, nil
+	}
+	if !s.breaker.allow(time.Now()) {
+		return 0, nil, errBreakerOpen
+	}
+	accepted := len(msgs)
+	var rejected []batchRejection
+	err := s.producer.SendMessages(msgs)
+	// Per-message failures alongside successes mean the brokers are reachable
+	var perr sarama.ProducerErrors
+	if errors.As(err, &perr) && len(perr) < len(msgs) {
+		s.breaker.record(nil, time.Now())
+	} else {
+		s.breaker.record(err, time.Now())
+	}
+	if err != nil {
+		if !errors.As(err, &perr) {
+			publishFailures.Add(float64(len(msgs)))
+			return 0, nil, err
+		}
+		for _, pe := range perr {
+			idx, _ := pe.Msg.Metadata.(int)
+			rejected = append(rejected, batchRejection{Index: idx, Reason: "kafka publish failed: " + pe.Err.Error()})
+		}
+		accepted -= len(perr)
+		publishFailures.Add(float64(len(perr)))
+	}
+	eventsAccepted.Add(float64(accepted))
+	return accepted, rejected, nil
+}
 
-		// Key by customer_id (keeps ordering per customer in Kafka partitions)
-		msg := &sarama.ProducerMessage{
-			Topic: s.topic,
-			Key:   sarama.StringEncoder(ev.CustomerID),
-			Value: sarama.ByteEncoder(b),
-			Headers: []sarama.RecordHeader{
-				{Key: []byte("service"), Value: []byte(ev.Service)},
-				{Key: []byte("env"), Value: []byte(env)},
-			},
-			Timestamp: now,
+// handleIngestNDJSON streams an application/x-ndjson body, one event per
+// line. Lines are validated like /ingest/batch elements but published every
+// MAX_BATCH_SIZE lines, so a large upload never sits in memory whole. Only
+// individual lines are bounded (by MAX_REQUEST_BYTES), not the stream; a
+// longer line is rejected like an invalid one. Rejections report the 1-based
+// line number as index.
+func (s *Server) handleIngestNDJSON(w http.ResponseWriter, r *http.Request, env string) {
+	br := bufio.NewReader(r.Body)
+	var buf []byte
+
+	var (
+		msgs       []*sarama.ProducerMessage
+		rejected   []batchRejection
+		accepted   int
+		total      int
+		sampledOut int
+		line       int
+	)
+	flush := func() error {
+		n, failed, err := s.publish(msgs)
+		if err != nil {
+			return err
 		}
+		accepted += n
+		rejected = append(rejected, failed...)
+		msgs = msgs[:0]
+		return nil
+	}
 
-		partition, offset, err := s.producer.SendMessage(msg)
+	for {
+		next, tooLong, err := readLine(br, buf, int(s.maxBodyBytes))
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			http.Error(w, "kafka publish failed: "+err.Error(), http.StatusBadGateway)
+			// Earlier chunks are already published; report how far we got
+			http.Error(w, "read error after line "+strconv.Itoa(line)+" ("+strconv.Itoa(accepted)+" events accepted): "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		buf = next
+		line++
+		if tooLong {
+			total++
+			eventsRejected.WithLabelValues("line_too_large").Inc()
+			rejected = append(rejected, batchRejection{Index: line, Reason: "line exceeds " + strconv.FormatInt(s.maxBodyBytes, 10) + " bytes"})
+			continue
+		}
+		b := bytes.TrimSpace(next)
+		if len(b) == 0 {
+			continue
+		}
+		total++
 
-		select {
-		case <-ctx.Done():
-			http.Error(w, "request timeout", http.StatusGatewayTimeout)
-			return
-		default:
+		var ev TelemetryEvent
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		raw, err := s.decodeEvent(dec, &ev)
+		if err != nil {
+			eventsRejected.WithLabelValues("invalid_json").Inc()
+			rejected = append(rejected, batchRejection{Index: line, Reason: "invalid json: " + err.Error()})
+			continue
+		}
+		now := time.Now().UTC()
+		if err := s.prepare(&ev, raw, env, now); err != nil {
+			eventsRejected.WithLabelValues(rejectReason(err)).Inc()
+			rejected = append(rejected, batchRejection{Index: line, Reason: err.Error()})
+			continue
+		}
+		if !s.sampledIn(&ev) {
+			eventsSampledOut.Inc()
+			sampledOut++
+			continue
+		}
+		msg, err := s.message(ev, now)
+		if err != nil {
+			rejected = append(rejected, batchRejection{Index: line, Reason: "marshal error"})
+			continue
 		}
+		msg.Metadata = line
+		msgs = append(msgs, msg)
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusAccepted)
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"status":    "accepted",
-			"topic":     s.topic,
-			"partition": partition,
-			"offset":    offset,
-			"trace_id":  ev.TraceID,
-			"request_id": ev.RequestID,
-		})
+		if len(msgs) >= s.maxBatchSize {
+			if err := flush(); err != nil {
+				http.Error(w, "kafka publish failed after "+strconv.Itoa(accepted)+" events: "+err.Error(), publishErrorStatus(err))
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		http.Error(w, "kafka publish failed after "+strconv.Itoa(accepted)+" events: "+err.Error(), publishErrorStatus(err))
+		return
+	}
+	sort.Slice(rejected, func(i, j int) bool { return rejected[i].Index < rejected[j].Index })
+
+	status := http.StatusAccepted
+	switch {
+	case accepted+sampledOut == 0 && total > 0:
+		status = http.StatusBadRequest
+	case len(rejected) > 0:
+		status = http.StatusMultiStatus
+	}
+
+	if rejected == nil {
+		rejected = []batchRejection{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"accepted":    accepted,
+		"sampled_out": sampledOut,
+		"rejected":    rejected,
+		"topic":       s.topic,
 	})
+}
 
-	addr := ":" + port
-	log.Printf("ingestion-api listening on %s (kafka=%s topic=%s env=%s)", addr, kafkaBrokers, topic, env)
-	log.Fatal(http.ListenAndServe(addr, withLogging(mux)))
+// readLine reads the next line from br into buf, without its newline. The
+// rest of a line longer than max is read and discarded, and reported as
+// tooLong so the caller can skip it and carry on. err is io.EOF once the
+// stream is exhausted.
+func readLine(br *bufio.Reader, buf []byte, max int) (line []byte, tooLong bool, err error) {
+	buf = buf[:0]
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if !tooLong {
+			buf = append(buf, chunk...)
+			if len(bytes.TrimSuffix(buf, []byte("\n"))) > max {
+				buf, tooLong = buf[:0], true
+			}
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && (len(buf) > 0 || tooLong):
+			// last line without a trailing newline
+			return buf, tooLong, nil
+		case err != nil:
+			return nil, false, err
+		}
+		return bytes.TrimSuffix(buf, []byte("\n")), tooLong, nil
+	}
 }
 
-func newProducer(brokers []string) (sarama.SyncProducer, error) {
-	cfg := sarama.NewConfig()
-	cfg.Producer.RequiredAcks = sarama.WaitForAll
-	cfg.Producer.Retry.Max = 5
-	cfg.Producer.Return.Successes = true
-	cfg.Producer.Idempotent = true
-	cfg.Net.MaxOpenRequests = 1
-	cfg.Version = sarama.V2_8_0_0
+// writeDecodeError reports a request body that could not be decoded, using
+// 413 when the body ran past MAX_REQUEST_BYTES.
+func writeDecodeError(w http.ResponseWriter, msg string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		eventsRejected.WithLabelValues("body_too_large").Inc()
+		http.Error(w, "request body exceeds "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	eventsRejected.WithLabelValues("invalid_json").Inc()
+	http.Error(w, msg+": "+err.Error(), http.StatusBadRequest)
+}
 
-	return sarama.NewSyncProducer(brokers, cfg)
+// defaultSchemaVersion is assumed for events that omit schema_version.
+const defaultSchemaVersion = 1
+
+// supportedSchemaVersions are the event layouts writer-consumer knows how to
+// decode. Add a version here only once the consumer handles it. v2 requires
+// ingested_at and sampling_rate, which prepare always sets.
+var supportedSchemaVersions = map[int]bool{
+	1: true,
+	2: true,
+}
+
+// prepare fills server-side defaults and enforces required fields, using the
+// JSON Schema when one is configured (raw is then the event as sent). env is
+// the request's environment, from s.environment.
+func (s *Server) prepare(ev *TelemetryEvent, raw json.RawMessage, env string, now time.Time) error {
+	if s.schema != nil {
+		if err := s.schema.validate(raw); err != nil {
+			return err
+		}
+	}
+
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = now
+	} else {
+		ev.Timestamp = ev.Timestamp.UTC()
+	}
+	ev.IngestedAt = now
+	if ev.SchemaVer == 0 {
+		ev.SchemaVer = defaultSchemaVersion
+	}
+	if !supportedSchemaVersions[ev.SchemaVer] {
+		return &validationError{reason: "schema_version", msg: fmt.Sprintf("unsupported schema_version %d", ev.SchemaVer)}
+	}
+	ev.Environment = env
+	s.enrich(ev)
+
+	if s.schema == nil && (strings.TrimSpace(ev.Service) == "" ||
+		strings.TrimSpace(ev.CustomerID) == "" ||
+		strings.TrimSpace(ev.Endpoint) == "" ||
+		strings.TrimSpace(ev.Method) == "" ||
+		ev.StatusCode == 0) {
+		return &validationError{reason: "missing_fields", msg: "missing required fields: service, customer_id, endpoint, method, status_code"}
+	}
+	if err := s.validateAllowlists(ev); err != nil {
+		return err
+	}
+	if err := s.validateRanges(ev); err != nil {
+		return err
+	}
+	if err := s.validateTimestamp(ev, now); err != nil {
+		return err
+	}
+	// Last, so events rejected for other reasons don't spend tokens
+	if s.limits != nil {
+		if err := s.limits.allow(ev.CustomerID, now); err != nil {
+			return err
+		}
+	}
+
+	if ev.TraceID == "" {
+		ev.TraceID = randomHex(16)
+	}
+	ev.RequestID = randomHex(12)
+	return nil
+}
+
+// validateTimestamp keeps event times close enough to now that they land in
+// sensible hour partitions. With OLD_TIMESTAMP_POLICY=clamp, events older than
+// MAX_EVENT_AGE are re-stamped with the ingestion time instead of rejected.
+func (s *Server) validateTimestamp(ev *TelemetryEvent, now time.Time) error {
+	if s.maxFutureSkew > 0 && ev.Timestamp.After(now.Add(s.maxFutureSkew)) {
+		return &validationError{reason: "timestamp", msg: fmt.Sprintf("timestamp %s is more than %s in the future", ev.Timestamp.Format(time.RFC3339), s.maxFutureSkew)}
+	}
+	if s.maxEventAge > 0 && ev.Timestamp.Before(now.Add(-s.maxEventAge)) {
+		if s.oldPolicy == "clamp" {
+			ev.Timestamp = now
+			return nil
+		}
+		return &validationError{reason: "timestamp", msg: fmt.Sprintf("timestamp %s is older than %s", ev.Timestamp.Format(time.RFC3339), s.maxEventAge)}
+	}
+	return nil
+}
+
+// environmentHeader lets a gateway fronting several environments tag each
+// request's events, when ENVIRONMENT_HEADER_ALLOWLIST is set.
+const environmentHeader = "X-Environment"
+
+// environment picks the environment for a request's events: the header value
+// if the allowlist is configured and the header is present, else ENVIRONMENT.
+// Values outside the allowlist are rejected rather than falling back, so a
+// misconfigured gateway doesn't silently mix environments.
+func (s *Server) environment(r *http.Request) (string, error) {
+	v := strings.TrimSpace(r.Header.Get(environmentHeader))
+	if s.allowedEnvironments == nil || v == "" {
+		return s.env, nil
+	}
+	if !s.allowedEnvironments[v] {
+		return "", &validationError{reason: "environment_not_allowed", msg: fmt.Sprintf("%s %q is not in ENVIRONMENT_HEADER_ALLOWLIST", environmentHeader, v)}
+	}
+	return v, nil
+}
+
+// validateAllowlists guards against misconfigured producers flooding storage
+// with new services or customers. Service names must match ALLOWED_SERVICES
+// exactly; customer IDs must start with one of ALLOWED_CUSTOMER_PREFIXES.
+func (s *Server) validateAllowlists(ev *TelemetryEvent) error {
+	if s.allowedServices != nil && !s.allowedServices[ev.Service] {
+		return &validationError{reason: "service_not_allowed", msg: fmt.Sprintf("service %q is not in ALLOWED_SERVICES", ev.Service)}
+	}
+	if len(s.allowedCustomerPrefixes) > 0 {
+		for _, p := range s.allowedCustomerPrefixes {
+			if strings.HasPrefix(ev.CustomerID, p) {
+				return nil
+			}
+		}
+		return &validationError{reason: "customer_not_allowed", msg: fmt.Sprintf("customer_id %q does not match ALLOWED_CUSTOMER_PREFIXES", ev.CustomerID)}
+	}
+	return nil
+}
+
+// httpMethods are the verbs accepted in the method field.
+var httpMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// validateRanges rejects values that would skew downstream error-rate and
+// latency math. The method is normalized to upper case.
+func (s *Server) validateRanges(ev *TelemetryEvent) error {
+	if ev.StatusCode < 100 || ev.StatusCode > 599 {
+		return &validationError{reason: "status_code", msg: fmt.Sprintf("status_code %d out of range 100-599", ev.StatusCode)}
+	}
+	if ev.LatencyMs < 0 {
+		return &validationError{reason: "latency_ms", msg: fmt.Sprintf("latency_ms %d must be >= 0", ev.LatencyMs)}
+	}
+	if s.maxLatencyMs > 0 && ev.LatencyMs > s.maxLatencyMs {
+		return &validationError{reason: "latency_ms", msg: fmt.Sprintf("latency_ms %d exceeds maximum of %d", ev.LatencyMs, s.maxLatencyMs)}
+	}
+	method := strings.ToUpper(strings.TrimSpace(ev.Method))
+	if !httpMethods[method] {
+		return &validationError{reason: "method", msg: fmt.Sprintf("method %q is not a recognized HTTP verb", ev.Method)}
+	}
+	ev.Method = method
+	return nil
+}
+
+// writePublishError reports a failed publish: 503 with Retry-After while the
+// breaker is open, 502 otherwise.
+func (s *Server) writePublishError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errBreakerOpen) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.breaker.retryAfter(time.Now()).Seconds()))))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "kafka publish failed: "+err.Error(), http.StatusBadGateway)
+}
+
+func publishErrorStatus(err error) int {
+	if errors.Is(err, errBreakerOpen) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// sendWithRetry publishes msg, retrying up to publishRetries times with a
+// linear backoff. Sarama already retries internally, so these extra attempts
+// only cover failures that outlast its retry budget, such as a leader election.
+// While the breaker is open it fails straight away with errBreakerOpen.
+func (s *Server) sendWithRetry(ctx context.Context, msg *sarama.ProducerMessage) (int32, int64, error) {
+	if !s.breaker.allow(time.Now()) {
+		return 0, 0, errBreakerOpen
+	}
+	partition, offset, err := s.sendAttempts(ctx, msg)
+	s.breaker.record(err, time.Now())
+	return partition, offset, err
+}
+
+func (s *Server) sendAttempts(ctx context.Context, msg *sarama.ProducerMessage) (int32, int64, error) {
+	partition, offset, err := s.producer.SendMessage(msg)
+	for attempt := 1; err != nil && attempt <= s.publishRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return 0, 0, err
+		case <-time.After(time.Duration(attempt) * s.retryBackoff):
+		}
+		partition, offset, err = s.producer.SendMessage(msg)
+	}
+	return partition, offset, err
+}
+
+// message builds the Kafka record for an event, encoded per MESSAGE_FORMAT.
+func (s *Server) message(ev TelemetryEvent, now time.Time) (*sarama.ProducerMessage, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if s.format == formatProtobuf {
+		b, err = marshalProtobuf(ev)
+	} else {
+		b, err = json.Marshal(ev)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   messageKey(s.partitionKey, ev),
+		Value: sarama.ByteEncoder(b),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("service"), Value: []byte(ev.Service)},
+			{Key: []byte("env"), Value: []byte(ev.Environment)},
+			{Key: []byte("format"), Value: []byte(s.format)},
+		},
+		Timestamp: now,
+	}, nil
 }
 
 func withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
+		elapsed := time.Since(start)
+
+		// ServeMux records the matched pattern on r; label by it to keep cardinality bounded
+		handler := r.Pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		requestDuration.WithLabelValues(handler).Observe(elapsed.Seconds())
+		log.Printf("%s %s %s", r.Method, r.URL.Path, elapsed)
 	})
 }
 
@@ -179,7 +1003,6 @@ func randomHex(nBytes int) string {
 	return hex.EncodeToString(b)
 }
 
-// optional helper if you want to parse ints from env later
 func getenvInt(key string, def int) int {
 	v := os.Getenv(key)
 	if strings.TrimSpace(v) == "" {
@@ -191,3 +1014,38 @@ func getenvInt(key string, def int) int {
 	}
 	return i
 }
+
+func getenvFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if strings.TrimSpace(v) == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+// getenvList splits a comma-separated variable, dropping empty entries.
+func getenvList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if strings.TrimSpace(v) == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
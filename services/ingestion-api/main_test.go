@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// fakeProducer records published messages instead of talking to Kafka.
+type fakeProducer struct {
+	err error
+
+	mu   sync.Mutex
+	msgs []*sarama.ProducerMessage
+}
+
+func (p *fakeProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, 0, p.err
+	}
+	p.msgs = append(p.msgs, msg)
+	return 0, int64(len(p.msgs) - 1), nil
+}
+
+func (p *fakeProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *fakeProducer) Close() error { return nil }
+
+func (p *fakeProducer) sent() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.msgs)
+}
+
+// testServer is a Server with main's defaults, publishing to a fakeProducer.
+func testServer() (*Server, *fakeProducer) {
+	p := &fakeProducer{}
+	s := &Server{
+		producer:      p,
+		topic:         "telemetry.events",
+		env:           "test",
+		format:        formatJSON,
+		maxBatchSize:  1000,
+		maxLatencyMs:  600000,
+		maxBodyBytes:  1 << 20,
+		partitionKey:  partitionKeyCustomer,
+		maxFutureSkew: 24 * time.Hour,
+		oldPolicy:     "reject",
+		sampleRate:    1,
+	}
+	s.enrich = func(ev *TelemetryEvent) {
+		ev.SamplingRate = s.samplingRate(ev)
+	}
+	return s, p
+}
+
+// validEvent is an event that passes every built-in check.
+func validEvent() TelemetryEvent {
+	return TelemetryEvent{
+		Service:    "checkout",
+		CustomerID: "cust-1",
+		Endpoint:   "/pay",
+		Method:     "POST",
+		StatusCode: 200,
+		LatencyMs:  42,
+	}
+}
+
+// postIngest sends body to /ingest and returns the recorded response.
+func postIngest(s *Server, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	s.handleIngest(rec, req)
+	return rec
+}
+
+func eventJSON(t *testing.T, ev TelemetryEvent) string {
+	t.Helper()
+	b, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestValidateRanges(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		latency    int
+		method     string
+		wantReason string // "" for accepted
+		wantMethod string
+	}{
+		{"lowest status", 100, 0, "GET", "", "GET"},
+		{"highest status", 599, 0, "GET", "", "GET"},
+		{"status below range", 99, 0, "GET", "status_code", ""},
+		{"status above range", 600, 0, "GET", "status_code", ""},
+		{"negative latency", 200, -1, "GET", "latency_ms", ""},
+		{"latency at ceiling", 200, 600000, "GET", "", "GET"},
+		{"latency over ceiling", 200, 600001, "GET", "latency_ms", ""},
+		{"lower-case method", 200, 1, " patch ", "", "PATCH"},
+		{"unknown method", 200, 1, "FETCH", "method", ""},
+		{"empty method", 200, 1, "", "method", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := testServer()
+			ev := validEvent()
+			ev.StatusCode, ev.LatencyMs, ev.Method = tt.status, tt.latency, tt.method
+			err := s.validateRanges(&ev)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				if ev.Method != tt.wantMethod {
+					t.Errorf("method = %q, want %q", ev.Method, tt.wantMethod)
+				}
+				return
+			}
+			var ve *validationError
+			if !errors.As(err, &ve) || ve.reason != tt.wantReason {
+				t.Errorf("err = %v, want a %s validation error", err, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestIngestRejectsOutOfRangeWith400(t *testing.T) {
+	s, p := testServer()
+	ev := validEvent()
+	ev.StatusCode = 99999
+	rec := postIngest(s, eventJSON(t, ev), nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "status_code 99999") {
+		t.Errorf("body %q does not name the bad field", rec.Body.String())
+	}
+	if p.sent() != 0 {
+		t.Errorf("published %d messages for a rejected event", p.sent())
+	}
+}
+
+func TestIngestBodyLimit(t *testing.T) {
+	s, _ := testServer()
+	body := eventJSON(t, validEvent())
+	tests := []struct {
+		name  string
+		limit int64
+		want  int
+	}{
+		{"under limit", int64(len(body)) + 1, http.StatusAccepted},
+		{"exactly at limit", int64(len(body)), http.StatusAccepted},
+		{"over limit", int64(len(body)) - 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.maxBodyBytes = tt.limit
+			if rec := postIngest(s, body, nil); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestIngestBatchBodyLimit(t *testing.T) {
+	s, p := testServer()
+	body := "[" + eventJSON(t, validEvent()) + "," + eventJSON(t, validEvent()) + "]"
+	s.maxBodyBytes = int64(len(body)) - 10
+
+	req := httptest.NewRequest(http.MethodPost, "/ingest/batch", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.handleIngestBatch(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rec.Code)
+	}
+	if p.sent() != 0 {
+		t.Errorf("published %d messages from an oversized batch", p.sent())
+	}
+}
+
+func TestIngestNDJSONRejectsBadLines(t *testing.T) {
+	valid := func() string {
+		ev := validEvent()
+		ev.Timestamp = time.Now()
+		return eventJSON(t, ev)
+	}
+	oversized := validEvent()
+	oversized.Attributes = map[string]string{"blob": strings.Repeat("x", 10000)}
+
+	tests := []struct {
+		name         string
+		lines        []string
+		trailing     bool // end the body with a newline
+		wantAccepted int
+		wantRejected []int
+	}{
+		{"mixed", []string{valid(), valid(), `{"service":`, eventJSON(t, oversized), "", valid()}, false, 3, []int{3, 4}},
+		{"oversized last line", []string{valid(), eventJSON(t, oversized)}, false, 1, []int{2}},
+		{"oversized with newline", []string{eventJSON(t, oversized), valid()}, true, 1, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, p := testServer()
+			s.maxBodyBytes = 500
+			s.maxBatchSize = 2 // publish a chunk before the bad lines
+			handler := newIdempotencyCache(10, time.Minute).wrap(s.handleIngest)
+			body := strings.Join(tt.lines, "\n")
+			if tt.trailing {
+				body += "\n"
+			}
+			send := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/x-ndjson")
+				req.Header.Set(idempotencyHeader, "upload-1")
+				rec := httptest.NewRecorder()
+				handler(rec, req)
+				return rec
+			}
+
+			rec := send()
+			if rec.Code != http.StatusMultiStatus {
+				t.Fatalf("status = %d (%s), want 207", rec.Code, rec.Body.String())
+			}
+			var resp struct {
+				Accepted int              `json:"accepted"`
+				Rejected []batchRejection `json:"rejected"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var lines []int
+			for _, r := range resp.Rejected {
+				lines = append(lines, r.Index)
+			}
+			if resp.Accepted != tt.wantAccepted || !slices.Equal(lines, tt.wantRejected) {
+				t.Errorf("accepted %d, rejected lines %v; want %d and %v", resp.Accepted, lines, tt.wantAccepted, tt.wantRejected)
+			}
+			if p.sent() != tt.wantAccepted {
+				t.Errorf("published %d messages, want %d", p.sent(), tt.wantAccepted)
+			}
+
+			// A retried upload with the same key replays the summary
+			if again := send(); again.Body.String() != rec.Body.String() || p.sent() != tt.wantAccepted {
+				t.Errorf("retry published again or answered %q", again.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateTimestamp(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		ts      time.Time
+		maxAge  time.Duration
+		policy  string
+		wantErr bool
+		want    time.Time
+	}{
+		{"now", now, 0, "reject", false, now},
+		{"at future skew", now.Add(24 * time.Hour), 0, "reject", false, now.Add(24 * time.Hour)},
+		{"past future skew", now.Add(24*time.Hour + time.Second), 0, "reject", true, time.Time{}},
+		{"old, no age limit", now.AddDate(-3, 0, 0), 0, "reject", false, now.AddDate(-3, 0, 0)},
+		{"within max age", now.Add(-time.Hour), 2 * time.Hour, "reject", false, now.Add(-time.Hour)},
+		{"too old, reject", now.Add(-3 * time.Hour), 2 * time.Hour, "reject", true, time.Time{}},
+		{"too old, clamp", now.Add(-3 * time.Hour), 2 * time.Hour, "clamp", false, now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := testServer()
+			s.maxEventAge, s.oldPolicy = tt.maxAge, tt.policy
+			ev := validEvent()
+			ev.Timestamp = tt.ts
+			err := s.validateTimestamp(&ev, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !ev.Timestamp.Equal(tt.want) {
+				t.Errorf("timestamp = %s, want %s", ev.Timestamp, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareDefaultsZeroTimestamp(t *testing.T) {
+	s, _ := testServer()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ev := validEvent()
+	if err := s.prepare(&ev, nil, s.env, now); err != nil {
+		t.Fatal(err)
+	}
+	if !ev.Timestamp.Equal(now) || !ev.IngestedAt.Equal(now) {
+		t.Errorf("timestamp = %s, ingested_at = %s, want both %s", ev.Timestamp, ev.IngestedAt, now)
+	}
+}
+
+func TestPrepareSchemaVersions(t *testing.T) {
+	tests := []struct {
+		sent, want int // want 0 for a rejection
+	}{
+		{0, 1},
+		{1, 1},
+		{2, 2},
+		{3, 0},
+		{-1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.sent), func(t *testing.T) {
+			s, _ := testServer()
+			ev := validEvent()
+			ev.SchemaVer = tt.sent
+			err := s.prepare(&ev, nil, s.env, time.Now())
+			if tt.want == 0 {
+				var ve *validationError
+				if !errors.As(err, &ve) || ve.reason != "schema_version" {
+					t.Errorf("err = %v, want a schema_version validation error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// writer-consumer rejects v2 events without these
+			if ev.SchemaVer != tt.want || ev.IngestedAt.IsZero() || ev.SamplingRate <= 0 || ev.SamplingRate > 1 {
+				t.Errorf("schema_version = %d, ingested_at = %s, sampling_rate = %v; want version %d with both set",
+					ev.SchemaVer, ev.IngestedAt, ev.SamplingRate, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngestRejectsFutureTimestamp(t *testing.T) {
+	s, _ := testServer()
+	ev := validEvent()
+	ev.Timestamp = time.Now().Add(48 * time.Hour)
+	rec := postIngest(s, eventJSON(t, ev), nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "in the future") {
+		t.Errorf("got %d %q, want 400 naming the future timestamp", rec.Code, rec.Body.String())
+	}
+}
+
+func TestValidateAllowlists(t *testing.T) {
+	tests := []struct {
+		name       string
+		services   map[string]bool
+		prefixes   []string
+		service    string
+		customer   string
+		wantReason string
+	}{
+		{"no allowlists", nil, nil, "anything", "anyone", ""},
+		{"allowed service", map[string]bool{"checkout": true}, nil, "checkout", "c1", ""},
+		{"service not allowed", map[string]bool{"checkout": true}, nil, "Checkout", "c1", "service_not_allowed"},
+		{"allowed customer prefix", nil, []string{"acme-", "globex-"}, "checkout", "globex-7", ""},
+		{"customer not allowed", nil, []string{"acme-"}, "checkout", "initech-1", "customer_not_allowed"},
+		{"both allowlists", map[string]bool{"checkout": true}, []string{"acme-"}, "checkout", "acme-1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := testServer()
+			s.allowedServices, s.allowedCustomerPrefixes = tt.services, tt.prefixes
+			ev := validEvent()
+			ev.Service, ev.CustomerID = tt.service, tt.customer
+			err := s.validateAllowlists(&ev)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Errorf("rejected: %v", err)
+				}
+				return
+			}
+			var ve *validationError
+			if !errors.As(err, &ve) || ve.reason != tt.wantReason {
+				t.Errorf("err = %v, want a %s validation error", err, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestIngestRejectsDisallowedService(t *testing.T) {
+	s, p := testServer()
+	s.allowedServices = map[string]bool{"search": true}
+	rec := postIngest(s, eventJSON(t, validEvent()), nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "ALLOWED_SERVICES") {
+		t.Errorf("got %d %q, want 400 naming ALLOWED_SERVICES", rec.Code, rec.Body.String())
+	}
+	if p.sent() != 0 {
+		t.Errorf("published %d messages for a rejected event", p.sent())
+	}
+}
+
+func TestEnvironmentHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowlist  map[string]bool
+		header     string
+		want       string
+		wantReject bool
+	}{
+		{"no allowlist ignores header", nil, "staging", "test", false},
+		{"no header", map[string]bool{"staging": true}, "", "test", false},
+		{"allowed", map[string]bool{"staging": true}, " staging ", "staging", false},
+		{"not allowed", map[string]bool{"staging": true}, "prod", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := testServer()
+			s.allowedEnvironments = tt.allowlist
+			req := httptest.NewRequest(http.MethodPost, "/ingest", nil)
+			if tt.header != "" {
+				req.Header.Set(environmentHeader, tt.header)
+			}
+			got, err := s.environment(req)
+			var ve *validationError
+			if tt.wantReject != errors.As(err, &ve) {
+				t.Fatalf("err = %v, wantReject %v", err, tt.wantReject)
+			}
+			if got != tt.want {
+				t.Errorf("environment = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// Producer publishes messages to Kafka. sarama.SyncProducer satisfies it
+// directly; asyncProducer adapts sarama.AsyncProducer to the same shape.
+type Producer interface {
+	SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error)
+	SendMessages(msgs []*sarama.ProducerMessage) error
+	Close() error
+}
+
+func producerConfig(auth kafkaAuth, compression sarama.CompressionCodec) *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	// Consumers decompress batches transparently
+	cfg.Producer.Compression = compression
+	cfg.Producer.Retry.Max = 5
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Return.Errors = true
+	cfg.Producer.Idempotent = true
+	cfg.Net.MaxOpenRequests = 1
+	cfg.Version = sarama.V2_8_0_0
+	auth.apply(cfg)
+	return cfg
+}
+
+// Partition key strategies for PARTITION_KEY. The key picks the Kafka
+// partition, and Kafka only orders events within a partition:
+//
+//   - customer (default): one customer's events stay in order, but a very busy
+//     customer pins all of its traffic to a single partition.
+//   - service: per-service ordering; skew follows the busiest service, and
+//     there are usually fewer services than partitions.
+//   - trace: events of one trace stay together and load spreads evenly, but
+//     there is no ordering across a customer's traces.
+//   - random: no key, so sarama spreads events randomly; the most even load
+//     and no ordering guarantee at all.
+const (
+	partitionKeyCustomer = "customer"
+	partitionKeyService  = "service"
+	partitionKeyTrace    = "trace"
+	partitionKeyRandom   = "random"
+)
+
+func validPartitionKey(strategy string) bool {
+	switch strategy {
+	case partitionKeyCustomer, partitionKeyService, partitionKeyTrace, partitionKeyRandom:
+		return true
+	}
+	return false
+}
+
+// messageKey returns the record key for ev under strategy. A nil key makes
+// sarama's hash partitioner choose a random partition.
+func messageKey(strategy string, ev TelemetryEvent) sarama.Encoder {
+	switch strategy {
+	case partitionKeyService:
+		return sarama.StringEncoder(ev.Service)
+	case partitionKeyTrace:
+		return sarama.StringEncoder(ev.TraceID)
+	case partitionKeyRandom:
+		return nil
+	default:
+		return sarama.StringEncoder(ev.CustomerID)
+	}
+}
+
+// newProducer builds the producer for PRODUCER_MODE: "sync" (default) waits
+// for acks on every request, "async" returns as soon as the message is queued.
+func newProducer(brokers []string, mode string, auth kafkaAuth, compression sarama.CompressionCodec) (Producer, bool, error) {
+	if mode == "async" {
+		p, err := sarama.NewAsyncProducer(brokers, producerConfig(auth, compression))
+		if err != nil {
+			return nil, false, err
+		}
+		return newAsyncProducer(p), true, nil
+	}
+	p, err := sarama.NewSyncProducer(brokers, producerConfig(auth, compression))
+	return p, false, err
+}
+
+// asyncProducer enqueues messages without waiting for broker acks. A
+// background goroutine drains the result channels, tracking in-flight and
+// failed messages in metrics since callers never see the outcome.
+type asyncProducer struct {
+	p    sarama.AsyncProducer
+	done sync.WaitGroup
+}
+
+func newAsyncProducer(p sarama.AsyncProducer) *asyncProducer {
+	ap := &asyncProducer{p: p}
+	ap.done.Add(2)
+	go func() {
+		defer ap.done.Done()
+		for range p.Successes() {
+			producerInFlight.Dec()
+		}
+	}()
+	go func() {
+		defer ap.done.Done()
+		for perr := range p.Errors() {
+			producerInFlight.Dec()
+			publishFailures.Inc()
+			log.Printf("async kafka publish failed: %v", perr.Err)
+		}
+	}()
+	return ap
+}
+
+// SendMessage queues msg; partition and offset are not known yet and are
+// returned as -1.
+func (ap *asyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	producerInFlight.Inc()
+	ap.p.Input() <- msg
+	return -1, -1, nil
+}
+
+func (ap *asyncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		producerInFlight.Inc()
+		ap.p.Input() <- msg
+	}
+	return nil
+}
+
+// Close flushes queued messages and waits for their results to be drained.
+func (ap *asyncProducer) Close() error {
+	ap.p.AsyncClose()
+	ap.done.Wait()
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"tigerscope/ingestion-api/gen/telemetryv1"
+)
+
+//go:generate protoc -I../../proto --go_out=. --go_opt=module=tigerscope/ingestion-api --go_opt=Mtelemetry/v1/event.proto=tigerscope/ingestion-api/gen/telemetryv1 telemetry/v1/event.proto
+
+// Message formats for MESSAGE_FORMAT; the name travels in the "format" Kafka
+// header so writer-consumer can pick the matching decoder.
+const (
+	formatJSON     = "json"
+	formatProtobuf = "protobuf"
+)
+
+// marshalProtobuf encodes ev as a tigerscope.telemetry.v1.TelemetryEvent from
+// proto/telemetry/v1/event.proto. An unset timestamp is sent as 0.
+func marshalProtobuf(ev TelemetryEvent) ([]byte, error) {
+	millis := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.UnixMilli()
+	}
+	return proto.Marshal(&telemetryv1.TelemetryEvent{
+		TimestampMs:   millis(ev.Timestamp),
+		Service:       ev.Service,
+		CustomerId:    ev.CustomerID,
+		Endpoint:      ev.Endpoint,
+		Method:        ev.Method,
+		StatusCode:    int32(ev.StatusCode),
+		LatencyMs:     int32(ev.LatencyMs),
+		TraceId:       ev.TraceID,
+		Error:         ev.Error,
+		Attributes:    ev.Attributes,
+		RequestId:     ev.RequestID,
+		IngestedAtMs:  millis(ev.IngestedAt),
+		SchemaVersion: int32(ev.SchemaVer),
+		Environment:   ev.Environment,
+		SamplingRate:  ev.SamplingRate,
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"tigerscope/ingestion-api/gen/telemetryv1"
+)
+
+// TestMarshalProtobufMatchesJSON checks that an event published as protobuf
+// carries the same fields as the JSON encoding of it.
+func TestMarshalProtobufMatchesJSON(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 13, 0, 0, 123e6, time.UTC)
+	full := validEvent()
+	full.Timestamp, full.IngestedAt = ts, ts.Add(time.Second)
+	full.StatusCode, full.Error, full.TraceID, full.RequestID = 502, "upstream timeout", "t-1", "r-1"
+	full.Attributes = map[string]string{"region": "eu-west-1", "build": "1234"}
+	full.SchemaVer, full.Environment, full.SamplingRate = 2, "prod", 0.25
+
+	for name, ev := range map[string]TelemetryEvent{"full": full, "minimal": validEvent()} {
+		t.Run(name, func(t *testing.T) {
+			js, err := json.Marshal(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fromJSON TelemetryEvent
+			if err := json.Unmarshal(js, &fromJSON); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := marshalProtobuf(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pb telemetryv1.TelemetryEvent
+			if err := proto.Unmarshal(b, &pb); err != nil {
+				t.Fatal(err)
+			}
+			fromProto := TelemetryEvent{
+				Service:      pb.Service,
+				CustomerID:   pb.CustomerId,
+				Endpoint:     pb.Endpoint,
+				Method:       pb.Method,
+				StatusCode:   int(pb.StatusCode),
+				LatencyMs:    int(pb.LatencyMs),
+				TraceID:      pb.TraceId,
+				Error:        pb.Error,
+				Attributes:   pb.Attributes,
+				RequestID:    pb.RequestId,
+				SchemaVer:    int(pb.SchemaVersion),
+				Environment:  pb.Environment,
+				SamplingRate: pb.SamplingRate,
+			}
+			// Unset timestamps travel as 0
+			if pb.TimestampMs != 0 {
+				fromProto.Timestamp = time.UnixMilli(pb.TimestampMs).UTC()
+			}
+			if pb.IngestedAtMs != 0 {
+				fromProto.IngestedAt = time.UnixMilli(pb.IngestedAtMs).UTC()
+			}
+			if !reflect.DeepEqual(fromProto, fromJSON) {
+				t.Errorf("protobuf carries\n%+v\nJSON carries\n%+v", fromProto, fromJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// customerLimiter is a token bucket per customer_id, so one noisy tenant
+// can't crowd out the rest of the pipeline. Limits are per instance: with N
+// replicas a customer can get up to N times the configured rate.
+type customerLimiter struct {
+	rate  rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+// newCustomerLimiter returns nil when perSec is 0, which disables limiting.
+func newCustomerLimiter(perSec float64, burst int) *customerLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(int(math.Ceil(perSec)), 1)
+	}
+	return &customerLimiter{
+		rate:     rate.Limit(perSec),
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+	}
+}
+
+// rateLimitError is returned by prepare when a customer is over its limit.
+type rateLimitError struct {
+	customer   string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("customer %q is over its rate limit, retry after %s", e.customer, e.retryAfter)
+}
+
+// allow takes one token for customer, or reports how long until one is free.
+func (cl *customerLimiter) allow(customer string, now time.Time) error {
+	cl.mu.Lock()
+	e, ok := cl.limiters[customer]
+	if !ok {
+		e = &limiterEntry{lim: rate.NewLimiter(cl.rate, cl.burst)}
+		cl.limiters[customer] = e
+	}
+	e.lastSeen = now
+	cl.mu.Unlock()
+
+	if e.lim.AllowN(now, 1) {
+		return nil
+	}
+	r := e.lim.ReserveN(now, 1)
+	wait := r.DelayFrom(now)
+	r.CancelAt(now)
+	return &rateLimitError{customer: customer, retryAfter: wait}
+}
+
+// cleanup drops limiters idle for longer than idle, every idle, until ctx
+// ends. A dropped customer starts again with a full bucket.
+func (cl *customerLimiter) cleanup(ctx context.Context, idle time.Duration) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cl.mu.Lock()
+			for customer, e := range cl.limiters {
+				if now.Sub(e.lastSeen) > idle {
+					delete(cl.limiters, customer)
+				}
+			}
+			cl.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// readinessChecker backs /readyz. It issues a metadata request for the ingest
+// topic and caches the outcome for ttl, so frequent probes from several
+// kubelets don't turn into a metadata request each.
+type readinessChecker struct {
+	client sarama.Client
+	topic  string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newReadinessChecker(brokers []string, topic string, ttl time.Duration, auth kafkaAuth) (*readinessChecker, error) {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_8_0_0
+	// Fail fast: a probe that hangs is as bad as one that lies
+	cfg.Net.DialTimeout = 2 * time.Second
+	cfg.Net.ReadTimeout = 2 * time.Second
+	cfg.Net.WriteTimeout = 2 * time.Second
+	cfg.Metadata.Retry.Max = 0
+	cfg.Metadata.RefreshFrequency = 0 // only refresh when probed
+	auth.apply(cfg)
+
+	client, err := sarama.NewClient(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &readinessChecker{client: client, topic: topic, ttl: ttl}, nil
+}
+
+func (rc *readinessChecker) check() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.checked.IsZero() && time.Since(rc.checked) < rc.ttl {
+		return rc.err
+	}
+	rc.err = rc.client.RefreshMetadata(rc.topic)
+	rc.checked = time.Now()
+	return rc.err
+}
+
+func (rc *readinessChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := rc.check(); err != nil {
+		http.Error(w, "kafka unreachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (rc *readinessChecker) Close() error {
+	return rc.client.Close()
+}
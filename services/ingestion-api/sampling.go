@@ -0,0 +1,36 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Head-based sampling keeps SAMPLE_RATE of events, decided by trace_id so a
+// trace is kept or dropped as a whole, across requests and replicas. Server
+// errors are always kept. Kept events record the rate they were sampled at,
+// which query-api's ?estimate=true uses to scale counts back up.
+
+// samplingRate is the rate ev is sampled at: 1 for server errors, otherwise
+// SAMPLE_RATE.
+func (s *Server) samplingRate(ev *TelemetryEvent) float64 {
+	if ev.StatusCode >= 500 {
+		return 1
+	}
+	return s.sampleRate
+}
+
+// sampledIn reports whether a prepared event (trace_id and sampling_rate set)
+// should be published.
+func (s *Server) sampledIn(ev *TelemetryEvent) bool {
+	if ev.SamplingRate >= 1 {
+		return true
+	}
+	return traceFraction(ev.TraceID) < ev.SamplingRate
+}
+
+// traceFraction hashes a trace ID onto [0, 1).
+func traceFraction(traceID string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(traceID))
+	return float64(h.Sum64()>>11) / math.Exp2(53)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTraceFraction(t *testing.T) {
+	kept := 0
+	for range 10000 {
+		// Random like the trace IDs prepare assigns
+		id := randomHex(16)
+		f := traceFraction(id)
+		if f < 0 || f >= 1 {
+			t.Fatalf("traceFraction(%q) = %v, want [0, 1)", id, f)
+		}
+		if f != traceFraction(id) {
+			t.Fatalf("traceFraction(%q) changed between calls", id)
+		}
+		if f < 0.25 {
+			kept++
+		}
+	}
+	// Hashed IDs should spread evenly enough for a rate to hold
+	if kept < 2300 || kept > 2700 {
+		t.Errorf("%d of 10000 traces under 0.25, want about 2500", kept)
+	}
+}
+
+func TestSampledIn(t *testing.T) {
+	const id = "4bf92f3577b34da6a3ce929d0e0e4736"
+	f := traceFraction(id)
+	tests := []struct {
+		name   string
+		rate   float64
+		status int
+		want   bool
+	}{
+		{"rate 1 keeps all", 1, 200, true},
+		{"rate 0 drops", 0, 200, false},
+		{"rate above the trace's fraction", f + 0.01, 200, true},
+		{"rate at the trace's fraction", f, 200, false},
+		{"rate below the trace's fraction", f - 0.01, 200, false},
+		{"server errors kept at rate 0", 0, 503, true},
+		{"server errors kept below the fraction", f - 0.01, 500, true},
+		{"client errors sampled", 0, 404, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Separate servers stand in for separate replicas
+			for range 3 {
+				s, _ := testServer()
+				s.sampleRate = tt.rate
+				ev := validEvent()
+				ev.StatusCode, ev.TraceID = tt.status, id
+				s.enrich(&ev)
+				if got := s.sampledIn(&ev); got != tt.want {
+					t.Fatalf("sampledIn = %v at rate %v (trace fraction %v), want %v", got, tt.rate, f, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestSampledOut(t *testing.T) {
+	s, p := testServer()
+	s.sampleRate = 0
+
+	rec := postIngest(s, eventJSON(t, validEvent()), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 for a sampled-out event", rec.Code)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["sampled"] != false || resp["status"] != "dropped" || resp["trace_id"] == "" || resp["request_id"] == "" {
+		t.Errorf("response = %v, want sampled false with the trace and request IDs", resp)
+	}
+	if p.sent() != 0 {
+		t.Errorf("published %d messages for a sampled-out event", p.sent())
+	}
+
+	ev := validEvent()
+	ev.StatusCode = 500
+	if rec := postIngest(s, eventJSON(t, ev), nil); rec.Code != http.StatusAccepted || p.sent() != 1 {
+		t.Errorf("server error: status %d, %d published; want 202 and the event kept", rec.Code, p.sent())
+	}
+}
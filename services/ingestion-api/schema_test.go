@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testEventSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "required": ["service", "customer_id", "endpoint", "method", "status_code"],
+  "properties": {
+    "service": {"type": "string", "pattern": "^[a-z][a-z0-9-]*$"},
+    "customer_id": {"type": "string", "minLength": 1},
+    "endpoint": {"type": "string"},
+    "method": {"type": "string"},
+    "status_code": {"type": "integer"},
+    "latency_ms": {"type": "integer", "minimum": 0}
+  }
+}`
+
+func writeSchema(t *testing.T, doc string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "event.schema.json")
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEventSchema(t *testing.T) {
+	if _, err := loadEventSchema(writeSchema(t, testEventSchema)); err != nil {
+		t.Fatalf("valid schema: %v", err)
+	}
+	if _, err := loadEventSchema(writeSchema(t, `{"type": 12}`)); err == nil {
+		t.Error("invalid schema loaded without error")
+	}
+	if _, err := loadEventSchema(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing schema file loaded without error")
+	}
+}
+
+func TestEventSchemaValidate(t *testing.T) {
+	es, err := loadEventSchema(writeSchema(t, testEventSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		doc  string
+		want []string // substrings of the error; nil when valid
+	}{
+		{"valid", `{"service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST","status_code":200,"latency_ms":3}`, nil},
+		{"missing field", `{"service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST"}`, []string{"/: missing properties: 'status_code'"}},
+		{"wrong type", `{"service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST","status_code":"200"}`, []string{"/status_code:"}},
+		{"non-integer number", `{"service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST","status_code":200.5}`, []string{"/status_code:"}},
+		{"several violations", `{"service":"Checkout!","customer_id":"","endpoint":"/pay","method":"POST","status_code":200,"latency_ms":-1}`,
+			[]string{"/service:", "/customer_id:", "/latency_ms:"}},
+		{"not an object", `[1,2]`, []string{"/: "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := es.validate([]byte(tt.doc))
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			var ve *validationError
+			if !errors.As(err, &ve) || ve.reason != "schema" {
+				t.Fatalf("err = %v, want a schema validation error", err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("error %q does not mention %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestWithSchema(t *testing.T) {
+	s, p := testServer()
+	var err error
+	if s.schema, err = loadEventSchema(writeSchema(t, testEventSchema)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postIngest(s, `{"service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST","status_code":200}`, nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("valid event: status %d (%s)", rec.Code, rec.Body.String())
+	}
+
+	rec = postIngest(s, `{"service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST","latency_ms":-5}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid event: status %d, want 400", rec.Code)
+	}
+	for _, w := range []string{"status_code", "/latency_ms"} {
+		if !strings.Contains(rec.Body.String(), w) {
+			t.Errorf("body %q does not name %s", rec.Body.String(), w)
+		}
+	}
+	if p.sent() != 1 {
+		t.Errorf("published %d messages, want only the valid event", p.sent())
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// spooledMessage is a Kafka record that could not be published, as stored on
+// disk. Byte fields are base64 in the JSON.
+type spooledMessage struct {
+	Topic   string                `json:"topic"`
+	Key     []byte                `json:"key,omitempty"`
+	Value   []byte                `json:"value"`
+	Headers []sarama.RecordHeader `json:"headers,omitempty"`
+}
+
+// spool keeps events that failed to publish in SPOOL_DIR, one file per event,
+// and replays them in the background once the brokers are back. Events only
+// live on this instance's disk, so a lost volume loses them.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex // serializes the size check and write
+}
+
+func newSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// write stores msg, failing once the directory holds maxBytes. The file is
+// written under a temporary name and renamed, so replay never reads a partial one.
+func (sp *spool) write(msg *sarama.ProducerMessage) error {
+	rec := spooledMessage{Topic: msg.Topic, Headers: msg.Headers}
+	var err error
+	if msg.Key != nil {
+		if rec.Key, err = msg.Key.Encode(); err != nil {
+			return err
+		}
+	}
+	if rec.Value, err = msg.Value.Encode(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	used, err := spoolSize(sp.dir)
+	if err != nil {
+		return err
+	}
+	if used+int64(len(b)) > sp.maxBytes {
+		return fmt.Errorf("spool full (%d of %d bytes used)", used, sp.maxBytes)
+	}
+
+	name := fmt.Sprintf("%d-%s.json", time.Now().UnixNano(), randomHex(4))
+	tmp := filepath.Join(sp.dir, name+".partial")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(sp.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	eventsSpooled.Inc()
+	spoolBytes.Set(float64(used + int64(len(b))))
+	return nil
+}
+
+// replay publishes spooled events, oldest first, every interval until ctx
+// ends. A failed publish stops the pass; the next one retries from there.
+func (sp *spool) replay(ctx context.Context, producer Producer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if n, err := sp.replayOnce(producer); err != nil {
+			log.Printf("spool replay stopped after %d events: %v", n, err)
+		} else if n > 0 {
+			log.Printf("spool replay published %d events", n)
+		}
+		if used, err := spoolSize(sp.dir); err == nil {
+			spoolBytes.Set(float64(used))
+		}
+	}
+}
+
+func (sp *spool) replayOnce(producer Producer) (int, error) {
+	files, err := filepath.Glob(filepath.Join(sp.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(files) // names start with a timestamp
+
+	sent := 0
+	for _, path := range files {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return sent, err
+		}
+		var rec spooledMessage
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return sent, fmt.Errorf("%s: %w", path, err)
+		}
+
+		msg := &sarama.ProducerMessage{
+			Topic:   rec.Topic,
+			Value:   sarama.ByteEncoder(rec.Value),
+			Headers: rec.Headers,
+		}
+		if rec.Key != nil {
+			msg.Key = sarama.ByteEncoder(rec.Key)
+		}
+		if _, _, err := producer.SendMessage(msg); err != nil {
+			return sent, err
+		}
+		os.Remove(path)
+		eventsAccepted.Inc()
+		sent++
+	}
+	return sent, nil
+}
+
+func spoolSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracer resolves through the global provider, so it stays a no-op until
+// initTracing installs a real one.
+var tracer = otel.Tracer("tigerscope/ingestion-api")
+
+// initTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is
+// set; the exporter reads that and the other standard OTEL_* variables itself.
+// With no endpoint, spans are never recorded or exported. The W3C traceparent
+// propagator is installed either way so incoming trace IDs are still honoured.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if strings.TrimSpace(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", getenv("OTEL_SERVICE_NAME", "ingestion-api")),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// objectLister is the part of *minio.Client used to enumerate parquet files,
+// so the listing cache can be exercised against a fake.
+type objectLister interface {
+	ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+}
+
+// listingCache remembers the sorted parquet keys under a prefix for a short
+// TTL, so dashboard auto-refresh doesn't re-list MinIO on every request.
+// Window pruning and limits are applied per request on top of the cached keys.
+type listingCache struct {
+	lister objectLister
+	bucket string
+	ttl    time.Duration // 0 disables caching
+
+	mu      sync.Mutex
+	entries map[string]listingEntry
+}
+
+type listingEntry struct {
+	keys    []string
+	sizes   []int64 // sizes[i] is the size of keys[i] in bytes
+	fetched time.Time
+}
+
+func newListingCache(lister objectLister, bucket string, ttl time.Duration) *listingCache {
+	return &listingCache{
+		lister:  lister,
+		bucket:  bucket,
+		ttl:     ttl,
+		entries: make(map[string]listingEntry),
+	}
+}
+
+// keys returns the sorted .parquet object keys under prefix.
+func (lc *listingCache) keys(ctx context.Context, prefix string) ([]string, error) {
+	e, err := lc.list(ctx, prefix)
+	return e.keys, err
+}
+
+// objects is keys along with each object's size.
+func (lc *listingCache) objects(ctx context.Context, prefix string) ([]string, []int64, error) {
+	e, err := lc.list(ctx, prefix)
+	return e.keys, e.sizes, err
+}
+
+func (lc *listingCache) list(ctx context.Context, prefix string) (listingEntry, error) {
+	if lc.ttl > 0 {
+		lc.mu.Lock()
+		e, ok := lc.entries[prefix]
+		lc.mu.Unlock()
+		if ok && time.Since(e.fetched) < lc.ttl {
+			return e, nil
+		}
+	}
+
+	opts := minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}
+
+	size := map[string]int64{}
+	var keys []string
+	for obj := range lc.lister.ListObjects(ctx, lc.bucket, opts) {
+		if obj.Err != nil {
+			return listingEntry{}, obj.Err
+		}
+		if strings.HasSuffix(obj.Key, ".parquet") {
+			keys = append(keys, obj.Key)
+			size[obj.Key] = obj.Size
+		}
+	}
+	sort.Strings(keys)
+	sizes := make([]int64, len(keys))
+	for i, key := range keys {
+		sizes[i] = size[key]
+	}
+
+	e := listingEntry{keys: keys, sizes: sizes, fetched: time.Now()}
+	if lc.ttl > 0 {
+		lc.mu.Lock()
+		lc.entries[prefix] = e
+		lc.mu.Unlock()
+	}
+	return e, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// fakeLister serves a fixed set of objects and counts listings.
+type fakeLister struct {
+	objects []minio.ObjectInfo
+	err     error
+	calls   int
+}
+
+func (f *fakeLister) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	f.calls++
+	ch := make(chan minio.ObjectInfo, len(f.objects)+1)
+	for _, obj := range f.objects {
+		ch <- obj
+	}
+	if f.err != nil {
+		ch <- minio.ObjectInfo{Err: f.err}
+	}
+	close(ch)
+	return ch
+}
+
+func TestListingCacheKeys(t *testing.T) {
+	lister := &fakeLister{objects: []minio.ObjectInfo{
+		{Key: "telemetry/parquet/date=2024-05-01/hour=14/b.parquet", Size: 20},
+		{Key: "telemetry/parquet/_manifest.json", Size: 5},
+		{Key: "telemetry/parquet/date=2024-05-01/hour=13/a.parquet", Size: 10},
+	}}
+	lc := newListingCache(lister, "bucket", 0)
+
+	keys, sizes, err := lc.objects(context.Background(), "telemetry/parquet/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKeys := []string{
+		"telemetry/parquet/date=2024-05-01/hour=13/a.parquet",
+		"telemetry/parquet/date=2024-05-01/hour=14/b.parquet",
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("keys = %v, want %v", keys, wantKeys)
+	}
+	if !reflect.DeepEqual(sizes, []int64{10, 20}) {
+		t.Errorf("sizes = %v, want [10 20]", sizes)
+	}
+}
+
+func TestListingCacheTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		wantCalls int
+	}{
+		{"disabled", 0, 2},
+		{"cached", time.Minute, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lister := &fakeLister{objects: []minio.ObjectInfo{{Key: "p/a.parquet"}}}
+			lc := newListingCache(lister, "bucket", tt.ttl)
+			for range 2 {
+				if _, err := lc.keys(context.Background(), "p/"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if lister.calls != tt.wantCalls {
+				t.Errorf("listed %d times, want %d", lister.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestListingCacheErrorNotCached(t *testing.T) {
+	boom := errors.New("boom")
+	lister := &fakeLister{err: boom}
+	lc := newListingCache(lister, "bucket", time.Minute)
+
+	if _, err := lc.keys(context.Background(), "p/"); !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want %v", err, boom)
+	}
+	lister.err = nil
+	lister.objects = []minio.ObjectInfo{{Key: "p/a.parquet"}}
+	keys, err := lc.keys(context.Background(), "p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || lister.calls != 2 {
+		t.Errorf("keys = %v after %d listings, want a fresh listing", keys, lister.calls)
+	}
+}
+
+func TestListingCacheKeyedByPrefix(t *testing.T) {
+	lister := &fakeLister{objects: []minio.ObjectInfo{{Key: "p/a.parquet"}}}
+	lc := newListingCache(lister, "bucket", time.Minute)
+	for _, prefix := range []string{"p/", "q/", "p/", "q/"} {
+		if _, err := lc.keys(context.Background(), prefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lister.calls != 2 {
+		t.Errorf("listed %d times, want once per prefix", lister.calls)
+	}
+}
+
+func TestListingCacheExpires(t *testing.T) {
+	lister := &fakeLister{objects: []minio.ObjectInfo{{Key: "p/a.parquet"}}}
+	lc := newListingCache(lister, "bucket", 10*time.Second)
+	if _, err := lc.keys(context.Background(), "p/"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the entry past the TTL rather than sleeping
+	e := lc.entries["p/"]
+	e.fetched = e.fetched.Add(-11 * time.Second)
+	lc.entries["p/"] = e
+	lister.objects = append(lister.objects, minio.ObjectInfo{Key: "p/b.parquet"})
+
+	keys, err := lc.keys(context.Background(), "p/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lister.calls != 2 || len(keys) != 2 {
+		t.Errorf("keys = %v after %d listings, want an expired entry to be re-listed", keys, lister.calls)
+	}
+}
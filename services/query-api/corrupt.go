@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// skippedFilesHeader lists, comma-separated, the object keys a response left
+// out because they could not be read (QUERY_SKIP_CORRUPT=true).
+const skippedFilesHeader = "X-Skipped-Files"
+
+// badFileRecheck is how long a file that failed to read stays skipped before
+// it is tried again, in case the failure was transient.
+const badFileRecheck = 5 * time.Minute
+
+// fileChecker backs QUERY_SKIP_CORRUPT. One truncated object (say from a
+// flush that crashed mid-upload) makes read_parquet fail every query whose
+// file list includes it, so in this mode each object is read on its own the
+// first time it is listed, and those that error are left out of sources.
+// Objects are immutable once written, so a good result is kept for good.
+type fileChecker struct {
+	qe *QueryEngine
+
+	mu   sync.Mutex
+	good map[string]bool
+	bad  map[string]time.Time // when the key last failed
+}
+
+func newFileChecker(qe *QueryEngine) *fileChecker {
+	return &fileChecker{qe: qe, good: map[string]bool{}, bad: map[string]time.Time{}}
+}
+
+// readable reports whether key can be read, checking it if it hasn't been.
+// A nil checker trusts every file.
+func (fc *fileChecker) readable(ctx context.Context, key string) bool {
+	if fc == nil {
+		return true
+	}
+	fc.mu.Lock()
+	good := fc.good[key]
+	failed, bad := fc.bad[key]
+	fc.mu.Unlock()
+	if good {
+		return true
+	}
+	if bad && time.Since(failed) < badFileRecheck {
+		return false
+	}
+
+	// COUNT(*) is answered from the footer, which is exactly what a
+	// truncated file is missing
+	var n int64
+	err := fc.qe.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM read_parquet(`+sqlString(fc.qe.objectPath(key))+`)`).Scan(&n)
+	if err != nil && ctx.Err() != nil {
+		// Out of time rather than a bad file; don't hold it against the file
+		return true
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err != nil {
+		if !bad {
+			log.Printf("skipping unreadable parquet object %s (delete or rewrite it): %v", key, err)
+		}
+		fc.bad[key] = time.Now()
+		return false
+	}
+	delete(fc.bad, key)
+	fc.good[key] = true
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const mimeTextCSV = "text/csv"
+
+// wantsCSV reports whether the client asked for CSV, via ?format=csv or an
+// Accept header listing text/csv. JSON stays the default.
+func wantsCSV(c echo.Context) bool {
+	if f := c.QueryParam("format"); f != "" {
+		return strings.EqualFold(f, "csv")
+	}
+	for _, part := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == mimeTextCSV {
+			return true
+		}
+	}
+	return false
+}
+
+// respond writes v as JSON, or as CSV when the client asked for it. Columns
+// come from the json tags of the row structs (or the keys of a map), so both
+// encodings share one set of row types.
+func respond(c echo.Context, code int, v any) error {
+	if !wantsCSV(c) {
+		return c.JSON(code, v)
+	}
+	header, records, err := csvTable(v)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if convert := keyConverter(c.QueryParam("case")); convert != nil {
+		for i, h := range header {
+			header[i] = convert(h)
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, mimeTextCSV+"; charset=utf-8")
+	c.Response().WriteHeader(code)
+	w := csv.NewWriter(c.Response())
+	if len(header) > 0 {
+		if err := w.Write(header); err != nil {
+			return err
+		}
+	}
+	if err := w.WriteAll(records); err != nil {
+		return err
+	}
+	return nil
+}
+
+// csvTable flattens v into a header and rows. A slice becomes one row per
+// element; a struct or map becomes a single row. Nested values that don't fit
+// in a cell (maps, slices, structs other than time) are written as JSON.
+func csvTable(v any) ([]string, [][]string, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Slice {
+		header, row, err := csvRecord(rv, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return header, [][]string{row}, nil
+	}
+
+	var header []string
+	records := make([][]string, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		h, row, err := csvRecord(reflect.Indirect(rv.Index(i)), header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header == nil {
+			header = h
+		}
+		records = append(records, row)
+	}
+	return header, records, nil
+}
+
+// csvRecord returns the column names and cells of one struct or map. For maps,
+// header fixes the column order once the first row has chosen it.
+func csvRecord(rv reflect.Value, header []string) ([]string, []string, error) {
+	if rv.Kind() == reflect.Interface {
+		rv = reflect.Indirect(rv.Elem())
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		var names, cells []string
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			cell, err := csvCell(rv.Field(i))
+			if err != nil {
+				return nil, nil, err
+			}
+			names = append(names, name)
+			cells = append(cells, cell)
+		}
+		return names, cells, nil
+
+	case reflect.Map:
+		if header == nil {
+			for _, k := range rv.MapKeys() {
+				header = append(header, fmt.Sprint(k.Interface()))
+			}
+			sort.Strings(header)
+		}
+		cells := make([]string, len(header))
+		for i, name := range header {
+			val := rv.MapIndex(reflect.ValueOf(name))
+			if !val.IsValid() {
+				continue
+			}
+			cell, err := csvCell(val)
+			if err != nil {
+				return nil, nil, err
+			}
+			cells[i] = cell
+		}
+		return header, cells, nil
+	}
+	return nil, nil, fmt.Errorf("cannot write %s as csv", rv.Kind())
+}
+
+func csvCell(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return x.UTC().Format(time.RFC3339), nil
+	case string:
+		return x, nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	case float32:
+		return strconv.FormatFloat(float64(x), 'f', -1, 32), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct, reflect.Pointer:
+		if (v.Kind() == reflect.Map || v.Kind() == reflect.Slice || v.Kind() == reflect.Pointer) && v.IsNil() {
+			return "", nil
+		}
+		b, err := json.Marshal(v.Interface())
+		return string(b), err
+	}
+	return fmt.Sprint(v.Interface()), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"tigerscope/query-api/gen/queryv1"
+)
+
+// The gRPC API is served from the code generated into gen/queryv1 from
+// proto/query/v1/query.proto; rerun go generate after editing the proto.
+// RPCs run the same QueryEngine queries as their HTTP handlers.
+
+// serveGRPC runs the gRPC API on lis until ctx ends, then stops taking new
+// RPCs and returns once those in flight have finished.
+func (qe *QueryEngine) serveGRPC(ctx context.Context, lis net.Listener, timeout time.Duration) error {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(grpcTimeout(timeout)))
+	queryv1.RegisterQueryServiceServer(srv, &grpcServer{qe: qe})
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	if err := srv.Serve(lis); err != nil {
+		return err
+	}
+	// Serve returns as soon as GracefulStop closes the listener
+	<-stopped
+	return nil
+}
+
+// grpcTimeout is queryTimeout for RPCs.
+func grpcTimeout(d time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if d <= 0 {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+type grpcServer struct {
+	queryv1.UnimplementedQueryServiceServer
+	qe *QueryEngine
+}
+
+// grpcWindow applies parseWindow's defaults to a request's from/to.
+func grpcWindow(from, to *timestamppb.Timestamp) (timeWindow, error) {
+	now := time.Now().UTC()
+	win := timeWindow{From: now.Add(-time.Hour), To: now}
+	if from != nil {
+		win.From = from.AsTime()
+	}
+	if to != nil {
+		win.To = to.AsTime()
+	}
+	if win.To.Before(win.From) {
+		return timeWindow{}, status.Error(codes.InvalidArgument, "from must be before to")
+	}
+	return win, nil
+}
+
+// source is parquetSource for RPCs; the number of objects dropped by
+// QUERY_MAX_FILES goes back as x-dropped-files response metadata.
+func (s *grpcServer) source(ctx context.Context, win timeWindow, dedup bool) (string, error) {
+	src, _, dropped, err := s.qe.readableSource(ctx, win, "")
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if dropped > 0 {
+		_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(droppedFilesHeader), strconv.Itoa(dropped)))
+	}
+	if src != "" && dedup {
+		src = dedupSource(src)
+	}
+	return src, nil
+}
+
+func (s *grpcServer) Summary(ctx context.Context, req *queryv1.SummaryRequest) (*queryv1.SummaryResponse, error) {
+	win, err := grpcWindow(req.GetFrom(), req.GetTo())
+	if err != nil {
+		return nil, err
+	}
+	src, err := s.source(ctx, win, req.GetDedup())
+	if err != nil || src == "" {
+		return &queryv1.SummaryResponse{}, err
+	}
+
+	f := &queryFilter{}
+	f.add("timestamp BETWEEN ? AND ?", win.From, win.To)
+	sum, err := s.qe.summary(ctx, src, f)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &queryv1.SummaryResponse{
+		TotalRows:      sum.TotalRows,
+		LatestIngested: nullTimestamp(sum.LatestIngested),
+	}
+	for _, e := range sum.ByEnvironment {
+		resp.ByEnvironment = append(resp.ByEnvironment, &queryv1.EnvironmentSummary{
+			Environment:    e.Environment,
+			TotalRows:      e.TotalRows,
+			Errors:         e.Errors,
+			LatestIngested: nullTimestamp(e.LatestIngested),
+		})
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) ErrorRate(ctx context.Context, req *queryv1.ErrorRateRequest) (*queryv1.ErrorRateResponse, error) {
+	win, err := grpcWindow(req.GetFrom(), req.GetTo())
+	if err != nil {
+		return nil, err
+	}
+	src, err := s.source(ctx, win, req.GetDedup())
+	if err != nil || src == "" {
+		return &queryv1.ErrorRateResponse{}, err
+	}
+
+	// Same filters as metricFilter, taken from the request instead of the query string
+	f := &queryFilter{}
+	f.add("timestamp BETWEEN ? AND ?", win.From, win.To)
+	if v := strings.TrimSpace(req.GetService()); v != "" {
+		f.add("service = ?", v)
+	}
+	if v := strings.TrimSpace(req.GetEnvironment()); v != "" {
+		f.add("environment = ?", v)
+	}
+	if v := strings.TrimSpace(req.GetEndpoint()); v != "" {
+		f.add("endpoint = ?", v)
+	}
+	if v := strings.TrimSpace(req.GetMethod()); v != "" {
+		f.add("method = ?", strings.ToUpper(v))
+	}
+	w := "1"
+	if req.GetEstimate() {
+		w = estimatedWeight
+	}
+
+	rows, err := s.qe.errorRates(ctx, src, f, w)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &queryv1.ErrorRateResponse{}
+	for _, r := range rows {
+		resp.Services = append(resp.Services, &queryv1.ServiceErrorRate{
+			Service:       r.Service,
+			TotalRequests: r.Total,
+			Errors:        r.Errors,
+			ErrorRatePct:  r.ErrorRatePct,
+		})
+	}
+	return resp, nil
+}
+
+func nullTimestamp(t sql.NullTime) *timestamppb.Timestamp {
+	if !t.Valid {
+		return nil
+	}
+	return timestamppb.New(t.Time)
+}
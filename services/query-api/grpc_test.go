@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"tigerscope/query-api/gen/queryv1"
+)
+
+// grpcClient serves qe over an in-process listener for the length of the test.
+func grpcClient(t *testing.T, qe *QueryEngine) queryv1.QueryServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- qe.serveGRPC(ctx, lis, time.Minute) }()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serveGRPC: %v", err)
+		}
+	})
+	return queryv1.NewQueryServiceClient(conn)
+}
+
+var (
+	grpcFrom = timestamppb.New(time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC))
+	grpcTo   = timestamppb.New(time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC))
+)
+
+func TestGRPCSummary(t *testing.T) {
+	client := grpcClient(t, sampledEngine(t))
+	resp, err := client.Summary(context.Background(), &queryv1.SummaryRequest{From: grpcFrom, To: grpcTo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetTotalRows() != 3 || len(resp.GetByEnvironment()) != 1 {
+		t.Fatalf("got %v, want 3 rows in one environment", resp)
+	}
+	env := resp.GetByEnvironment()[0]
+	if env.GetEnvironment() != "prod" || env.GetTotalRows() != 3 || env.GetErrors() != 1 {
+		t.Errorf("environment summary %v, want prod with 3 rows and 1 error", env)
+	}
+	if got := resp.GetLatestIngested().AsTime(); !got.Equal(time.Date(2024, 5, 1, 13, 30, 0, 0, time.UTC)) {
+		t.Errorf("latest ingested %s", got)
+	}
+}
+
+func TestGRPCErrorRate(t *testing.T) {
+	client := grpcClient(t, sampledEngine(t))
+	tests := []struct {
+		name          string
+		req           *queryv1.ErrorRateRequest
+		total, errors int64
+	}{
+		{"plain", &queryv1.ErrorRateRequest{From: grpcFrom, To: grpcTo}, 3, 1},
+		{"estimate", &queryv1.ErrorRateRequest{From: grpcFrom, To: grpcTo, Estimate: true}, 5, 2},
+		{"service filter", &queryv1.ErrorRateRequest{From: grpcFrom, To: grpcTo, Service: "checkout"}, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.ErrorRate(context.Background(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.GetServices()) != 1 {
+				t.Fatalf("got %v, want one service", resp)
+			}
+			s := resp.GetServices()[0]
+			if s.GetService() != "checkout" || s.GetTotalRequests() != tt.total || s.GetErrors() != tt.errors {
+				t.Errorf("got %v, want checkout with %d requests and %d errors", s, tt.total, tt.errors)
+			}
+		})
+	}
+
+	resp, err := client.ErrorRate(context.Background(), &queryv1.ErrorRateRequest{From: grpcFrom, To: grpcTo, Service: "search"})
+	if err != nil || len(resp.GetServices()) != 0 {
+		t.Errorf("other service: %v, %v; want no rows", resp, err)
+	}
+
+	_, err = client.ErrorRate(context.Background(), &queryv1.ErrorRateRequest{From: grpcTo, To: grpcFrom})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("reversed window: err = %v, want InvalidArgument", err)
+	}
+}
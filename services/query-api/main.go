@@ -1,16 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	_ "time/tzdata" // ?tz= validation must not depend on the host's zoneinfo
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	_ "github.com/marcboeker/go-duckdb"
+	"github.com/marcboeker/go-duckdb"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -19,307 +34,2919 @@ import (
 type QueryEngine struct {
 	db          *sql.DB
 	minioClient *minio.Client
+	listing     *listingCache
 	bucket      string
 	prefix      string
 	minioHTTP   string // e.g. http://localhost:9000
+	readMode    string
+	globSource  bool
+
+	apdexThresholdMs int           // default T for /metrics/apdex
+	maxRows          int           // cap on streamed timeseries rows
+	maxFiles         int           // cap on objects read per query, 0 for none
+	exportExpiry     time.Duration // lifetime of /export presigned URLs
+
+	checker *fileChecker // nil unless QUERY_SKIP_CORRUPT=true
+}
+
+// Read modes for read_parquet sources. s3 lets DuckDB's httpfs issue ranged
+// reads and prune columns/row groups; http fetches each object by URL and is
+// kept as a fallback for setups where the s3 settings can't be made to work.
+const (
+	readModeS3   = "s3"
+	readModeHTTP = "http"
+)
+
+type Config struct {
+	MinIOEndpoint  string
+	MinIOAccessKey string
+	MinIOSecretKey string
+	MinIOBucket    string
+	MinIOUseSSL    bool
+	MinIOLookup    string // bucket addressing, see bucketLookup
+
+	QueryPrefix  string
+	Port         string
+	ListCacheTTL time.Duration
+	ReadMode     string
+	SourceMode   string
+	QueryTimeout time.Duration
+	SkipCorrupt  bool
+	WarmInterval time.Duration // 0 disables the cache warmer
+	WarmWindow   time.Duration
+
+	ApdexThresholdMs int
+	MaxRows          int
+	MaxFiles         int // objects read per query in list mode; 0 reads all
+	ExportURLExpiry  time.Duration
+
+	// DuckDB resource caps; empty/0 keeps DuckDB's defaults (80% of RAM, one
+	// thread per core)
+	DuckDBMemoryLimit string
+	DuckDBThreads     int
+	DuckDBMaxConns    int // concurrent queries; further ones wait for a connection
+
+	// Port for the gRPC API (see grpc.go); empty disables it
+	GRPCPort string
+}
+
+//go:generate protoc --go_out=. --go_opt=module=tigerscope/query-api --go-grpc_out=. --go-grpc_opt=module=tigerscope/query-api proto/query/v1/query.proto
+
+func main() {
+	cfg := Config{
+		MinIOEndpoint:  getenv("MINIO_ENDPOINT", "localhost:9000"),
+		MinIOAccessKey: getenv("MINIO_ACCESS_KEY", "minioadmin"),
+		MinIOSecretKey: getenv("MINIO_SECRET_KEY", "minioadmin"),
+		MinIOBucket:    getenv("MINIO_BUCKET", "tigerscope"),
+		MinIOUseSSL:    getenv("MINIO_USE_SSL", "false") == "true",
+		MinIOLookup:    getenv("MINIO_BUCKET_LOOKUP", "path"),
+		QueryPrefix:    getenv("QUERY_PREFIX", "telemetry/parquet/"),
+		Port:           getenv("PORT", "8090"),
+		ListCacheTTL:   getenvDuration("LIST_CACHE_TTL", 10*time.Second),
+		ReadMode:       strings.ToLower(getenv("QUERY_READ_MODE", readModeS3)),
+		SourceMode:     strings.ToLower(getenv("QUERY_SOURCE", "list")),
+		QueryTimeout:   getenvDuration("QUERY_TIMEOUT", 30*time.Second),
+		SkipCorrupt:    getenv("QUERY_SKIP_CORRUPT", "false") == "true",
+		WarmInterval:   getenvDuration("WARM_INTERVAL", 0),
+		WarmWindow:     getenvDuration("WARM_WINDOW", time.Hour),
+
+		ApdexThresholdMs: getenvInt("APDEX_THRESHOLD_MS", 300),
+		MaxRows:          getenvInt("QUERY_MAX_ROWS", 100000),
+		MaxFiles:         getenvInt("QUERY_MAX_FILES", 200),
+		ExportURLExpiry:  getenvDuration("EXPORT_URL_EXPIRY", 15*time.Minute),
+
+		DuckDBMemoryLimit: strings.TrimSpace(os.Getenv("DUCKDB_MEMORY_LIMIT")),
+		DuckDBThreads:     getenvInt("DUCKDB_THREADS", 0),
+		DuckDBMaxConns:    getenvInt("DUCKDB_MAX_CONNS", 4),
+
+		GRPCPort: os.Getenv("GRPC_PORT"),
+	}
+	if cfg.ReadMode != readModeS3 && cfg.ReadMode != readModeHTTP {
+		log.Fatalf("QUERY_READ_MODE must be %q or %q, got %q", readModeS3, readModeHTTP, cfg.ReadMode)
+	}
+	if cfg.SourceMode != "list" && cfg.SourceMode != "glob" {
+		log.Fatalf("QUERY_SOURCE must be \"list\" or \"glob\", got %q", cfg.SourceMode)
+	}
+	if cfg.SourceMode == "glob" && cfg.ReadMode != readModeS3 {
+		log.Fatalf("QUERY_SOURCE=glob requires QUERY_READ_MODE=s3")
+	}
+	if cfg.SourceMode == "glob" && cfg.SkipCorrupt {
+		log.Fatalf("QUERY_SKIP_CORRUPT=true requires QUERY_SOURCE=list")
+	}
+	if cfg.DuckDBMemoryLimit != "" && !memoryLimitPattern.MatchString(cfg.DuckDBMemoryLimit) {
+		log.Fatalf("DUCKDB_MEMORY_LIMIT must be a size such as 512MB or 4GiB, got %q", cfg.DuckDBMemoryLimit)
+	}
+	if cfg.DuckDBThreads < 0 {
+		log.Fatalf("DUCKDB_THREADS must be a non-negative integer, got %d", cfg.DuckDBThreads)
+	}
+	if cfg.ExportURLExpiry < time.Second || cfg.ExportURLExpiry > maxPresignExpiry {
+		log.Fatalf("EXPORT_URL_EXPIRY must be between 1s and %s, got %s", maxPresignExpiry, cfg.ExportURLExpiry)
+	}
+	lookup, err := bucketLookup(cfg.MinIOLookup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.DuckDBMaxConns < 1 {
+		log.Fatalf("DUCKDB_MAX_CONNS must be at least 1, got %d", cfg.DuckDBMaxConns)
+	}
+
+	// DuckDB engine. database/sql pools connections to one in-memory
+	// database; every new connection runs the setup statements itself, so
+	// httpfs and the session settings are in place whichever connection a
+	// query lands on. The pool is capped, and idle connections kept, so
+	// connections (and their setup) aren't churned under load.
+	setup := duckdbSetup(cfg)
+	connector, err := duckdb.NewConnector("", func(execer driver.ExecerContext) error {
+		for _, stmt := range setup {
+			if _, err := execer.ExecContext(context.Background(), stmt, nil); err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxOpenConns(cfg.DuckDBMaxConns)
+	db.SetMaxIdleConns(cfg.DuckDBMaxConns)
+
+	var memLimit, threads string
+	if err := db.QueryRow(`SELECT current_setting('memory_limit'), current_setting('threads')::VARCHAR;`).Scan(&memLimit, &threads); err != nil {
+		panic(err)
+	}
+	log.Printf("duckdb limits: memory_limit=%s threads=%s max_conns=%d", memLimit, threads, cfg.DuckDBMaxConns)
+
+	// MinIO client (for listing objects)
+	minioClient, err := minio.New(cfg.MinIOEndpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.MinIOAccessKey, cfg.MinIOSecretKey, ""),
+		Secure:       cfg.MinIOUseSSL,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	scheme := "http"
+	if cfg.MinIOUseSSL {
+		scheme = "https"
+	}
+
+	qe := &QueryEngine{
+		db:          db,
+		minioClient: minioClient,
+		listing:     newListingCache(minioClient, cfg.MinIOBucket, cfg.ListCacheTTL),
+		bucket:      cfg.MinIOBucket,
+		prefix:      cfg.QueryPrefix,
+		minioHTTP:   scheme + "://" + cfg.MinIOEndpoint,
+		readMode:    cfg.ReadMode,
+		globSource:  cfg.SourceMode == "glob",
+
+		apdexThresholdMs: cfg.ApdexThresholdMs,
+		maxRows:          cfg.MaxRows,
+		maxFiles:         cfg.MaxFiles,
+		exportExpiry:     cfg.ExportURLExpiry,
+	}
+	if cfg.SkipCorrupt {
+		qe.checker = newFileChecker(qe)
+	}
+
+	e := echo.New()
+	e.JSONSerializer = caseSerializer{}
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  []string{"*"},
+		ExposeHeaders: []string{totalCountHeader, skippedFilesHeader, droppedFilesHeader},
+	}))
+	e.Use(queryTimeout(cfg.QueryTimeout))
+
+	e.GET("/healthz", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	e.GET("/readyz", qe.handleReady)
+	routes := qe.routes()
+	for _, r := range routes {
+		e.GET(r.Path, r.handler)
+	}
+	e.GET("/endpoints", handleEndpoints(routes))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.WarmInterval > 0 {
+		go qe.warm(ctx, cfg.WarmInterval, cfg.WarmWindow)
+		log.Printf("warming the last %s of data every %s", cfg.WarmWindow, cfg.WarmInterval)
+	}
+
+	go func() {
+		if err := e.Start(":" + cfg.Port); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	grpcDone := make(chan struct{})
+	if cfg.GRPCPort != "" {
+		lis, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			log.Fatalf("grpc listen: %v", err)
+		}
+		go func() {
+			defer close(grpcDone)
+			if err := qe.serveGRPC(ctx, lis, cfg.QueryTimeout); err != nil {
+				log.Fatalf("grpc server error: %v", err)
+			}
+		}()
+	} else {
+		close(grpcDone)
+	}
+
+	<-ctx.Done()
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.QueryTimeout+5*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	// serveGRPC drains in-flight RPCs once ctx ends
+	select {
+	case <-grpcDone:
+	case <-shutdownCtx.Done():
+		log.Printf("shutdown: grpc drain incomplete: %v", shutdownCtx.Err())
+	}
+}
+
+// queryTimeout bounds each request's context. Handlers run DuckDB statements
+// with QueryContext, so a client disconnect or the deadline interrupts the scan.
+func queryTimeout(d time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if d <= 0 {
+				return next(c)
+			}
+			ctx, cancel := context.WithTimeout(c.Request().Context(), d)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// memoryLimitPattern matches the sizes DuckDB's memory_limit accepts.
+var memoryLimitPattern = regexp.MustCompile(`(?i)^[0-9]+(\.[0-9]+)?\s*(b|bytes|kb|mb|gb|tb|kib|mib|gib|tib)$`)
+
+// duckdbSetup returns the statements run on each new DuckDB connection.
+func duckdbSetup(cfg Config) []string {
+	stmts := []string{
+		// httpfs serves both s3:// paths and plain HTTP URLs
+		`INSTALL httpfs;`,
+		`LOAD httpfs;`,
+
+		// Point the S3 client at MinIO (used when QUERY_READ_MODE=s3)
+		`SET s3_endpoint=` + sqlString(cfg.MinIOEndpoint) + `;`,
+		`SET s3_access_key_id=` + sqlString(cfg.MinIOAccessKey) + `;`,
+		`SET s3_secret_access_key=` + sqlString(cfg.MinIOSecretKey) + `;`,
+		`SET s3_use_ssl=` + strconv.FormatBool(cfg.MinIOUseSSL) + `;`,
+		`SET s3_url_style=` + sqlString(s3URLStyle(cfg.MinIOLookup)) + `;`,
+		`SET s3_region='us-east-1';`,
+	}
+
+	if cfg.WarmInterval > 0 {
+		// Keep parquet footers and HTTP HEAD results between queries; without
+		// these the warmer has nothing to keep warm
+		stmts = append(stmts, `SET enable_object_cache=true;`, `SET enable_http_metadata_cache=true;`)
+	}
+
+	// Cap DuckDB so a large scan spills or fails instead of taking the pod down
+	if cfg.DuckDBMemoryLimit != "" {
+		stmts = append(stmts, `SET memory_limit=`+sqlString(cfg.DuckDBMemoryLimit)+`;`)
+	}
+	if cfg.DuckDBThreads > 0 {
+		stmts = append(stmts, `SET threads=`+strconv.Itoa(cfg.DuckDBThreads)+`;`)
+	}
+	return stmts
+}
+
+// sqlString quotes v as a DuckDB string literal, for statements like SET
+// that don't accept bind parameters.
+func sqlString(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+func getenv(key, def string) string {
+	v := os.Getenv(key)
+	if strings.TrimSpace(v) == "" {
+		return def
+	}
+	return v
+}
+
+func getenvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if strings.TrimSpace(v) == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if strings.TrimSpace(v) == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// caseSerializer rewrites response keys according to the ?case= query param
+// (camel or pascal). Without it, responses keep their snake_case JSON tags.
+type caseSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s caseSerializer) Serialize(c echo.Context, i any, indent string) error {
+	convert := keyConverter(c.QueryParam("case"))
+	if convert == nil {
+		return s.DefaultJSONSerializer.Serialize(c, i, indent)
+	}
+
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	return s.DefaultJSONSerializer.Serialize(c, convertKeys(v, convert), indent)
+}
+
+func keyConverter(name string) func(string) string {
+	switch strings.ToLower(name) {
+	case "camel":
+		return func(k string) string { return snakeToCamel(k, false) }
+	case "pascal":
+		return func(k string) string { return snakeToCamel(k, true) }
+	default:
+		return nil
+	}
+}
+
+func convertKeys(v any, convert func(string) string) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, val := range t {
+			out[convert(k)] = convertKeys(val, convert)
+		}
+		return out
+	case []any:
+		for i := range t {
+			t[i] = convertKeys(t[i], convert)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func snakeToCamel(k string, upperFirst bool) string {
+	parts := strings.Split(k, "_")
+	var b strings.Builder
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		if i == 0 && !upperFirst {
+			b.WriteString(p)
+			continue
+		}
+		b.WriteString(strings.ToUpper(p[:1]) + p[1:])
+	}
+	return b.String()
+}
+
+// timeWindow bounds a query to events with From <= timestamp <= To.
+type timeWindow struct {
+	From time.Time
+	To   time.Time
+}
+
+// parseWindow reads the RFC3339 from/to query params, defaulting to the last hour.
+func parseWindow(c echo.Context) (timeWindow, error) {
+	now := time.Now().UTC()
+	win := timeWindow{From: now.Add(-time.Hour), To: now}
+
+	if v := c.QueryParam("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return timeWindow{}, fmt.Errorf("invalid from: %w", err)
+		}
+		win.From = t.UTC()
+	}
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return timeWindow{}, fmt.Errorf("invalid to: %w", err)
+		}
+		win.To = t.UTC()
+	}
+	if win.To.Before(win.From) {
+		return timeWindow{}, fmt.Errorf("from must be before to")
+	}
+	return win, nil
+}
+
+const (
+	defaultPageLimit = 10
+	maxPageLimit     = 500
+	totalCountHeader = "X-Total-Count"
+	// droppedFilesHeader counts the objects in the window a response left out
+	// to stay within QUERY_MAX_FILES; those are the oldest hours.
+	droppedFilesHeader = "X-Dropped-Files"
+)
+
+// parsePage reads ?limit= and ?offset= for paginated endpoints. limit is
+// bounded by maxPageLimit so a single response can't grow unbounded.
+func parsePage(c echo.Context) (limit, offset int, err error) {
+	limit, offset = defaultPageLimit, 0
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return 0, 0, fmt.Errorf("limit must be a non-negative integer")
+		}
+		if limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be at most %d", maxPageLimit)
+		}
+	}
+	if v := c.QueryParam("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// parseInterval reads the ?interval= bucket width (Go duration syntax, e.g.
+// 30s, 5m, 1h), defaulting to def. Widths must be whole seconds.
+func parseInterval(c echo.Context, def time.Duration) (time.Duration, error) {
+	v := c.QueryParam("interval")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Second || d%time.Second != 0 {
+		return 0, fmt.Errorf("interval must be a whole number of seconds, e.g. 30s, 5m, 1h")
+	}
+	return d, nil
+}
+
+// parseTZ reads the ?tz= zone that time buckets align to, as an IANA name such
+// as America/New_York. Defaults to UTC.
+func parseTZ(c echo.Context) (*time.Location, error) {
+	v := strings.TrimSpace(c.QueryParam("tz"))
+	if v == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(v)
+	if err != nil || v == "Local" {
+		return nil, fmt.Errorf("tz must be an IANA time zone such as America/New_York, got %q", v)
+	}
+	return loc, nil
+}
+
+// bucketExpr is the start of timestamp's interval bucket. Buckets are aligned
+// on loc's wall clock, so with tz=America/New_York and interval=24h a bucket
+// runs from local midnight to local midnight across DST changes; the start is
+// returned as a UTC TIMESTAMP like the timestamp column itself.
+func bucketExpr(interval time.Duration, loc *time.Location) string {
+	if loc == time.UTC {
+		return `time_bucket(` + intervalLiteral(interval) + `, timestamp)`
+	}
+	tz := sqlString(loc.String())
+	local := `timezone(` + tz + `, timezone('UTC', timestamp))`
+	return `timezone('UTC', timezone(` + tz + `, time_bucket(` + intervalLiteral(interval) + `, ` + local + `)))`
+}
+
+// intervalLiteral renders a validated bucket width as a DuckDB INTERVAL.
+func intervalLiteral(d time.Duration) string {
+	return fmt.Sprintf("INTERVAL %d SECOND", int64(d/time.Second))
+}
+
+// defaultLatencyBuckets are the lower bounds (ms) used when ?buckets= is omitted.
+var defaultLatencyBuckets = []int64{0, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// parseLatencyBuckets reads ?buckets= as ascending, comma-separated lower
+// bounds in ms. Bucket i covers [b[i], b[i+1]); the last one is open-ended.
+func parseLatencyBuckets(c echo.Context) ([]int64, error) {
+	v := c.QueryParam("buckets")
+	if v == "" {
+		return defaultLatencyBuckets, nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) > 50 {
+		return nil, fmt.Errorf("at most 50 buckets are allowed")
+	}
+	bounds := make([]int64, 0, len(parts))
+	for _, p := range parts {
+		b, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+		if err != nil || b < 0 {
+			return nil, fmt.Errorf("buckets must be non-negative integers: %q", p)
+		}
+		if len(bounds) > 0 && b <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("buckets must be strictly ascending")
+		}
+		bounds = append(bounds, b)
+	}
+	return bounds, nil
+}
+
+// timeBucketOrigin is DuckDB's default time_bucket origin; bucket starts are
+// whole multiples of the interval from here.
+var timeBucketOrigin = time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC)
+
+// maxHeatmapColumns bounds the time axis of /metrics/latency-heatmap.
+const maxHeatmapColumns = 2000
+
+// timeBuckets returns the start of every interval bucket overlapping win,
+// aligned on loc's wall clock the same way as bucketExpr. Starts are in loc.
+func timeBuckets(win timeWindow, interval time.Duration, loc *time.Location) ([]time.Time, error) {
+	from, to := wallClock(win.From, loc), wallClock(win.To, loc)
+	start := timeBucketOrigin.Add(from.Sub(timeBucketOrigin) / interval * interval)
+	if start.After(from) {
+		start = start.Add(-interval)
+	}
+	n := int(to.Sub(start)/interval) + 1
+	if n > maxHeatmapColumns {
+		return nil, fmt.Errorf("window spans %d intervals, at most %d are allowed; widen interval", n, maxHeatmapColumns)
+	}
+	out := make([]time.Time, 0, n)
+	for t := start; !t.After(to); t = t.Add(interval) {
+		out = append(out, time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc))
+	}
+	return out, nil
+}
+
+// wallClock is t's local time in loc, relabelled as UTC so bucket arithmetic
+// works on wall-clock time.
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	l := t.In(loc)
+	return time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), l.Nanosecond(), time.UTC)
+}
+
+// latencyBucketExpr maps latency_ms onto its bucket index. Values below the
+// first bound fall into bucket 0.
+func latencyBucketExpr(bounds []int64) string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for i := 1; i < len(bounds); i++ {
+		fmt.Fprintf(&b, " WHEN latency_ms < %d THEN %d", bounds[i], i-1)
+	}
+	fmt.Fprintf(&b, " ELSE %d END", len(bounds)-1)
+	return b.String()
+}
+
+// queryFilter collects WHERE predicates along with their bind values, so
+// caller-supplied filters never end up concatenated into SQL.
+type queryFilter struct {
+	clauses []string
+	args    []any
+}
+
+func (f *queryFilter) add(clause string, args ...any) {
+	f.clauses = append(f.clauses, clause)
+	f.args = append(f.args, args...)
+}
+
+func (f *queryFilter) where() string {
+	if len(f.clauses) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.clauses, " AND ")
+}
+
+// metricFilter restricts a metric query to the time window plus the optional
+// service, service_pattern, environment, endpoint and method query params.
+func metricFilter(c echo.Context, win timeWindow) *queryFilter {
+	f := &queryFilter{}
+	f.add("timestamp BETWEEN ? AND ?", win.From, win.To)
+	if v := strings.TrimSpace(c.QueryParam("service")); v != "" {
+		f.add("service = ?", v)
+	}
+	if v := strings.TrimSpace(c.QueryParam("service_pattern")); v != "" {
+		f.add(`service LIKE ? ESCAPE '\'`, globToLike(v))
+	}
+	if v := strings.TrimSpace(c.QueryParam("environment")); v != "" {
+		f.add("environment = ?", v)
+	}
+	if v := strings.TrimSpace(c.QueryParam("endpoint")); v != "" {
+		f.add("endpoint = ?", v)
+	}
+	if v := strings.TrimSpace(c.QueryParam("method")); v != "" {
+		f.add("method = ?", strings.ToUpper(v))
+	}
+	return f
+}
+
+// globToLike turns a service_pattern glob into a LIKE pattern. Supported
+// wildcards are * (any run of characters, including none) and ? (exactly one
+// character); everything else, including LIKE's own % and _, matches
+// literally. Matching is case-sensitive, like the exact service param.
+func globToLike(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parsePartition extracts the hour partition from an object key written by
+// writer-consumer, e.g. telemetry/parquet/date=2024-05-01/hour=13/batch-x.parquet.
+// The date= and hour= segments may appear anywhere in the path.
+func parsePartition(key string) (time.Time, error) {
+	var date, hour string
+	for _, seg := range strings.Split(key, "/") {
+		switch {
+		case strings.HasPrefix(seg, "date="):
+			date = strings.TrimPrefix(seg, "date=")
+		case strings.HasPrefix(seg, "hour="):
+			hour = strings.TrimPrefix(seg, "hour=")
+		}
+	}
+	if date == "" || hour == "" {
+		return time.Time{}, fmt.Errorf("missing date/hour partition in %q", key)
+	}
+	t, err := time.Parse("2006-01-02 15", date+" "+hour)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed partition in %q: %w", key, err)
+	}
+	return t, nil
+}
+
+// partitionService returns the service= segment of key, if it has one. Keys
+// written before the service partition was added have none.
+func partitionService(key string) (string, bool) {
+	for _, seg := range strings.Split(key, "/") {
+		if v, ok := strings.CutPrefix(seg, "service="); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// servicePartitionValue is how writer-consumer sanitizes a service name into
+// its service= path segment; keep the two in step.
+func servicePartitionValue(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// partitionInWindow reports whether the hour starting at start can hold events in win.
+func partitionInWindow(start time.Time, win timeWindow) bool {
+	return !start.After(win.To) && start.Add(time.Hour).After(win.From)
+}
+
+// parquetFileList lists parquet sources for read_parquet, newest last. When win
+// is non-nil, objects whose partition falls outside it are skipped, as are
+// objects whose key carries no usable partition (logged so they can be cleaned
+// up). When service is set, objects under another service= partition are
+// skipped too. limit caps the number of objects considered, keeping the newest
+// hours across all services, and dropped counts the objects left out; in s3
+// mode those objects are collapsed into one glob per hour partition, so the
+// oldest partition may contribute a few more files than the limit. With
+// QUERY_SKIP_CORRUPT=true, objects that can't be read are left out and
+// returned as skipped.
+func (qe *QueryEngine) parquetFileList(limit int, win *timeWindow, service string) (files, skipped []string, dropped int, err error) {
+	ctx := context.Background()
+	keys, err := qe.listing.keys(ctx, qe.prefix)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var svc string
+	if service != "" {
+		svc = servicePartitionValue(service)
+	}
+
+	var selected []string
+	for _, key := range keys {
+		if svc != "" {
+			if v, ok := partitionService(key); ok && v != svc {
+				continue
+			}
+		}
+		if win != nil {
+			start, err := parsePartition(key)
+			if err != nil {
+				log.Printf("skipping object: %v", err)
+				continue
+			}
+			if !partitionInWindow(start, *win) {
+				continue
+			}
+		}
+		selected = append(selected, key)
+	}
+
+	if limit > 0 && len(selected) > limit {
+		// Keys sort by service first, so order by hour before keeping the
+		// newest; keys without a partition sort oldest
+		hours := make(map[string]time.Time, len(selected))
+		for _, key := range selected {
+			hours[key], _ = parsePartition(key)
+		}
+		sort.SliceStable(selected, func(i, j int) bool {
+			return hours[selected[i]].Before(hours[selected[j]])
+		})
+		dropped = len(selected) - limit
+		selected = selected[dropped:]
+	}
+
+	// Hour partitions holding a skipped object can't be globbed
+	var partial map[string]bool
+	if qe.checker != nil {
+		readable := selected[:0:0]
+		for _, key := range selected {
+			if qe.checker.readable(ctx, key) {
+				readable = append(readable, key)
+				continue
+			}
+			skipped = append(skipped, key)
+			if partial == nil {
+				partial = map[string]bool{}
+			}
+			partial[path.Dir(key)] = true
+		}
+		selected = readable
+	}
+
+	if qe.readMode == readModeS3 {
+		return qe.s3Globs(selected, partial), skipped, dropped, nil
+	}
+
+	files = make([]string, 0, len(selected))
+	for _, key := range selected {
+		files = append(files, qe.objectPath(key))
+	}
+	return files, skipped, dropped, nil
+}
+
+// objectPath is how DuckDB reads a single object in the configured read mode.
+func (qe *QueryEngine) objectPath(key string) string {
+	if qe.readMode == readModeS3 {
+		return "s3://" + qe.bucket + "/" + key
+	}
+	// Use HTTP URL so DuckDB reads via httpfs without S3 hostname inference
+	return qe.minioHTTP + "/" + qe.bucket + "/" + key
+}
+
+// s3Globs turns object keys into s3:// sources, one *.parquet glob per hour
+// partition directory. Keys outside a date=/hour= partition, or in a directory
+// listed in partial, are kept as-is.
+func (qe *QueryEngine) s3Globs(keys []string, partial map[string]bool) []string {
+	seen := make(map[string]bool, len(keys))
+	var out []string
+	for _, key := range keys {
+		src := "s3://" + qe.bucket + "/" + key
+		if _, err := parsePartition(key); err == nil && !partial[path.Dir(key)] {
+			src = "s3://" + qe.bucket + "/" + path.Dir(key) + "/*.parquet"
+		}
+		if !seen[src] {
+			seen[src] = true
+			out = append(out, src)
+		}
+	}
+	return out
+}
+
+// parquetSource returns the table expression handlers select from for win, or
+// "" when no objects fall inside it. With QUERY_SOURCE=glob DuckDB discovers
+// the files itself from an s3:// glob, skipping the MinIO listing entirely.
+// Otherwise objects are listed and passed as an explicit array. ?dedup=true
+// wraps either in dedupSource. Objects left out by QUERY_SKIP_CORRUPT are
+// named in the X-Skipped-Files header, and the number left out by
+// QUERY_MAX_FILES is sent as X-Dropped-Files.
+func (qe *QueryEngine) parquetSource(c echo.Context, win timeWindow) (string, error) {
+	service := strings.TrimSpace(c.QueryParam("service"))
+	src, skipped, dropped, err := qe.readableSource(c.Request().Context(), win, service)
+	if len(skipped) > 0 {
+		c.Response().Header().Set(skippedFilesHeader, strings.Join(skipped, ","))
+	}
+	if dropped > 0 {
+		c.Response().Header().Set(droppedFilesHeader, strconv.Itoa(dropped))
+	}
+	if err != nil || src == "" {
+		return src, err
+	}
+	if c.QueryParam("dedup") == "true" {
+		src = dedupSource(src)
+	}
+	return src, nil
+}
+
+// tableSource is parquetSource without the per-request options.
+func (qe *QueryEngine) tableSource(ctx context.Context, win timeWindow) (string, error) {
+	src, _, _, err := qe.readableSource(ctx, win, "")
+	return src, err
+}
+
+// readableSource is tableSource that also returns the objects skipped as
+// unreadable and the number dropped by QUERY_MAX_FILES. A non-empty service
+// limits the objects read to that service's partition.
+func (qe *QueryEngine) readableSource(ctx context.Context, win timeWindow, service string) (src string, skipped []string, dropped int, err error) {
+	var files []string
+	if qe.globSource {
+		files, err = qe.globFiles(ctx, "s3://"+qe.bucket+"/"+strings.TrimSuffix(qe.prefix, "/"), win, service)
+	} else {
+		files, skipped, dropped, err = qe.parquetFileList(qe.maxFiles, &win, service)
+	}
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if len(files) == 0 {
+		return "", skipped, dropped, nil
+	}
+	return readParquetSource(files), skipped, dropped, nil
+}
+
+// readParquetSource reads files as one table. Hive partitioning is off: the
+// service= segment holds the sanitized partition value, and DuckDB would
+// otherwise read it as a column in place of the service each event was
+// written with.
+func readParquetSource(files []string) string {
+	return `read_parquet(` + duckdbFileArrayLiteral(files) + `, hive_partitioning=false, filename=true, union_by_name=true)`
+}
+
+// globFiles has DuckDB glob the parquet files under base whose date= segment
+// falls inside win. A non-empty service narrows the glob to its service=
+// partition, plus files from before the service partition existed.
+func (qe *QueryEngine) globFiles(ctx context.Context, base string, win timeWindow, service string) ([]string, error) {
+	patterns := []string{base + "/**/*.parquet"}
+	if service != "" {
+		patterns = []string{
+			base + "/service=" + servicePartitionValue(service) + "/**/*.parquet",
+			base + "/date=*/**/*.parquet",
+		}
+	}
+	globs := make([]string, len(patterns))
+	for i, p := range patterns {
+		globs[i] = `SELECT file FROM glob(` + sqlString(p) + `)`
+	}
+	query := `SELECT file FROM (` + strings.Join(globs, " UNION ALL ") + `)
+		WHERE regexp_extract(file, '/date=([0-9]{4}-[0-9]{2}-[0-9]{2})/', 1) BETWEEN ? AND ?
+		ORDER BY file`
+	rows, err := qe.db.QueryContext(ctx, query, win.From.UTC().Format("2006-01-02"), win.To.UTC().Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []string
+	for rows.Next() {
+		var f string
+		if err := rows.Scan(&f); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// dedupSource keeps one row per request_id, so events redelivered by the
+// at-least-once pipeline are only counted once. Rows written before request_id
+// was recorded read as NULL and are all kept.
+func dedupSource(src string) string {
+	return `(SELECT * FROM ` + src + `
+		  QUALIFY request_id IS NULL
+		    OR row_number() OVER (PARTITION BY request_id ORDER BY ingested_at) = 1)`
+}
+
+func duckdbFileArrayLiteral(files []string) string {
+	escaped := make([]string, 0, len(files))
+	for _, f := range files {
+		escaped = append(escaped, sqlString(f))
+	}
+	return "[" + strings.Join(escaped, ",") + "]"
+}
+
+// weightExpr is the per-row weight used by count aggregates. With ?estimate=true
+// each row counts as 1/sampling_rate, so sampled data reflects estimated true
+// volume even when files mix different sampling rates. Rows written before
+// sampling_rate existed read as NULL and count once.
+func weightExpr(c echo.Context) string {
+	if c.QueryParam("estimate") == "true" {
+		return estimatedWeight
+	}
+	return "1"
+}
+
+const estimatedWeight = "(1.0 / COALESCE(NULLIF(sampling_rate, 0), 1))"
+
+// handleReady checks both query dependencies: MinIO answers a one-key listing
+// and DuckDB can run a statement. It skips the listing cache on purpose.
+func (qe *QueryEngine) handleReady(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+	defer cancel()
+
+	opts := minio.ListObjectsOptions{Prefix: qe.prefix, MaxKeys: 1}
+	for obj := range qe.minioClient.ListObjects(ctx, qe.bucket, opts) {
+		if obj.Err != nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]any{"dependency": "minio", "error": obj.Err.Error()})
+		}
+		break
+	}
+
+	var one int
+	if err := qe.db.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]any{"dependency": "duckdb", "error": err.Error()})
+	}
+
+	return c.String(http.StatusOK, "ok")
+}
+
+// handleSchema describes the columns of a parquet file from the newest hour
+// partition, for checking that new event fields actually reach storage. Only
+// one file is read, so older files with a different layout won't show up here.
+func (qe *QueryEngine) handleSchema(c echo.Context) error {
+	keys, err := qe.listing.keys(c.Request().Context(), qe.prefix)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	// Keys sort by service first, so compare partition hours; batch names are
+	// random, so any file within the newest hour will do
+	var latest string
+	var latestHour time.Time
+	for _, key := range keys {
+		hour, err := parsePartition(key)
+		if err != nil {
+			continue
+		}
+		if latest == "" || !hour.Before(latestHour) {
+			latest, latestHour = key, hour
+		}
+	}
+	if latest == "" {
+		return c.JSON(http.StatusNotFound, map[string]any{"error": "no parquet files found"})
+	}
+
+	query := `
+		SELECT column_name, column_type
+		FROM (DESCRIBE SELECT * FROM read_parquet(` + sqlString(qe.objectPath(latest)) + `, hive_partitioning=false));
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Column struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	columns := []Column{}
+	for rows.Next() {
+		var col Column
+		if err := rows.Scan(&col.Name, &col.Type); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		columns = append(columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	version, err := qe.fileSchemaVersion(c.Request().Context(), latest)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"file":           latest,
+		"columns":        columns,
+		"schema_version": version,
+		"supported":      version <= maxSchemaVersion,
+	})
+}
+
+// Must match the writer-consumer's parquetSchemaKey. Queries here are written
+// against layout maxSchemaVersion; files from a newer writer may have columns
+// renamed or retyped under them.
+const (
+	parquetSchemaKey = "tigerscope.schema_version"
+	maxSchemaVersion = 1
+)
+
+// fileSchemaVersion reads the layout version from a file's key-value
+// metadata. Files written before versioning have none and report 0.
+func (qe *QueryEngine) fileSchemaVersion(ctx context.Context, key string) (int, error) {
+	query := `
+		SELECT decode(value)
+		FROM parquet_kv_metadata(` + sqlString(qe.objectPath(key)) + `)
+		WHERE decode(key) = ?;
+	`
+
+	var v string
+	err := qe.db.QueryRowContext(ctx, query, parquetSchemaKey).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: bad %s %q", key, parquetSchemaKey, v)
+	}
+	return n, nil
+}
+
+// handlePartitions lists the hour partitions that hold parquet files, oldest
+// first, with their file count and total size, so dashboards can see the data's
+// time coverage without querying empty ranges. Service partitions of the same
+// hour are counted together. earliest and latest are the start times of the
+// first and last hours, whatever the limit; ?limit= keeps only the newest N
+// hours in the list.
+func (qe *QueryEngine) handlePartitions(c echo.Context) error {
+	limit := 0
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "limit must be a non-negative integer"})
+		}
+		limit = n
+	}
+
+	keys, sizes, err := qe.listing.objects(c.Request().Context(), qe.prefix)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	type Partition struct {
+		Hour  time.Time `json:"hour"`
+		Files int       `json:"files"`
+		Bytes int64     `json:"bytes"`
+	}
+
+	byHour := map[time.Time]*Partition{}
+	for i, key := range keys {
+		hour, err := parsePartition(key)
+		if err != nil {
+			continue
+		}
+		p, ok := byHour[hour]
+		if !ok {
+			p = &Partition{Hour: hour}
+			byHour[hour] = p
+		}
+		p.Files++
+		p.Bytes += sizes[i]
+	}
+
+	partitions := make([]Partition, 0, len(byHour))
+	for _, p := range byHour {
+		partitions = append(partitions, *p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Hour.Before(partitions[j].Hour) })
+
+	resp := map[string]any{"earliest": nil, "latest": nil}
+	if len(partitions) > 0 {
+		resp["earliest"] = partitions[0].Hour
+		resp["latest"] = partitions[len(partitions)-1].Hour
+	}
+	if limit > 0 && len(partitions) > limit {
+		partitions = partitions[len(partitions)-limit:]
+	}
+	resp["partitions"] = partitions
+	return c.JSON(http.StatusOK, resp)
+}
+
+// maxExportFiles caps how many objects one /export call will sign.
+const maxExportFiles = 1000
+
+// handleExport lists the parquet objects whose hour partition overlaps
+// ?from=/?to= with a presigned GET URL for each, so raw data can be pulled for
+// offline analysis without MinIO credentials. URLs expire after
+// EXPORT_URL_EXPIRY and point at MINIO_ENDPOINT, which must be reachable by
+// the caller. Files are whole hour batches, so they may hold events just
+// outside the window.
+func (qe *QueryEngine) handleExport(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	keys, sizes, err := qe.listing.objects(ctx, qe.prefix)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	type File struct {
+		Key   string    `json:"key"`
+		Hour  time.Time `json:"hour"`
+		Bytes int64     `json:"bytes"`
+		URL   string    `json:"url"`
+	}
+
+	files := []File{}
+	for i, key := range keys {
+		hour, err := parsePartition(key)
+		if err != nil || !partitionInWindow(hour, win) {
+			continue
+		}
+		files = append(files, File{Key: key, Hour: hour, Bytes: sizes[i]})
+	}
+	if len(files) > maxExportFiles {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error": fmt.Sprintf("%d files match; narrow the range to at most %d", len(files), maxExportFiles),
+		})
+	}
+
+	expiresAt := time.Now().UTC().Add(qe.exportExpiry)
+	for i := range files {
+		files[i].URL, err = qe.presignedURL(ctx, files[i].Key, qe.exportExpiry)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"from":       win.From,
+		"to":         win.To,
+		"expires_at": expiresAt,
+		"files":      files,
+	})
+}
+
+func (qe *QueryEngine) handleErrorRate(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	out, err := qe.errorRates(c.Request().Context(), src, metricFilter(c, win), weightExpr(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	return respond(c, http.StatusOK, out)
+}
+
+type errorRateRow struct {
+	Service      string  `json:"service"`
+	Total        int64   `json:"total_requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRatePct float64 `json:"error_rate_pct"`
+}
+
+// errorRates is the query behind /metrics/error-rate and the ErrorRate RPC.
+func (qe *QueryEngine) errorRates(ctx context.Context, src string, f *queryFilter, w string) ([]errorRateRow, error) {
+	query := `
+		SELECT
+		  service,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS total_requests,
+		  CAST(ROUND(SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS errors,
+		  CAST(ROUND(100.0 * SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END) / SUM(` + w + `), 2) AS DOUBLE) AS error_rate_pct
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service
+		ORDER BY error_rate_pct DESC;
+	`
+
+	rows, err := qe.db.QueryContext(ctx, query, f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []errorRateRow
+	for rows.Next() {
+		var r errorRateRow
+		if err := rows.Scan(&r.Service, &r.Total, &r.Errors, &r.ErrorRatePct); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// handleStatusDistribution counts requests per service by status class, so
+// client errors (4xx) can be told apart from server errors (5xx).
+func (qe *QueryEngine) handleStatusDistribution(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+	class := func(n int) string {
+		return `CAST(ROUND(SUM(CASE WHEN status_code // 100 = ` + strconv.Itoa(n) + ` THEN ` + w + ` ELSE 0 END)) AS BIGINT)`
+	}
+
+	query := `
+		SELECT
+		  service,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS total_requests,
+		  ` + class(1) + ` AS status_1xx,
+		  ` + class(2) + ` AS status_2xx,
+		  ` + class(3) + ` AS status_3xx,
+		  ` + class(4) + ` AS status_4xx,
+		  ` + class(5) + ` AS status_5xx
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service
+		ORDER BY service;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Service   string `json:"service"`
+		Total     int64  `json:"total_requests"`
+		Status1xx int64  `json:"status_1xx"`
+		Status2xx int64  `json:"status_2xx"`
+		Status3xx int64  `json:"status_3xx"`
+		Status4xx int64  `json:"status_4xx"`
+		Status5xx int64  `json:"status_5xx"`
+	}
+
+	out := []Row{}
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.Service, &r.Total, &r.Status1xx, &r.Status2xx, &r.Status3xx, &r.Status4xx, &r.Status5xx); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+// handleRequestsByMethod breaks traffic down by HTTP method per service,
+// busiest first.
+func (qe *QueryEngine) handleRequestsByMethod(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+
+	query := `
+		SELECT
+		  service,
+		  method,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS requests,
+		  CAST(ROUND(SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS errors
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service, method
+		ORDER BY requests DESC, service, method;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Service  string `json:"service"`
+		Method   string `json:"method"`
+		Requests int64  `json:"requests"`
+		Errors   int64  `json:"errors"`
+	}
+
+	out := []Row{}
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.Service, &r.Method, &r.Requests, &r.Errors); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+// cohortFilter matches the customers of one cohort: any of the comma-separated
+// ids in <side>_customers or prefixes in <side>_prefixes.
+func cohortFilter(c echo.Context, side string) (string, []any, error) {
+	var clauses []string
+	var args []any
+	if ids := splitParam(c.QueryParam(side + "_customers")); len(ids) > 0 {
+		clauses = append(clauses, "customer_id IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")+")")
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	for _, p := range splitParam(c.QueryParam(side + "_prefixes")) {
+		clauses = append(clauses, `customer_id LIKE ? ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(p)+"%")
+	}
+	if len(clauses) == 0 {
+		return "", nil, fmt.Errorf("%s_customers or %s_prefixes is required", side, side)
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// splitParam splits a comma-separated query param, dropping empty entries.
+func splitParam(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// handleCohortComparison puts two customer cohorts side by side, e.g.
+// ?a_prefixes=ent-&b_prefixes=free-, with volume, error rate and p95 latency
+// for each. Cohorts are labelled by ?a_name= and ?b_name= (default "a" and
+// "b"). A customer matching both cohorts counts towards both.
+func (qe *QueryEngine) handleCohortComparison(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	condA, argsA, err := cohortFilter(c, "a")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	condB, argsB, err := cohortFilter(c, "b")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	nameA, nameB := c.QueryParam("a_name"), c.QueryParam("b_name")
+	if nameA == "" {
+		nameA = "a"
+	}
+	if nameB == "" {
+		nameB = "b"
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+	where := f.where()
+
+	// One aggregation per cohort; the filter args repeat for each side
+	cohort := func(cond string) string {
+		return `
+		SELECT
+		  CAST(? AS VARCHAR) AS cohort,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS requests,
+		  CAST(ROUND(SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS errors,
+		  CAST(COALESCE(ROUND(100.0 * SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END) / NULLIF(SUM(` + w + `), 0), 2), 0) AS DOUBLE) AS error_rate_pct,
+		  CAST(COALESCE(ROUND(quantile_cont(latency_ms, 0.95), 2), 0) AS DOUBLE) AS p95_latency_ms
+		FROM ` + src + `
+		` + where + ` AND ` + cond
+	}
+	query := cohort(condA) + `
+		UNION ALL` + cohort(condB) + `;
+	`
+
+	args := []any{nameA}
+	args = append(args, f.args...)
+	args = append(args, argsA...)
+	args = append(args, nameB)
+	args = append(args, f.args...)
+	args = append(args, argsB...)
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Cohort       string  `json:"cohort"`
+		Requests     int64   `json:"requests"`
+		Errors       int64   `json:"errors"`
+		ErrorRatePct float64 `json:"error_rate_pct"`
+		P95LatencyMs float64 `json:"p95_latency_ms"`
+	}
+
+	out := []Row{}
+	for rows.Next() {
+		var r Row
+		var requests, errs sql.NullInt64
+		if err := rows.Scan(&r.Cohort, &requests, &errs, &r.ErrorRatePct, &r.P95LatencyMs); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		r.Requests, r.Errors = requests.Int64, errs.Int64
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+// handleAnomaly flags services whose error rate in the window is unusual for
+// them. The baseline is the ?baseline= period (default 24h) just before the
+// window, cut into ?interval= buckets (default: the window's length). For each
+// service:
+//
+//	mean   = average error rate over the baseline buckets that saw traffic
+//	stddev = population standard deviation of those bucket rates
+//
+// and the service is anomalous when its current rate exceeds
+// mean * ?multiplier= (default 2), or, when ?sigma= is set, mean + sigma*stddev
+// in place of the multiplier.
+// Services with fewer than ?min_requests= (default 20) in the window are never
+// flagged, and those with no baseline traffic compare against a mean of 0.
+func (qe *QueryEngine) handleAnomaly(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	interval, err := parseInterval(c, max(win.To.Sub(win.From).Truncate(time.Second), time.Second))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	baseline := 24 * time.Hour
+	if v := c.QueryParam("baseline"); v != "" {
+		baseline, err = time.ParseDuration(v)
+		if err != nil || baseline < interval {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "baseline must be a duration of at least one interval, e.g. 24h"})
+		}
+	}
+	multiplier := 2.0
+	if v := c.QueryParam("multiplier"); v != "" {
+		multiplier, err = strconv.ParseFloat(v, 64)
+		if err != nil || multiplier <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "multiplier must be a positive number"})
+		}
+	}
+	sigma := 0.0
+	if v := c.QueryParam("sigma"); v != "" {
+		sigma, err = strconv.ParseFloat(v, 64)
+		if err != nil || sigma <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "sigma must be a positive number"})
+		}
+	}
+	minRequests := int64(20)
+	if v := c.QueryParam("min_requests"); v != "" {
+		minRequests, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || minRequests < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "min_requests must be a non-negative integer"})
+		}
+	}
+
+	baseWin := timeWindow{From: win.From.Add(-baseline), To: win.From}
+	src, err := qe.parquetSource(c, timeWindow{From: baseWin.From, To: win.To})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	w := weightExpr(c)
+	errs := `SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)`
+
+	type Row struct {
+		Service              string  `json:"service"`
+		Requests             int64   `json:"requests"`
+		ErrorRatePct         float64 `json:"error_rate_pct"`
+		BaselineErrorRatePct float64 `json:"baseline_error_rate_pct"`
+		BaselineStddevPct    float64 `json:"baseline_stddev_pct"`
+		BaselineBuckets      int64   `json:"baseline_buckets"`
+		ThresholdPct         float64 `json:"threshold_pct"`
+		Anomalous            bool    `json:"anomalous"`
+	}
+
+	f := metricFilter(c, win)
+	query := `
+		SELECT
+		  service,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS requests,
+		  CAST(100.0 * ` + errs + ` / SUM(` + w + `) AS DOUBLE) AS error_rate_pct
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service
+		ORDER BY service;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	out := []Row{}
+	byService := map[string]int{}
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.Service, &r.Requests, &r.ErrorRatePct); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		byService[r.Service] = len(out)
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	bf := metricFilter(c, baseWin)
+	bf.add("timestamp < ?", baseWin.To)
+	query = `
+		WITH buckets AS (
+		  SELECT
+		    service,
+		    100.0 * ` + errs + ` / SUM(` + w + `) AS rate
+		  FROM ` + src + `
+		  ` + bf.where() + `
+		  GROUP BY service, time_bucket(` + intervalLiteral(interval) + `, timestamp)
+		  HAVING SUM(` + w + `) > 0
+		)
+		SELECT
+		  service,
+		  CAST(AVG(rate) AS DOUBLE),
+		  CAST(COALESCE(STDDEV_POP(rate), 0) AS DOUBLE),
+		  COUNT(*)
+		FROM buckets
+		GROUP BY service;
+	`
+
+	baseRows, err := qe.db.QueryContext(c.Request().Context(), query, bf.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer baseRows.Close()
+
+	for baseRows.Next() {
+		var (
+			svc          string
+			mean, stddev float64
+			n            int64
+		)
+		if err := baseRows.Scan(&svc, &mean, &stddev, &n); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		if i, ok := byService[svc]; ok {
+			out[i].BaselineErrorRatePct, out[i].BaselineStddevPct, out[i].BaselineBuckets = mean, stddev, n
+		}
+	}
+	if err := baseRows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	for i := range out {
+		r := &out[i]
+		r.ThresholdPct = anomalyThreshold(r.BaselineErrorRatePct, r.BaselineStddevPct, multiplier, sigma)
+		r.Anomalous = r.Requests >= minRequests && r.ErrorRatePct > r.ThresholdPct
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+// anomalyThreshold is the error rate above which a service is flagged:
+// mean + sigma*stddev when sigma is set, otherwise mean * multiplier.
+func anomalyThreshold(mean, stddev, multiplier, sigma float64) float64 {
+	if sigma > 0 {
+		return mean + sigma*stddev
+	}
+	return mean * multiplier
+}
+
+func (qe *QueryEngine) handleP95Latency(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+
+	query := `
+		SELECT
+		  service,
+		  CAST(ROUND(quantile_cont(latency_ms, 0.95), 2) AS DOUBLE) AS p95_latency_ms
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service
+		ORDER BY p95_latency_ms DESC;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Service      string  `json:"service"`
+		P95LatencyMs float64 `json:"p95_latency_ms"`
+	}
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.Service, &r.P95LatencyMs); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+// handleLatencyPercentiles returns several latency percentiles per service,
+// e.g. ?p=50&p=90&p=99. Defaults to p50/p95/p99 when no p is given.
+func (qe *QueryEngine) handleLatencyPercentiles(c echo.Context) error {
+	raw := c.QueryParams()["p"]
+	if len(raw) == 0 {
+		raw = []string{"50", "95", "99"}
+	}
+
+	// Percentiles are parsed as numbers and re-formatted, so no caller text
+	// reaches the SQL.
+	pcts := make([]float64, 0, len(raw))
+	for _, v := range raw {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 || p > 100 {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "p must be a number between 0 and 100: " + v})
+		}
+		pcts = append(pcts, p)
+	}
+
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	cols := make([]string, 0, len(pcts))
+	for i, p := range pcts {
+		cols = append(cols, fmt.Sprintf("CAST(ROUND(quantile_cont(latency_ms, %s), 2) AS DOUBLE) AS p_%d",
+			strconv.FormatFloat(p/100, 'f', -1, 64), i))
+	}
+
+	f := metricFilter(c, win)
+	query := `
+		SELECT
+		  service,
+		  ` + strings.Join(cols, ", ") + `
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service
+		ORDER BY service;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Service     string             `json:"service"`
+		Percentiles map[string]float64 `json:"percentiles"`
+	}
+
+	var out []Row
+	for rows.Next() {
+		var service string
+		values := make([]float64, len(pcts))
+		dest := []any{&service}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+
+		r := Row{Service: service, Percentiles: make(map[string]float64, len(pcts))}
+		for i, p := range pcts {
+			r.Percentiles["p"+strconv.FormatFloat(p, 'f', -1, 64)] = values[i]
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+// handleLatencyByEndpoint returns p50/p95/p99 latency and request count per
+// service and endpoint, slowest p95 first, to pinpoint the route that makes a
+// service slow. ?limit= and ?offset= page through the endpoints; X-Total-Count
+// carries the number of service/endpoint pairs.
+func (qe *QueryEngine) handleLatencyByEndpoint(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	limit, offset, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		c.Response().Header().Set(totalCountHeader, "0")
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+
+	countQuery := `
+		SELECT COUNT(*) FROM (
+		  SELECT DISTINCT service, endpoint
+		  FROM ` + src + `
+		  ` + f.where() + `
+		);
+	`
+
+	var total int64
+	if err := qe.db.QueryRowContext(c.Request().Context(), countQuery, f.args...).Scan(&total); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	c.Response().Header().Set(totalCountHeader, strconv.FormatInt(total, 10))
+
+	query := `
+		SELECT
+		  service,
+		  endpoint,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS requests,
+		  CAST(ROUND(quantile_cont(latency_ms, 0.50), 2) AS DOUBLE) AS p50_latency_ms,
+		  CAST(ROUND(quantile_cont(latency_ms, 0.95), 2) AS DOUBLE) AS p95_latency_ms,
+		  CAST(ROUND(quantile_cont(latency_ms, 0.99), 2) AS DOUBLE) AS p99_latency_ms
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service, endpoint
+		ORDER BY p95_latency_ms DESC, service, endpoint
+		LIMIT ` + strconv.Itoa(limit) + ` OFFSET ` + strconv.Itoa(offset) + `;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Service      string  `json:"service"`
+		Endpoint     string  `json:"endpoint"`
+		Requests     int64   `json:"requests"`
+		P50LatencyMs float64 `json:"p50_latency_ms"`
+		P95LatencyMs float64 `json:"p95_latency_ms"`
+		P99LatencyMs float64 `json:"p99_latency_ms"`
+	}
+
+	out := []Row{}
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.Service, &r.Endpoint, &r.Requests, &r.P50LatencyMs, &r.P95LatencyMs, &r.P99LatencyMs); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+func (qe *QueryEngine) handleTopImpactedCustomers(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	limit, offset, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		c.Response().Header().Set(totalCountHeader, "0")
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+
+	countQuery := `
+		SELECT COUNT(DISTINCT customer_id)
+		FROM ` + src + `
+		` + f.where() + `;
+	`
+
+	var total int64
+	if err := qe.db.QueryRowContext(c.Request().Context(), countQuery, f.args...).Scan(&total); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	c.Response().Header().Set(totalCountHeader, strconv.FormatInt(total, 10))
+
+	query := `
+		SELECT
+		  customer_id,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS requests,
+		  CAST(ROUND(SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS errors
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY customer_id
+		ORDER BY errors DESC, customer_id
+		LIMIT ` + strconv.Itoa(limit) + ` OFFSET ` + strconv.Itoa(offset) + `;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		CustomerID string `json:"customer_id"`
+		Requests   int64  `json:"requests"`
+		Errors     int64  `json:"errors"`
+	}
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.CustomerID, &r.Requests, &r.Errors); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+func (qe *QueryEngine) handleCustomerAvailability(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+
+	// weighting=request (default) counts every request equally; weighting=time
+	// averages per-minute availability so quiet minutes weigh as much as busy ones.
+	var query string
+	switch c.QueryParam("weighting") {
+	case "", "request":
+		query = `
+		SELECT
+		  customer_id,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS total,
+		  CAST(ROUND(SUM(CASE WHEN status_code < 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS successful,
+		  CAST(ROUND(100.0 * SUM(CASE WHEN status_code < 500 THEN ` + w + ` ELSE 0 END) / SUM(` + w + `), 2) AS DOUBLE) AS availability_pct
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY customer_id
+		ORDER BY availability_pct ASC;
+	`
+	case "time":
+		query = `
+		WITH per_minute AS (
+		  SELECT
+		    customer_id,
+		    date_trunc('minute', timestamp) AS minute,
+		    SUM(` + w + `) AS total,
+		    SUM(CASE WHEN status_code < 500 THEN ` + w + ` ELSE 0 END) AS successful
+		  FROM ` + src + `
+		  ` + f.where() + `
+		  GROUP BY customer_id, minute
+		)
+		SELECT
+		  customer_id,
+		  CAST(ROUND(SUM(total)) AS BIGINT) AS total,
+		  CAST(ROUND(SUM(successful)) AS BIGINT) AS successful,
+		  CAST(ROUND(AVG(100.0 * successful / total), 2) AS DOUBLE) AS availability_pct
+		FROM per_minute
+		GROUP BY customer_id
+		ORDER BY availability_pct ASC;
+	`
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": "weighting must be time or request"})
+	}
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		CustomerID      string  `json:"customer_id"`
+		Total           int64   `json:"total"`
+		Successful      int64   `json:"successful"`
+		AvailabilityPct float64 `json:"availability_pct"`
+	}
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.CustomerID, &r.Total, &r.Successful, &r.AvailabilityPct); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+func (qe *QueryEngine) handleSummary(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, map[string]any{"total_rows": 0, "latest_ingested": "", "by_environment": []any{}})
+	}
+
+	sum, err := qe.summary(c.Request().Context(), src, metricFilter(c, win))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	type EnvRow struct {
+		Environment    string `json:"environment"`
+		TotalRows      int64  `json:"total_rows"`
+		Errors         int64  `json:"errors"`
+		LatestIngested string `json:"latest_ingested"`
+	}
+
+	byEnv := make([]EnvRow, 0, len(sum.ByEnvironment))
+	for _, e := range sum.ByEnvironment {
+		byEnv = append(byEnv, EnvRow{
+			Environment:    e.Environment,
+			TotalRows:      e.TotalRows,
+			Errors:         e.Errors,
+			LatestIngested: formatNullTime(e.LatestIngested),
+		})
+	}
+
+	return respond(c, http.StatusOK, map[string]any{
+		"total_rows":      sum.TotalRows,
+		"latest_ingested": formatNullTime(sum.LatestIngested),
+		"by_environment":  byEnv,
+	})
+}
+
+// summaryResult backs /metrics/summary and the Summary RPC. Ingestion times
+// are NULL when nothing falls in the window.
+type summaryResult struct {
+	TotalRows      int64
+	LatestIngested sql.NullTime
+	ByEnvironment  []envSummary
+}
+
+type envSummary struct {
+	Environment    string
+	TotalRows      int64
+	Errors         int64
+	LatestIngested sql.NullTime
+}
+
+// summary counts the rows of src matching f.
+func (qe *QueryEngine) summary(ctx context.Context, src string, f *queryFilter) (summaryResult, error) {
+	var res summaryResult
+	query := `
+		SELECT
+		  CAST(COUNT(*) AS BIGINT) AS total_rows,
+		  MAX(ingested_at) AS max_ingested_at
+		FROM ` + src + `
+		` + f.where() + `;
+	`
+	if err := qe.db.QueryRowContext(ctx, query, f.args...).Scan(&res.TotalRows, &res.LatestIngested); err != nil {
+		return res, err
+	}
+
+	// Files written before the environment column existed read it as NULL
+	query = `
+		SELECT
+		  COALESCE(environment, 'unknown') AS env,
+		  CAST(COUNT(*) AS BIGINT) AS total_rows,
+		  CAST(SUM(CASE WHEN status_code >= 500 THEN 1 ELSE 0 END) AS BIGINT) AS errors,
+		  MAX(ingested_at) AS max_ingested_at
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY env
+		ORDER BY total_rows DESC, env;
+	`
+
+	rows, err := qe.db.QueryContext(ctx, query, f.args...)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e envSummary
+		if err := rows.Scan(&e.Environment, &e.TotalRows, &e.Errors, &e.LatestIngested); err != nil {
+			return res, err
+		}
+		res.ByEnvironment = append(res.ByEnvironment, e)
+	}
+	return res, rows.Err()
+}
+
+// formatNullTime renders t as RFC3339, or "" when it is NULL.
+func formatNullTime(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.UTC().Format(time.RFC3339)
+}
+
+func (qe *QueryEngine) handleLatencyContribution(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	// by_service=true splits each endpoint's contribution per service
+	byService := c.QueryParam("by_service") == "true"
+	groupCols := "endpoint"
+	if byService {
+		groupCols = "service, endpoint"
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+	query := `
+		SELECT
+		  ` + groupCols + `,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS requests,
+		  CAST(ROUND(SUM(latency_ms * ` + w + `)) AS BIGINT) AS total_latency_ms,
+		  CAST(ROUND(100.0 * SUM(latency_ms * ` + w + `) / SUM(SUM(latency_ms * ` + w + `)) OVER (), 2) AS DOUBLE) AS share_pct
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY ` + groupCols + `
+		ORDER BY total_latency_ms DESC;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Service        string  `json:"service,omitempty"`
+		Endpoint       string  `json:"endpoint"`
+		Requests       int64   `json:"requests"`
+		TotalLatencyMs int64   `json:"total_latency_ms"`
+		SharePct       float64 `json:"share_pct"`
+	}
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		dest := []any{&r.Endpoint, &r.Requests, &r.TotalLatencyMs, &r.SharePct}
+		if byService {
+			dest = append([]any{&r.Service}, dest...)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
+}
+
+func (qe *QueryEngine) handleServiceErrorAttribution(c echo.Context) error {
+	service := strings.TrimSpace(c.QueryParam("service"))
+	if service == "" {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": "service is required"})
+	}
+
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	// For each customer: their share of the service's errors, and the service
+	// error rate recomputed as if their traffic were removed. metricFilter
+	// picks up the required service along with any other filters.
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+	query := `
+		WITH per_customer AS (
+		  SELECT
+		    customer_id,
+		    ROUND(SUM(` + w + `)) AS requests,
+		    ROUND(SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)) AS errors
+		  FROM ` + src + `
+		  ` + f.where() + `
+		  GROUP BY customer_id
+		),
+		totals AS (
+		  SELECT SUM(requests) AS total_requests, SUM(errors) AS total_errors
+		  FROM per_customer
+		)
+		SELECT
+		  customer_id,
+		  CAST(requests AS BIGINT) AS requests,
+		  CAST(errors AS BIGINT) AS errors,
+		  CAST(COALESCE(ROUND(100.0 * errors / NULLIF(total_errors, 0), 2), 0) AS DOUBLE) AS error_share_pct,
+		  CAST(ROUND(100.0 * total_errors / total_requests, 2) AS DOUBLE) AS service_error_rate_pct,
+		  CAST(COALESCE(ROUND(100.0 * (total_errors - errors) / NULLIF(total_requests - requests, 0), 2), 0) AS DOUBLE) AS error_rate_excluding_pct
+		FROM per_customer, totals
+		ORDER BY errors DESC, customer_id;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		CustomerID            string  `json:"customer_id"`
+		Requests              int64   `json:"requests"`
+		Errors                int64   `json:"errors"`
+		ErrorSharePct         float64 `json:"error_share_pct"`
+		ServiceErrorRatePct   float64 `json:"service_error_rate_pct"`
+		ErrorRateExcludingPct float64 `json:"error_rate_excluding_pct"`
+	}
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		if err := rows.Scan(&r.CustomerID, &r.Requests, &r.Errors, &r.ErrorSharePct, &r.ServiceErrorRatePct, &r.ErrorRateExcludingPct); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+
+	return respond(c, http.StatusOK, out)
 }
 
-func main() {
-	// DuckDB engine
-	db, err := sql.Open("duckdb", "")
+func (qe *QueryEngine) handleThroughput(c echo.Context) error {
+	interval, err := parseInterval(c, time.Minute)
 	if err != nil {
-		panic(err)
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
 	}
-	defer db.Close()
 
-	// DuckDB httpfs config (we will read Parquet via HTTP URLs served by MinIO)
-	mustExec(db, `INSTALL httpfs;`)
-	mustExec(db, `LOAD httpfs;`)
+	loc, err := parseTZ(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
 
-	// (These S3 settings can stay; but we won't rely on s3:// paths in this demo)
-	mustExec(db, `SET s3_endpoint='localhost:9000';`)
-	mustExec(db, `SET s3_access_key_id='minioadmin';`)
-	mustExec(db, `SET s3_secret_access_key='minioadmin';`)
-	mustExec(db, `SET s3_use_ssl=false;`)
-	mustExec(db, `SET s3_url_style='path';`)
-	mustExec(db, `SET s3_region='us-east-1';`)
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
 
-	// MinIO client (for listing objects)
-	minioClient, err := minio.New("localhost:9000", &minio.Options{
-		Creds:  credentials.NewStaticV4("minioadmin", "minioadmin", ""),
-		Secure: false,
-	})
+	src, err := qe.parquetSource(c, win)
 	if err != nil {
-		panic(err)
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
 	}
 
-	qe := &QueryEngine{
-		db:          db,
-		minioClient: minioClient,
-		bucket:      "tigerscope",
-		prefix:      "telemetry/parquet/",
-		minioHTTP:   "http://localhost:9000",
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+
+	// by_service=true returns one series per service
+	byService := c.QueryParam("by_service") == "true"
+	groupCols := "bucket"
+	serviceCol := ""
+	if byService {
+		groupCols = "bucket, service"
+		serviceCol = "service,"
 	}
 
-	e := echo.New()
-	e.Use(middleware.CORS())
+	query := `
+		SELECT
+		  ` + bucketExpr(interval, loc) + ` AS bucket,
+		  ` + serviceCol + `
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS count
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY ` + groupCols + `
+		ORDER BY ` + groupCols + `;
+	`
 
-	e.GET("/healthz", func(c echo.Context) error {
-		return c.String(http.StatusOK, "ok")
-	})
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
 
-	e.GET("/metrics/error-rate", qe.handleErrorRate)
-	e.GET("/metrics/p95-latency", qe.handleP95Latency)
-	e.GET("/metrics/top-impacted-customers", qe.handleTopImpactedCustomers)
-	e.GET("/metrics/customer-availability", qe.handleCustomerAvailability)
-	e.GET("/metrics/summary", qe.handleSummary)
+	type Row struct {
+		Bucket  time.Time `json:"bucket"`
+		Service string    `json:"service,omitempty"`
+		Count   int64     `json:"count"`
+	}
 
-	e.Logger.Fatal(e.Start(":8090"))
+	return streamRows(c, rows, qe.maxRows, func() (any, error) {
+		var r Row
+		dest := []any{&r.Bucket, &r.Count}
+		if byService {
+			dest = []any{&r.Bucket, &r.Service, &r.Count}
+		}
+		err := rows.Scan(dest...)
+		r.Bucket = r.Bucket.In(loc)
+		return r, err
+	})
 }
 
-func mustExec(db *sql.DB, stmt string) {
-	if _, err := db.Exec(stmt); err != nil {
-		panic(err)
+// handleCustomerErrorRateTimeseries returns one customer's error rate per
+// interval bucket, for the support console sparkline. Buckets with no
+// requests are omitted.
+func (qe *QueryEngine) handleCustomerErrorRateTimeseries(c echo.Context) error {
+	customerID := strings.TrimSpace(c.Param("customer_id"))
+	if customerID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": "customer_id is required"})
 	}
-}
 
-func (qe *QueryEngine) parquetFileList(limit int) ([]string, error) {
-	ctx := context.Background()
+	interval, err := parseInterval(c, 5*time.Minute)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
 
-	opts := minio.ListObjectsOptions{
-		Prefix:    qe.prefix,
-		Recursive: true,
+	loc, err := parseTZ(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
 	}
 
-	var files []string
-	for obj := range qe.minioClient.ListObjects(ctx, qe.bucket, opts) {
-		if obj.Err != nil {
-			return nil, obj.Err
-		}
-		if strings.HasSuffix(obj.Key, ".parquet") {
-			// Use HTTP URL so DuckDB reads via httpfs without S3 hostname inference
-			files = append(files, qe.minioHTTP+"/"+qe.bucket+"/"+obj.Key)
-		}
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
+	}
+
+	f := metricFilter(c, win)
+	f.add("customer_id = ?", customerID)
+	w := weightExpr(c)
+
+	query := `
+		SELECT
+		  ` + bucketExpr(interval, loc) + ` AS bucket,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS total_requests,
+		  CAST(ROUND(SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS errors,
+		  CAST(ROUND(100.0 * SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END) / SUM(` + w + `), 2) AS DOUBLE) AS error_rate_pct
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY bucket
+		ORDER BY bucket;
+	`
 
-	sort.Strings(files)
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
 
-	if limit > 0 && len(files) > limit {
-		files = files[len(files)-limit:]
+	type Row struct {
+		Bucket       time.Time `json:"bucket"`
+		Total        int64     `json:"total_requests"`
+		Errors       int64     `json:"errors"`
+		ErrorRatePct float64   `json:"error_rate_pct"`
 	}
 
-	return files, nil
+	return streamRows(c, rows, qe.maxRows, func() (any, error) {
+		var r Row
+		err := rows.Scan(&r.Bucket, &r.Total, &r.Errors, &r.ErrorRatePct)
+		r.Bucket = r.Bucket.In(loc)
+		return r, err
+	})
 }
 
-func duckdbFileArrayLiteral(files []string) string {
-	escaped := make([]string, 0, len(files))
-	for _, f := range files {
-		escaped = append(escaped, "'"+strings.ReplaceAll(f, "'", "''")+"'")
+// handleAvailabilityTimeseries returns availability (non-5xx / total, as in
+// /metrics/customer-availability) per interval bucket for ?customer_id=,
+// ?service= or both, for plotting trends and spotting downtime. Buckets with
+// no requests are omitted.
+func (qe *QueryEngine) handleAvailabilityTimeseries(c echo.Context) error {
+	customerID := strings.TrimSpace(c.QueryParam("customer_id"))
+	if customerID == "" && strings.TrimSpace(c.QueryParam("service")) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": "customer_id or service is required"})
 	}
-	return "[" + strings.Join(escaped, ",") + "]"
-}
 
-func (qe *QueryEngine) handleErrorRate(c echo.Context) error {
-	files, err := qe.parquetFileList(200)
+	interval, err := parseInterval(c, 5*time.Minute)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	loc, err := parseTZ(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
-	if len(files) == 0 {
-		return c.JSON(http.StatusOK, []any{})
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
 	}
 
-	src := duckdbFileArrayLiteral(files)
+	f := metricFilter(c, win)
+	if customerID != "" {
+		f.add("customer_id = ?", customerID)
+	}
+	w := weightExpr(c)
 
-	rows, err := qe.db.Query(`
+	query := `
 		SELECT
-		  service,
-		  CAST(COUNT(*) AS BIGINT) AS total_requests,
-		  CAST(SUM(CASE WHEN status_code >= 500 THEN 1 ELSE 0 END) AS BIGINT) AS errors,
-		  CAST(ROUND(100.0 * SUM(CASE WHEN status_code >= 500 THEN 1 ELSE 0 END) / COUNT(*), 2) AS DOUBLE) AS error_rate_pct
-		FROM read_parquet(` + src + `, filename=true)
-		GROUP BY service
-		ORDER BY error_rate_pct DESC;
-	`)
+		  ` + bucketExpr(interval, loc) + ` AS bucket,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS total_requests,
+		  CAST(ROUND(SUM(CASE WHEN status_code < 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS successful,
+		  CAST(ROUND(100.0 * SUM(CASE WHEN status_code < 500 THEN ` + w + ` ELSE 0 END) / SUM(` + w + `), 2) AS DOUBLE) AS availability_pct
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY bucket
+		ORDER BY bucket;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 	defer rows.Close()
 
 	type Row struct {
-		Service      string  `json:"service"`
-		Total        int64   `json:"total_requests"`
-		Errors       int64   `json:"errors"`
-		ErrorRatePct float64 `json:"error_rate_pct"`
+		Bucket          time.Time `json:"bucket"`
+		Total           int64     `json:"total_requests"`
+		Successful      int64     `json:"successful"`
+		AvailabilityPct float64   `json:"availability_pct"`
 	}
 
-	var out []Row
-	for rows.Next() {
+	return streamRows(c, rows, qe.maxRows, func() (any, error) {
 		var r Row
-		if err := rows.Scan(&r.Service, &r.Total, &r.Errors, &r.ErrorRatePct); err != nil {
+		err := rows.Scan(&r.Bucket, &r.Total, &r.Successful, &r.AvailabilityPct)
+		r.Bucket = r.Bucket.In(loc)
+		return r, err
+	})
+}
+
+func (qe *QueryEngine) handleLatencyHistogram(c echo.Context) error {
+	bounds, err := parseLatencyBuckets(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	type Series struct {
+		Service string  `json:"service,omitempty"`
+		Counts  []int64 `json:"counts"`
+	}
+	type Response struct {
+		Buckets []int64  `json:"buckets"`
+		Series  []Series `json:"series"`
+	}
+	out := Response{Buckets: bounds, Series: []Series{}}
+
+	src, err := qe.parquetSource(c, win)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	if src == "" {
+		return respond(c, http.StatusOK, out)
+	}
+
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+
+	// by_service=true returns one histogram per service
+	byService := c.QueryParam("by_service") == "true"
+	serviceCol := "''"
+	if byService {
+		serviceCol = "service"
+	}
+
+	query := `
+		SELECT
+		  ` + serviceCol + ` AS service,
+		  ` + latencyBucketExpr(bounds) + ` AS bucket,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS count
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY 1, 2
+		ORDER BY 1, 2;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	index := map[string]int{}
+	for rows.Next() {
+		var (
+			service string
+			bucket  int
+			count   int64
+		)
+		if err := rows.Scan(&service, &bucket, &count); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 		}
-		out = append(out, r)
+		i, ok := index[service]
+		if !ok {
+			i = len(out.Series)
+			index[service] = i
+			out.Series = append(out.Series, Series{Service: service, Counts: make([]int64, len(bounds))})
+		}
+		out.Series[i].Counts[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 
-	return c.JSON(http.StatusOK, out)
+	return respond(c, http.StatusOK, out)
 }
 
-func (qe *QueryEngine) handleP95Latency(c echo.Context) error {
-	files, err := qe.parquetFileList(200)
+// handleLatencyHeatmap counts requests per time bucket and latency bucket.
+// counts[i][j] is the number of requests in time bucket i (starting at
+// time_buckets[i]) whose latency falls in latency bucket j (at least
+// latency_buckets[j] ms, below latency_buckets[j+1]). The grid is dense, so
+// empty cells are zero.
+func (qe *QueryEngine) handleLatencyHeatmap(c echo.Context) error {
+	bounds, err := parseLatencyBuckets(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	interval, err := parseInterval(c, 5*time.Minute)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	loc, err := parseTZ(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	times, err := timeBuckets(win, interval, loc)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	index := make(map[int64]int, len(times))
+	for i, t := range times {
+		index[t.Unix()] = i
+	}
+
+	type Response struct {
+		IntervalSeconds int64       `json:"interval_seconds"`
+		TimeBuckets     []time.Time `json:"time_buckets"`
+		LatencyBuckets  []int64     `json:"latency_buckets"`
+		Counts          [][]int64   `json:"counts"`
+	}
+	out := Response{
+		IntervalSeconds: int64(interval / time.Second),
+		TimeBuckets:     times,
+		LatencyBuckets:  bounds,
+		Counts:          make([][]int64, len(times)),
+	}
+	for i := range out.Counts {
+		out.Counts[i] = make([]int64, len(bounds))
+	}
+
+	src, err := qe.parquetSource(c, win)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
-	if len(files) == 0 {
-		return c.JSON(http.StatusOK, []any{})
+	if src == "" {
+		return respond(c, http.StatusOK, out)
 	}
 
-	src := duckdbFileArrayLiteral(files)
+	f := metricFilter(c, win)
+	w := weightExpr(c)
 
-	rows, err := qe.db.Query(`
+	query := `
 		SELECT
-		  service,
-		  CAST(ROUND(quantile_cont(latency_ms, 0.95), 2) AS DOUBLE) AS p95_latency_ms
-		FROM read_parquet(` + src + `, filename=true)
-		GROUP BY service
-		ORDER BY p95_latency_ms DESC;
-	`)
+		  ` + bucketExpr(interval, loc) + ` AS bucket,
+		  ` + latencyBucketExpr(bounds) + ` AS latency_bucket,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS count
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY 1, 2
+		ORDER BY 1, 2;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 	defer rows.Close()
 
-	type Row struct {
-		Service      string  `json:"service"`
-		P95LatencyMs float64 `json:"p95_latency_ms"`
-	}
-
-	var out []Row
 	for rows.Next() {
-		var r Row
-		if err := rows.Scan(&r.Service, &r.P95LatencyMs); err != nil {
+		var (
+			bucket  time.Time
+			latency int
+			count   int64
+		)
+		if err := rows.Scan(&bucket, &latency, &count); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 		}
-		out = append(out, r)
+		i, ok := index[bucket.Unix()]
+		if !ok {
+			continue
+		}
+		out.Counts[i][latency] = count
+	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 
-	return c.JSON(http.StatusOK, out)
+	return respond(c, http.StatusOK, out)
 }
 
-func (qe *QueryEngine) handleTopImpactedCustomers(c echo.Context) error {
-	files, err := qe.parquetFileList(200)
+// handleSLO compares each service's availability (non-5xx / total) over the
+// window with ?target= (a percentage, default 99.9) and reports how much of
+// the window's error budget is left. A negative budget means the SLO is blown.
+func (qe *QueryEngine) handleSLO(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	target := 99.9
+	if v := c.QueryParam("target"); v != "" {
+		target, err = strconv.ParseFloat(v, 64)
+		if err != nil || target <= 0 || target >= 100 {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "target must be a percentage between 0 and 100, e.g. 99.9"})
+		}
+	}
+
+	src, err := qe.parquetSource(c, win)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
-	if len(files) == 0 {
-		return c.JSON(http.StatusOK, []any{})
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
 	}
 
-	src := duckdbFileArrayLiteral(files)
+	f := metricFilter(c, win)
+	w := weightExpr(c)
 
-	rows, err := qe.db.Query(`
+	query := `
 		SELECT
-		  customer_id,
-		  CAST(COUNT(*) AS BIGINT) AS requests,
-		  CAST(SUM(CASE WHEN status_code >= 500 THEN 1 ELSE 0 END) AS BIGINT) AS errors
-		FROM read_parquet(` + src + `, filename=true)
-		GROUP BY customer_id
-		ORDER BY errors DESC
-		LIMIT 10;
-	`)
+		  service,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS total_requests,
+		  CAST(ROUND(SUM(CASE WHEN status_code >= 500 THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS errors
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service
+		ORDER BY service;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 	defer rows.Close()
 
 	type Row struct {
-		CustomerID string `json:"customer_id"`
-		Requests   int64  `json:"requests"`
-		Errors     int64  `json:"errors"`
+		Service            string  `json:"service"`
+		Total              int64   `json:"total_requests"`
+		Errors             int64   `json:"errors"`
+		AvailabilityPct    float64 `json:"availability_pct"`
+		TargetPct          float64 `json:"target_pct"`
+		MeetingSLO         bool    `json:"meeting_slo"`
+		AllowedErrors      float64 `json:"allowed_errors"`
+		BudgetRemaining    float64 `json:"error_budget_remaining"`
+		BudgetRemainingPct float64 `json:"error_budget_remaining_pct"`
 	}
 
 	var out []Row
 	for rows.Next() {
 		var r Row
-		if err := rows.Scan(&r.CustomerID, &r.Requests, &r.Errors); err != nil {
+		if err := rows.Scan(&r.Service, &r.Total, &r.Errors); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 		}
+		r.TargetPct = target
+		r.AvailabilityPct = 100
+		if r.Total > 0 {
+			r.AvailabilityPct = 100 * float64(r.Total-r.Errors) / float64(r.Total)
+		}
+		r.MeetingSLO = r.AvailabilityPct >= target
+		r.AllowedErrors = float64(r.Total) * (100 - target) / 100
+		r.BudgetRemaining = r.AllowedErrors - float64(r.Errors)
+		if r.AllowedErrors > 0 {
+			r.BudgetRemainingPct = 100 * r.BudgetRemaining / r.AllowedErrors
+		}
 		out = append(out, r)
 	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
 
-	return c.JSON(http.StatusOK, out)
+	return respond(c, http.StatusOK, out)
 }
 
-func (qe *QueryEngine) handleCustomerAvailability(c echo.Context) error {
-	files, err := qe.parquetFileList(200)
+// handleApdex scores each service's latency against ?threshold= (T, in ms,
+// default APDEX_THRESHOLD_MS): requests up to T are satisfied, up to 4T
+// tolerating, slower ones frustrated, and apdex = (satisfied + tolerating/2) / total.
+func (qe *QueryEngine) handleApdex(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	threshold := qe.apdexThresholdMs
+	if v := c.QueryParam("threshold"); v != "" {
+		threshold, err = strconv.Atoi(v)
+		if err != nil || threshold <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "threshold must be a positive number of milliseconds"})
+		}
+	}
+
+	src, err := qe.parquetSource(c, win)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
-	if len(files) == 0 {
-		return c.JSON(http.StatusOK, []any{})
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
 	}
 
-	src := duckdbFileArrayLiteral(files)
+	f := metricFilter(c, win)
+	w := weightExpr(c)
+	t := strconv.Itoa(threshold)
+	t4 := strconv.Itoa(4 * threshold)
 
-	rows, err := qe.db.Query(`
+	query := `
 		SELECT
-		  customer_id,
-		  CAST(COUNT(*) AS BIGINT) AS total,
-		  CAST(SUM(CASE WHEN status_code < 500 THEN 1 ELSE 0 END) AS BIGINT) AS successful,
-		  CAST(ROUND(100.0 * SUM(CASE WHEN status_code < 500 THEN 1 ELSE 0 END) / COUNT(*), 2) AS DOUBLE) AS availability_pct
-		FROM read_parquet(` + src + `, filename=true)
-		GROUP BY customer_id
-		ORDER BY availability_pct ASC;
-	`)
+		  service,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS total,
+		  CAST(ROUND(SUM(CASE WHEN latency_ms <= ` + t + ` THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS satisfied,
+		  CAST(ROUND(SUM(CASE WHEN latency_ms > ` + t + ` AND latency_ms <= ` + t4 + ` THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS tolerating,
+		  CAST(ROUND(SUM(CASE WHEN latency_ms > ` + t4 + ` THEN ` + w + ` ELSE 0 END)) AS BIGINT) AS frustrated
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY service
+		ORDER BY service;
+	`
+
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 	defer rows.Close()
 
 	type Row struct {
-		CustomerID      string  `json:"customer_id"`
-		Total           int64   `json:"total"`
-		Successful      int64   `json:"successful"`
-		AvailabilityPct float64 `json:"availability_pct"`
+		Service     string  `json:"service"`
+		ThresholdMs int     `json:"threshold_ms"`
+		Total       int64   `json:"total"`
+		Satisfied   int64   `json:"satisfied"`
+		Tolerating  int64   `json:"tolerating"`
+		Frustrated  int64   `json:"frustrated"`
+		Apdex       float64 `json:"apdex"`
 	}
 
 	var out []Row
 	for rows.Next() {
-		var r Row
-		if err := rows.Scan(&r.CustomerID, &r.Total, &r.Successful, &r.AvailabilityPct); err != nil {
+		r := Row{ThresholdMs: threshold}
+		if err := rows.Scan(&r.Service, &r.Total, &r.Satisfied, &r.Tolerating, &r.Frustrated); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 		}
+		if r.Total > 0 {
+			r.Apdex = math.Round((float64(r.Satisfied)+float64(r.Tolerating)/2)/float64(r.Total)*1000) / 1000
+		}
 		out = append(out, r)
 	}
+	if err := rows.Err(); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
 
-	return c.JSON(http.StatusOK, out)
+	return respond(c, http.StatusOK, out)
 }
 
-func (qe *QueryEngine) handleSummary(c echo.Context) error {
-	files, err := qe.parquetFileList(200)
+// handleErrorBreakdown counts events per distinct error message, most frequent
+// first. ?limit= caps the number of messages returned; by_service=true counts
+// each message per service instead.
+func (qe *QueryEngine) handleErrorBreakdown(c echo.Context) error {
+	win, err := parseWindow(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+	limit, offset, err := parsePage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{"error": err.Error()})
+	}
+
+	src, err := qe.parquetSource(c, win)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
-	if len(files) == 0 {
-		return c.JSON(http.StatusOK, map[string]any{"total_rows": 0, "latest_ingested": ""})
+	if src == "" {
+		return respond(c, http.StatusOK, []any{})
 	}
 
-	src := duckdbFileArrayLiteral(files)
+	f := metricFilter(c, win)
+	f.add("error IS NOT NULL AND error <> ''")
+	w := weightExpr(c)
+
+	byService := c.QueryParam("by_service") == "true"
+	groupCols := "error"
+	if byService {
+		groupCols = "service, error"
+	}
 
-	row := qe.db.QueryRow(`
+	query := `
 		SELECT
-		  CAST(COUNT(*) AS BIGINT) AS total_rows,
-		  MAX(ingested_at) AS max_ingested_at
-		FROM read_parquet(` + src + `, filename=true);
-	`)
+		  ` + groupCols + `,
+		  CAST(ROUND(SUM(` + w + `)) AS BIGINT) AS occurrences
+		FROM ` + src + `
+		` + f.where() + `
+		GROUP BY ` + groupCols + `
+		ORDER BY occurrences DESC, ` + groupCols + `
+		LIMIT ` + strconv.Itoa(limit) + ` OFFSET ` + strconv.Itoa(offset) + `;
+	`
 
-	var total int64
-	var maxIngested time.Time
-	if err := row.Scan(&total, &maxIngested); err != nil {
+	rows, err := qe.db.QueryContext(c.Request().Context(), query, f.args...)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	type Row struct {
+		Service     string `json:"service,omitempty"`
+		Error       string `json:"error"`
+		Occurrences int64  `json:"occurrences"`
+	}
+
+	var out []Row
+	for rows.Next() {
+		var r Row
+		dest := []any{&r.Error, &r.Occurrences}
+		if byService {
+			dest = append([]any{&r.Service}, dest...)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
 	}
 
-	return c.JSON(http.StatusOK, map[string]any{
-		"total_rows":      total,
-		"latest_ingested": maxIngested.UTC().Format(time.RFC3339),
-	})
+	return respond(c, http.StatusOK, out)
 }
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/minio/minio-go/v7"
+)
+
+// listedEngine is a QueryEngine reading keys from a fake listing in http mode.
+func listedEngine(keys ...string) *QueryEngine {
+	lister := &fakeLister{}
+	for _, key := range keys {
+		lister.objects = append(lister.objects, minio.ObjectInfo{Key: key})
+	}
+	return &QueryEngine{
+		listing:   newListingCache(lister, "telemetry", 0),
+		bucket:    "telemetry",
+		prefix:    "telemetry/parquet/",
+		minioHTTP: "http://minio:9000",
+		readMode:  readModeHTTP,
+	}
+}
+
+func batchKey(svc string, hour time.Time, n int) string {
+	return fmt.Sprintf("telemetry/parquet/service=%s/date=%s/hour=%02d/batch-p0-%04d.parquet",
+		svc, hour.Format("2006-01-02"), hour.Hour(), n)
+}
+
+func TestParquetFileListKeepsNewestAcrossServices(t *testing.T) {
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var keys []string
+	// zeta sorts last by key but only has old hours; alpha sorts first and
+	// holds the newest hour
+	for i := range 250 {
+		keys = append(keys, batchKey("zeta", base.Add(time.Duration(i%20)*time.Hour), i))
+	}
+	newest := batchKey("alpha", base.Add(23*time.Hour), 0)
+	keys = append(keys, newest)
+	qe := listedEngine(keys...)
+
+	win := timeWindow{From: base, To: base.Add(24 * time.Hour)}
+	files, _, dropped, err := qe.parquetFileList(200, &win, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 200 || dropped != 51 {
+		t.Fatalf("got %d files and %d dropped, want the 200 limit and the other 51 dropped", len(files), dropped)
+	}
+	if files[len(files)-1] != qe.objectPath(newest) {
+		t.Errorf("newest file = %q, want %q", files[len(files)-1], qe.objectPath(newest))
+	}
+	// What got dropped should be zeta's oldest hours
+	for _, f := range files {
+		if strings.Contains(f, "/hour=00/") {
+			t.Fatalf("kept %q from the oldest hour over newer files", f)
+		}
+	}
+}
+
+func TestParquetSourceReportsDroppedFiles(t *testing.T) {
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	keys := []string{batchKey("checkout", base, 0), batchKey("checkout", base.Add(time.Hour), 1), batchKey("checkout", base.Add(2*time.Hour), 2)}
+	tests := []struct {
+		maxFiles int
+		header   string
+	}{
+		{0, ""},
+		{3, ""},
+		{2, "1"},
+		{1, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.maxFiles), func(t *testing.T) {
+			qe := listedEngine(keys...)
+			qe.maxFiles = tt.maxFiles
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/metrics/error-rate", nil), rec)
+			src, err := qe.parquetSource(c, timeWindow{From: base, To: base.Add(3 * time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.Header().Get(droppedFilesHeader); got != tt.header {
+				t.Errorf("%s = %q, want %q", droppedFilesHeader, got, tt.header)
+			}
+			// The newest hour is always read
+			if !strings.Contains(src, "hour=12") {
+				t.Errorf("source %s left out the newest hour", src)
+			}
+		})
+	}
+}
+
+func TestParquetFileListServicePruning(t *testing.T) {
+	hour := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	legacy := "telemetry/parquet/date=2024-05-01/hour=13/batch-old.parquet"
+	qe := listedEngine(
+		batchKey("checkout", hour, 1),
+		batchKey("search", hour, 2),
+		batchKey("pay_ments", hour, 3),
+		legacy,
+	)
+	win := timeWindow{From: hour, To: hour.Add(time.Hour)}
+
+	tests := []struct {
+		service string
+		want    []string
+	}{
+		{"", []string{legacy, batchKey("checkout", hour, 1), batchKey("pay_ments", hour, 3), batchKey("search", hour, 2)}},
+		{"checkout", []string{legacy, batchKey("checkout", hour, 1)}},
+		// matched on the sanitized partition value, as writer-consumer writes it
+		{"pay ments", []string{legacy, batchKey("pay_ments", hour, 3)}},
+		{"missing", []string{legacy}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			files, _, _, err := qe.parquetFileList(0, &win, tt.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]string, len(tt.want))
+			for i, key := range tt.want {
+				want[i] = qe.objectPath(key)
+			}
+			if !slices.Equal(files, want) {
+				t.Errorf("files = %v\nwant %v", files, want)
+			}
+		})
+	}
+}
+
+func TestParsePartition(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    time.Time
+		wantErr bool
+	}{
+		{"telemetry/parquet/date=2024-05-01/hour=13/batch-x.parquet", time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), false},
+		{"telemetry/parquet/service=checkout/date=2024-05-01/hour=00/batch-x.parquet", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), false},
+		{"telemetry/parquet/batch-x.parquet", time.Time{}, true},
+		{"telemetry/parquet/date=2024-05-01/batch-x.parquet", time.Time{}, true},
+		{"telemetry/parquet/hour=13/batch-x.parquet", time.Time{}, true},
+		{"telemetry/parquet/date=2024-13-01/hour=13/batch-x.parquet", time.Time{}, true},
+		{"telemetry/parquet/date=2024-05-01/hour=25/batch-x.parquet", time.Time{}, true},
+		{"telemetry/parquet/date=yesterday/hour=1/batch-x.parquet", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := parsePartition(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parsePartition = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartitionInWindow(t *testing.T) {
+	hour := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     bool
+	}{
+		{"window inside hour", hour.Add(10 * time.Minute), hour.Add(20 * time.Minute), true},
+		{"window ends as hour starts", hour.Add(-time.Hour), hour, true},
+		{"window ends just before hour", hour.Add(-time.Hour), hour.Add(-time.Millisecond), false},
+		{"window starts in last millisecond", hour.Add(time.Hour - time.Millisecond), hour.Add(2 * time.Hour), true},
+		{"window starts as next hour starts", hour.Add(time.Hour), hour.Add(2 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partitionInWindow(hour, timeWindow{From: tt.from, To: tt.to}); got != tt.want {
+				t.Errorf("partitionInWindow = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParquetFileListSkipsUnpartitionedKeys(t *testing.T) {
+	hour := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	good := batchKey("checkout", hour, 1)
+	qe := listedEngine(
+		good,
+		"telemetry/parquet/batch-x.parquet",
+		"telemetry/parquet/date=2024-05-01/batch-y.parquet",
+		"telemetry/parquet/date=bad/hour=13/batch-z.parquet",
+	)
+	win := timeWindow{From: hour, To: hour.Add(time.Hour)}
+	files, _, _, err := qe.parquetFileList(0, &win, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(files, []string{qe.objectPath(good)}) {
+		t.Errorf("files = %v, want only %s", files, good)
+	}
+}
+
+// slowScan runs for minutes unless DuckDB interrupts it.
+const slowScan = `SELECT count(*) FROM range(1000000000000) t(i) WHERE i % 7 = 3`
+
+func openMemoryDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestQueryContextCancelStopsScan(t *testing.T) {
+	db := openMemoryDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	var n int64
+	err := db.QueryRowContext(ctx, slowScan).Scan(&n)
+	if err == nil {
+		t.Fatalf("scan finished with %d rows, want it cancelled", n)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("scan ran %s after cancel, want it interrupted", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) && !strings.Contains(err.Error(), "nterrupt") {
+		t.Errorf("err = %v, want a cancellation", err)
+	}
+
+	// The connection is still usable after the interrupt
+	if err := db.QueryRowContext(context.Background(), `SELECT 1`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("follow-up query: %d, %v", n, err)
+	}
+}
+
+func TestQueryTimeoutMiddlewareInterruptsHandler(t *testing.T) {
+	db := openMemoryDB(t)
+	e := echo.New()
+	var handlerErr error
+	h := queryTimeout(200 * time.Millisecond)(func(c echo.Context) error {
+		var n int64
+		handlerErr = db.QueryRowContext(c.Request().Context(), slowScan).Scan(&n)
+		return handlerErr
+	})
+
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/summary", nil), httptest.NewRecorder())
+	start := time.Now()
+	_ = h(c)
+	if handlerErr == nil {
+		t.Fatal("scan finished, want the statement timeout to interrupt it")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("handler ran %s with a 200ms timeout", elapsed)
+	}
+}
+
+func TestGlobToLike(t *testing.T) {
+	tests := []struct{ glob, want string }{
+		{"payments-*", "payments-%"},
+		{"*-worker", "%-worker"},
+		{"api-v?", "api-v_"},
+		{"100%_done", `100\%\_done`},
+		{`back\slash`, `back\\slash`},
+		{"exact", "exact"},
+	}
+	for _, tt := range tests {
+		if got := globToLike(tt.glob); got != tt.want {
+			t.Errorf("globToLike(%q) = %q, want %q", tt.glob, got, tt.want)
+		}
+	}
+}
+
+// TestServicePattern runs metricFilter's service_pattern predicate in DuckDB.
+func TestServicePattern(t *testing.T) {
+	tests := []struct {
+		pattern, service string
+		want             bool
+	}{
+		{"payments-*", "payments-service", true},
+		{"payments-*", "payments-", true},
+		{"payments-*", "payments", false},
+		{"payments-*", "Payments-cron", false},
+		{"*-worker", "payments-worker", true},
+		{"*-worker", "payments-workers", false},
+		{"api-v?", "api-v2", true},
+		{"api-v?", "api-v10", false},
+		{"pay_ments", "pay_ments", true},
+		{"pay_ments", "payXments", false},
+		{"100%", "1000", false},
+		{"100%", "100%", true},
+	}
+	db := openMemoryDB(t)
+	e := echo.New()
+	win := timeWindow{From: time.Unix(0, 0), To: time.Unix(1, 0)}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.service, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics/error-rate?service_pattern="+url.QueryEscape(tt.pattern), nil)
+			f := metricFilter(e.NewContext(req, httptest.NewRecorder()), win)
+			if len(f.clauses) != 2 {
+				t.Fatalf("clauses = %v, want the window and the pattern", f.clauses)
+			}
+			var got bool
+			query := `SELECT ` + strings.Replace(f.clauses[1], "service", "?", 1)
+			if err := db.QueryRow(query, tt.service, f.args[2]).Scan(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%q matches %q = %v, want %v", tt.pattern, tt.service, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnomalyThreshold(t *testing.T) {
+	tests := []struct {
+		name                            string
+		mean, stddev, multiplier, sigma float64
+		want                            float64
+	}{
+		{"multiplier", 2, 1, 2, 0, 4},
+		// sigma replaces the multiplier even when it gives the higher threshold
+		{"sigma above multiplier", 2, 3, 2, 2, 8},
+		{"sigma below multiplier", 2, 0.5, 2, 2, 3},
+		{"no baseline", 0, 0, 2, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := anomalyThreshold(tt.mean, tt.stddev, tt.multiplier, tt.sigma); got != tt.want {
+				t.Errorf("anomalyThreshold = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuckDBSetupURLStyle(t *testing.T) {
+	tests := []struct {
+		lookup string
+		want   string
+	}{
+		{"", `SET s3_url_style='path';`},
+		{"path", `SET s3_url_style='path';`},
+		{"dns", `SET s3_url_style='vhost';`},
+		{"DNS", `SET s3_url_style='vhost';`},
+		{"auto", `SET s3_url_style='path';`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lookup, func(t *testing.T) {
+			setup := duckdbSetup(Config{MinIOLookup: tt.lookup})
+			if !slices.Contains(setup, tt.want) {
+				t.Errorf("setup %q does not contain %s", setup, tt.want)
+			}
+		})
+	}
+}
+
+// writeServiceFile writes a one-row parquet file for service at dir/rel.
+func writeServiceFile(t *testing.T, db *sql.DB, dir, rel, service string) {
+	t.Helper()
+	path := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`COPY (SELECT ` + sqlString(service) + ` AS service) TO ` + sqlString(path) + ` (FORMAT parquet)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGlobFilesKeepsServiceColumn(t *testing.T) {
+	db := openMemoryDB(t)
+	dir := t.TempDir()
+	// api.gw is not path-safe, so its partition is service=api_gw
+	writeServiceFile(t, db, dir, "service=api_gw/date=2024-05-01/hour=13/batch-a.parquet", "api.gw")
+	writeServiceFile(t, db, dir, "service=api_gw/date=2024-04-01/hour=13/batch-old.parquet", "api.gw")
+	writeServiceFile(t, db, dir, "service=search/date=2024-05-01/hour=13/batch-b.parquet", "search")
+	writeServiceFile(t, db, dir, "date=2024-05-02/hour=12/batch-legacy.parquet", "api.gw")
+	qe := &QueryEngine{db: db}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		service   string
+		days      int // window length from day
+		wantFiles int
+		wantRows  int // rows whose service column reads api.gw
+	}{
+		{"all services", "", 0, 2, 1},
+		{"unsafe service", "api.gw", 0, 1, 1},
+		{"other service", "search", 0, 1, 0},
+		{"missing service", "missing", 0, 0, 0},
+		// files from before the service partition are kept for any service
+		{"legacy files", "search", 1, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			win := timeWindow{From: day, To: day.AddDate(0, 0, tt.days)}
+			files, err := qe.globFiles(context.Background(), dir, win, tt.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != tt.wantFiles {
+				t.Fatalf("globbed %v, want %d files", files, tt.wantFiles)
+			}
+			if len(files) == 0 {
+				return
+			}
+			var n int
+			err = db.QueryRow(`SELECT COUNT(*) FROM ` + readParquetSource(files) + ` WHERE service = 'api.gw'`).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.wantRows {
+				t.Errorf("%d rows read back as api.gw, want %d", n, tt.wantRows)
+			}
+		})
+	}
+}
+
+// sampledEngine is a listedEngine over one local file of three checkout
+// requests, two of them kept at a 50% sampling rate.
+func sampledEngine(t *testing.T) *QueryEngine {
+	t.Helper()
+	db := openMemoryDB(t)
+	dir := t.TempDir()
+	hour := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	key := batchKey("checkout", hour, 1)
+	path := filepath.Join(dir, "telemetry", key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec(`COPY (
+		SELECT TIMESTAMP '2024-05-01 13:10:00' + to_minutes(i) AS timestamp,
+		       TIMESTAMP '2024-05-01 13:30:00' AS ingested_at,
+		       'checkout' AS service, '/pay' AS endpoint, 'POST' AS method, 'c1' AS customer_id,
+		       'prod' AS environment, 'req-' || i AS request_id, 'trace-' || i AS trace_id,
+		       status_code, latency_ms, sampling_rate,
+		       CASE WHEN status_code >= 500 THEN 'upstream timeout' END AS error
+		FROM (VALUES (0, 200, 100, 0.5), (1, 500, 300, 0.5), (2, 200, 100, 1.0)) AS v(i, status_code, latency_ms, sampling_rate)
+	) TO ` + sqlString(path) + ` (FORMAT parquet)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qe := listedEngine(key)
+	qe.db, qe.minioHTTP = db, dir
+	return qe
+}
+
+// sumField adds up every number under field anywhere in the decoded JSON v.
+func sumField(v any, field string) float64 {
+	var sum float64
+	var numbers func(v any) float64
+	numbers = func(v any) float64 {
+		switch v := v.(type) {
+		case float64:
+			return v
+		case []any:
+			var n float64
+			for _, e := range v {
+				n += numbers(e)
+			}
+			return n
+		}
+		return 0
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if k == field {
+				sum += numbers(e)
+			} else {
+				sum += sumField(e, field)
+			}
+		}
+	case []any:
+		for _, e := range v {
+			sum += sumField(e, field)
+		}
+	}
+	return sum
+}
+
+func TestEstimateScalesRequestCounts(t *testing.T) {
+	qe := sampledEngine(t)
+	tests := []struct {
+		path    string
+		handler func(echo.Context) error
+		query   string
+		field   string
+		plain   float64
+		want    float64 // with ?estimate=true
+	}{
+		{"/metrics/throughput", qe.handleThroughput, "", "count", 3, 5},
+		{"/metrics/latency-histogram", qe.handleLatencyHistogram, "", "counts", 3, 5},
+		{"/metrics/latency-heatmap", qe.handleLatencyHeatmap, "", "counts", 3, 5},
+		{"/metrics/latency-contribution", qe.handleLatencyContribution, "", "requests", 3, 5},
+		{"/metrics/latency-contribution", qe.handleLatencyContribution, "", "total_latency_ms", 500, 900},
+		{"/metrics/service-error-attribution", qe.handleServiceErrorAttribution, "&service=checkout", "requests", 3, 5},
+		{"/metrics/service-error-attribution", qe.handleServiceErrorAttribution, "&service=checkout", "errors", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+"/"+tt.field, func(t *testing.T) {
+			for _, estimate := range []bool{false, true} {
+				target := tt.path + "?from=2024-05-01T13:00:00Z&to=2024-05-01T14:00:00Z" + tt.query
+				want := tt.plain
+				if estimate {
+					target += "&estimate=true"
+					want = tt.want
+				}
+				rec := httptest.NewRecorder()
+				if err := tt.handler(echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)); err != nil {
+					t.Fatal(err)
+				}
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body.String())
+				}
+				var body any
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("%s: %v in %s", target, err, rec.Body.String())
+				}
+				if got := sumField(body, tt.field); got != want {
+					t.Errorf("%s: %s sums to %v, want %v", target, tt.field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCohortComparison(t *testing.T) {
+	qe := sampledEngine(t)
+	rec := httptest.NewRecorder()
+	target := "/metrics/cohort-comparison?from=2024-05-01T13:00:00Z&to=2024-05-01T14:00:00Z&a_customers=c1&a_name=paying&b_prefixes=trial-"
+	if err := qe.handleCohortComparison(echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var rows []struct {
+		Cohort   string `json:"cohort"`
+		Requests int64  `json:"requests"`
+		Errors   int64  `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Cohort != "paying" || rows[0].Requests != 3 || rows[0].Errors != 1 ||
+		rows[1].Cohort != "b" || rows[1].Requests != 0 {
+		t.Errorf("got %+v, want paying with 3 requests and 1 error, then an empty b", rows)
+	}
+}
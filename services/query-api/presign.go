@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// maxPresignExpiry is the longest lifetime S3 SigV4 allows a presigned URL.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// bucketLookup maps MINIO_BUCKET_LOOKUP to minio-go's addressing style. MinIO
+// serves buckets path-style (http://host:9000/bucket/key) unless it was set up
+// with MINIO_DOMAIN, so path is the default; dns gives virtual-host URLs
+// (http://bucket.host/key) and auto lets minio-go pick per endpoint.
+func bucketLookup(v string) (minio.BucketLookupType, error) {
+	switch strings.ToLower(v) {
+	case "", "path":
+		return minio.BucketLookupPath, nil
+	case "dns":
+		return minio.BucketLookupDNS, nil
+	case "auto":
+		return minio.BucketLookupAuto, nil
+	}
+	return 0, fmt.Errorf("MINIO_BUCKET_LOOKUP must be \"path\", \"dns\" or \"auto\", got %q", v)
+}
+
+// s3URLStyle maps MINIO_BUCKET_LOOKUP to DuckDB's s3_url_style, so s3 reads
+// address buckets the same way as the minio-go client. DuckDB has no auto
+// style; minio-go's auto only picks virtual hosts for AWS and a few other
+// clouds, so it maps to path like the default.
+func s3URLStyle(v string) string {
+	if strings.EqualFold(v, "dns") {
+		return "vhost"
+	}
+	return "path"
+}
+
+// presignedURL returns a GET URL for key that is valid for expiry without
+// credentials. The URL is signed for the client's endpoint and addressing
+// style, so the host must be the one callers reach MinIO on.
+func (qe *QueryEngine) presignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if expiry < time.Second || expiry > maxPresignExpiry {
+		return "", fmt.Errorf("presign expiry must be between 1s and %s, got %s", maxPresignExpiry, expiry)
+	}
+	u, err := qe.minioClient.PresignedGetObject(ctx, qe.bucket, key, expiry, url.Values{})
+	if err != nil {
+		return "", fmt.Errorf("presign %s: %w", key, err)
+	}
+	return u.String(), nil
+}
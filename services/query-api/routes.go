@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// route is one GET endpoint of the query API. main registers every route in
+// qe.routes(), and /endpoints serves the same list, so a handler only shows
+// up in discovery once it is routed and vice versa. Params must be kept in
+// line with what the handler reads.
+type route struct {
+	Path        string       `json:"path"`
+	Description string       `json:"description"`
+	Params      []routeParam `json:"params"`
+
+	handler echo.HandlerFunc
+}
+
+type routeParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Params shared by many handlers, named after the helper that reads them.
+var (
+	windowParams = []routeParam{
+		{"from", "start of the window, RFC3339 (default an hour before to)"},
+		{"to", "end of the window, RFC3339 (default now)"},
+	}
+	sourceParams = []routeParam{
+		{"dedup", "true to count each request_id once"},
+	}
+	filterParams = []routeParam{
+		{"service", "exact service name"},
+		{"service_pattern", "service glob, * and ? wildcards"},
+		{"environment", "exact environment"},
+		{"endpoint", "exact endpoint"},
+		{"method", "HTTP method"},
+	}
+	estimateParams = []routeParam{
+		{"estimate", "true to scale counts by 1/sampling_rate"},
+	}
+	intervalParams = []routeParam{
+		{"interval", "bucket width, Go duration in whole seconds (e.g. 5m)"},
+		{"tz", "IANA time zone buckets align to (default UTC)"},
+	}
+	pageParams = []routeParam{
+		{"limit", "page size"},
+		{"offset", "rows to skip"},
+	}
+	bucketParams = []routeParam{
+		{"buckets", "comma-separated latency bucket bounds in ms"},
+	}
+	outputParams = []routeParam{
+		{"format", "csv for CSV output (or Accept: text/csv)"},
+		{"case", "key case for the output, camel or pascal"},
+	}
+)
+
+// params concatenates param groups and handler-specific params.
+func params(groups ...[]routeParam) []routeParam {
+	var out []routeParam
+	for _, g := range groups {
+		out = append(out, g...)
+	}
+	return out
+}
+
+// metricParams are the params of a handler that reads the window and the
+// common filters and responds through respond.
+func metricParams(extra ...[]routeParam) []routeParam {
+	return params(append([][]routeParam{windowParams, sourceParams, filterParams}, append(extra, outputParams)...)...)
+}
+
+func (qe *QueryEngine) routes() []route {
+	return []route{
+		{Path: "/schema", handler: qe.handleSchema,
+			Description: "columns of the newest parquet file and its schema version"},
+		{Path: "/partitions", handler: qe.handlePartitions,
+			Description: "hour partitions holding data, with file counts and sizes",
+			Params:      []routeParam{{"limit", "keep only the newest N hours"}}},
+		{Path: "/export", handler: qe.handleExport,
+			Description: "presigned download URLs for the parquet files overlapping the window",
+			Params:      windowParams},
+
+		{Path: "/metrics/error-rate", handler: qe.handleErrorRate,
+			Description: "5xx error rate per service",
+			Params:      metricParams(estimateParams)},
+		{Path: "/metrics/p95-latency", handler: qe.handleP95Latency,
+			Description: "p95 latency per service",
+			Params:      metricParams()},
+		{Path: "/metrics/latency-percentiles", handler: qe.handleLatencyPercentiles,
+			Description: "several latency percentiles per service",
+			Params:      metricParams([]routeParam{{"p", "percentile, repeatable (default 50, 95, 99)"}})},
+		{Path: "/metrics/latency-by-endpoint", handler: qe.handleLatencyByEndpoint,
+			Description: "p50/p95/p99 latency and request count per service and endpoint, slowest first",
+			Params:      metricParams(estimateParams, pageParams)},
+		{Path: "/metrics/top-impacted-customers", handler: qe.handleTopImpactedCustomers,
+			Description: "customers with the most errors",
+			Params:      metricParams(estimateParams, pageParams)},
+		{Path: "/metrics/customer-availability", handler: qe.handleCustomerAvailability,
+			Description: "availability (non-5xx / total) per customer",
+			Params: metricParams(estimateParams,
+				[]routeParam{{"weighting", "request (default) or time, to average per-minute availability"}})},
+		{Path: "/metrics/summary", handler: qe.handleSummary,
+			Description: "row counts and freshness per environment",
+			Params:      metricParams()},
+		{Path: "/metrics/latency-contribution", handler: qe.handleLatencyContribution,
+			Description: "share of total latency per endpoint",
+			Params:      metricParams(estimateParams, []routeParam{{"by_service", "true to break down per service"}})},
+		{Path: "/metrics/service-error-attribution", handler: qe.handleServiceErrorAttribution,
+			Description: "which customers a service's errors come from",
+			// filterParams[1:] is every filter but the optional service
+			Params: params(windowParams, sourceParams,
+				[]routeParam{{"service", "service to attribute (required)"}}, filterParams[1:], estimateParams, outputParams)},
+		{Path: "/metrics/throughput", handler: qe.handleThroughput,
+			Description: "requests per interval bucket",
+			Params: metricParams(estimateParams, intervalParams,
+				[]routeParam{{"by_service", "true to break down per service"}})},
+		{Path: "/metrics/latency-histogram", handler: qe.handleLatencyHistogram,
+			Description: "request counts per latency bucket",
+			Params: metricParams(estimateParams, bucketParams,
+				[]routeParam{{"by_service", "true to break down per service"}})},
+		{Path: "/metrics/latency-heatmap", handler: qe.handleLatencyHeatmap,
+			Description: "request counts per time bucket and latency bucket",
+			Params:      metricParams(estimateParams, intervalParams, bucketParams)},
+		{Path: "/metrics/slo", handler: qe.handleSLO,
+			Description: "availability against a target and the error budget left",
+			Params: metricParams(estimateParams,
+				[]routeParam{{"target", "availability target in percent (default 99.9)"}})},
+		{Path: "/metrics/apdex", handler: qe.handleApdex,
+			Description: "apdex score per service",
+			Params: metricParams(estimateParams,
+				[]routeParam{{"threshold", "T in ms (default APDEX_THRESHOLD_MS)"}})},
+		{Path: "/metrics/error-breakdown", handler: qe.handleErrorBreakdown,
+			Description: "events per distinct error message",
+			Params: metricParams(estimateParams, pageParams,
+				[]routeParam{{"by_service", "true to count per service"}})},
+		{Path: "/metrics/status-distribution", handler: qe.handleStatusDistribution,
+			Description: "requests per service by status class",
+			Params:      metricParams(estimateParams)},
+		{Path: "/metrics/requests-by-method", handler: qe.handleRequestsByMethod,
+			Description: "requests per service by HTTP method",
+			Params:      metricParams(estimateParams)},
+		{Path: "/metrics/cohort-comparison", handler: qe.handleCohortComparison,
+			Description: "volume, error rate and p95 latency of two customer cohorts",
+			Params: metricParams(estimateParams, []routeParam{
+				{"a_customers", "comma-separated customer IDs in cohort a"},
+				{"a_prefixes", "comma-separated customer ID prefixes in cohort a"},
+				{"a_name", "label for cohort a (default a)"},
+				{"b_customers", "comma-separated customer IDs in cohort b"},
+				{"b_prefixes", "comma-separated customer ID prefixes in cohort b"},
+				{"b_name", "label for cohort b (default b)"},
+			})},
+		{Path: "/metrics/anomaly", handler: qe.handleAnomaly,
+			Description: "services whose error rate is well above their baseline",
+			Params: metricParams(estimateParams, []routeParam{
+				{"interval", "baseline bucket width (default the window length)"},
+				{"baseline", "baseline length before the window (default 24h)"},
+				{"multiplier", "flag above mean * multiplier (default 2)"},
+				{"sigma", "flag above mean + sigma * stddev instead of using multiplier"},
+				{"min_requests", "ignore services with fewer requests (default 20)"},
+			})},
+		{Path: "/metrics/availability-timeseries", handler: qe.handleAvailabilityTimeseries,
+			Description: "availability per interval bucket for a customer or service",
+			Params: metricParams(estimateParams, intervalParams,
+				[]routeParam{{"customer_id", "customer to chart (this or service is required)"}})},
+		{Path: "/metrics/customer/:customer_id/error-rate-timeseries", handler: qe.handleCustomerErrorRateTimeseries,
+			Description: "one customer's error rate per interval bucket",
+			Params:      metricParams(estimateParams, intervalParams)},
+	}
+}
+
+// handleEndpoints lists the routes in rs for client discovery.
+func handleEndpoints(rs []route) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, rs)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// paramRecorder notes every query param a handler reads.
+type paramRecorder struct {
+	echo.Context
+	read map[string]bool
+}
+
+func (c *paramRecorder) QueryParam(name string) string {
+	c.read[name] = true
+	return c.Context.QueryParam(name)
+}
+
+func TestRoutesDocumentParamsRead(t *testing.T) {
+	qe := sampledEngine(t)
+	// Params a route needs to get past validation to its query
+	required := map[string]string{
+		"/metrics/service-error-attribution": "&service=checkout",
+		"/metrics/availability-timeseries":   "&service=checkout",
+		"/metrics/cohort-comparison":         "&a_customers=c1&b_customers=c2",
+	}
+	for _, r := range qe.routes() {
+		if r.Path == "/export" {
+			continue // presigns against a real MinIO client
+		}
+		t.Run(r.Path, func(t *testing.T) {
+			target := strings.Replace(r.Path, ":customer_id", "c1", 1) +
+				"?from=2024-05-01T13:00:00Z&to=2024-05-01T14:00:00Z" + required[r.Path]
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+			if strings.Contains(r.Path, ":customer_id") {
+				c.SetParamNames("customer_id")
+				c.SetParamValues("c1")
+			}
+			pr := &paramRecorder{Context: c, read: map[string]bool{}}
+			if err := r.handler(pr); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var documented []string
+			for _, p := range r.Params {
+				documented = append(documented, p.Name)
+			}
+			for name := range pr.read {
+				if !slices.Contains(documented, name) {
+					t.Errorf("handler reads %q, which the route does not document", name)
+				}
+			}
+			// Every handler that weights counts reads estimate unconditionally
+			if slices.Contains(documented, "estimate") != pr.read["estimate"] {
+				t.Errorf("estimate documented %v, read %v", slices.Contains(documented, "estimate"), pr.read["estimate"])
+			}
+		})
+	}
+}
+
+func TestRoutesDescribeServiceErrorAttribution(t *testing.T) {
+	for _, r := range (&QueryEngine{}).routes() {
+		if r.Path == "/metrics/service-error-attribution" && strings.Contains(r.Description, "endpoint") {
+			t.Errorf("description %q mentions endpoints, but the handler groups by customer only", r.Description)
+		}
+	}
+}
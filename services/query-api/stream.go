@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// truncatedTrailer reports whether streamRows stopped at the row cap. CSV has
+// nowhere in-band to say so, so it is sent as an HTTP trailer: the rows are
+// already on the wire by the time the cap is hit.
+const truncatedTrailer = "X-Result-Truncated"
+
+// streamEnd is the last element of a streamed JSON array that was cut short,
+// either at the row cap or by an error after rows were sent. Rows never carry
+// a truncated key, so clients can check the final element for it. A complete
+// result has no such element.
+type streamEnd struct {
+	Truncated bool   `json:"truncated"`
+	Reason    string `json:"reason"` // "max_rows" or "error"
+	Rows      int    `json:"rows"`   // elements before this one
+	Error     string `json:"error,omitempty"`
+}
+
+// streamFlushEvery is how many rows are written between flushes.
+const streamFlushEvery = 500
+
+// streamRows writes rows to the response as a JSON array, one element at a
+// time, so a large result is never held in memory as a slice. At most maxRows
+// elements are written (0 means no cap). scan reads the current row into a
+// value for the response; elements go through the echo JSON serializer, so
+// ?case= still applies. With CSV requested (see wantsCSV) the rows are
+// written as CSV records instead, under a header taken from the first row.
+//
+// A scan or iteration error before the first element produces the usual 500
+// JSON error. After that the status is already sent, so the array is closed
+// with a streamEnd carrying the error, as it is when maxRows is reached.
+func streamRows(c echo.Context, rows *sql.Rows, maxRows int, scan func() (any, error)) error {
+	res := c.Response()
+	asCSV := wantsCSV(c)
+	if asCSV {
+		res.Header().Set(echo.HeaderContentType, mimeTextCSV+"; charset=utf-8")
+	} else {
+		res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	}
+	res.Header().Set("Trailer", truncatedTrailer)
+	cw := csv.NewWriter(res)
+
+	// end closes the JSON array, after a streamEnd element if there is one
+	end := func(marker *streamEnd) {
+		if marker != nil {
+			_, _ = res.Write([]byte(","))
+			_ = c.Echo().JSONSerializer.Serialize(c, marker, "")
+		}
+		_, _ = res.Write([]byte("]\n"))
+	}
+	fail := func(n int, err error) error {
+		if n == 0 {
+			res.Header().Del("Trailer")
+			return c.JSON(http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		}
+		log.Printf("%s: result stream aborted after %d rows: %v", c.Path(), n, err)
+		if asCSV {
+			cw.Flush()
+		} else {
+			end(&streamEnd{Truncated: true, Reason: "error", Rows: n, Error: err.Error()})
+		}
+		return nil
+	}
+
+	n := 0
+	truncated := false
+	for rows.Next() {
+		if maxRows > 0 && n == maxRows {
+			truncated = true
+			break
+		}
+		v, err := scan()
+		if err != nil {
+			return fail(n, err)
+		}
+
+		if asCSV {
+			if err := writeCSVRow(c, cw, v, n == 0); err != nil {
+				return fail(n, err)
+			}
+			n++
+			if n%streamFlushEvery == 0 {
+				cw.Flush()
+				res.Flush()
+			}
+			continue
+		}
+
+		sep := ","
+		if n == 0 {
+			res.WriteHeader(http.StatusOK)
+			sep = "["
+		}
+		if _, err := res.Write([]byte(sep)); err != nil {
+			return nil // client went away
+		}
+		if err := c.Echo().JSONSerializer.Serialize(c, v, ""); err != nil {
+			return nil
+		}
+		n++
+		if n%streamFlushEvery == 0 {
+			res.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil && !truncated {
+		return fail(n, err)
+	}
+
+	if asCSV {
+		if n == 0 {
+			res.WriteHeader(http.StatusOK)
+		}
+		cw.Flush()
+		res.Header().Set(truncatedTrailer, strconv.FormatBool(truncated))
+		return nil
+	}
+
+	if n == 0 {
+		res.WriteHeader(http.StatusOK)
+		_, _ = res.Write([]byte("["))
+	}
+	if truncated {
+		end(&streamEnd{Truncated: true, Reason: "max_rows", Rows: n})
+	} else {
+		end(nil)
+	}
+	res.Header().Set(truncatedTrailer, strconv.FormatBool(truncated))
+	return nil
+}
+
+// writeCSVRow writes one streamed row, preceded by the header row (and the
+// response status) when first is set.
+func writeCSVRow(c echo.Context, cw *csv.Writer, v any, first bool) error {
+	header, cells, err := csvRecord(reflect.ValueOf(v), nil)
+	if err != nil {
+		return err
+	}
+	if first {
+		if convert := keyConverter(c.QueryParam("case")); convert != nil {
+			for i, h := range header {
+				header[i] = convert(h)
+			}
+		}
+		c.Response().WriteHeader(http.StatusOK)
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+	}
+	return cw.Write(cells)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestStreamRows(t *testing.T) {
+	type row struct {
+		I int64 `json:"i"`
+	}
+	tests := []struct {
+		name    string
+		maxRows int
+		failAt  int // scan error on this row; -1 for none
+		status  int
+		want    []any
+	}{
+		{"complete", 0, -1, http.StatusOK, []any{
+			map[string]any{"i": 0.0}, map[string]any{"i": 1.0}, map[string]any{"i": 2.0},
+		}},
+		{"at the cap", 3, -1, http.StatusOK, []any{
+			map[string]any{"i": 0.0}, map[string]any{"i": 1.0}, map[string]any{"i": 2.0},
+		}},
+		{"truncated", 2, -1, http.StatusOK, []any{
+			map[string]any{"i": 0.0}, map[string]any{"i": 1.0},
+			map[string]any{"truncated": true, "reason": "max_rows", "rows": 2.0},
+		}},
+		{"error mid-stream", 0, 1, http.StatusOK, []any{
+			map[string]any{"i": 0.0},
+			map[string]any{"truncated": true, "reason": "error", "rows": 1.0, "error": "scan failed"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openMemoryDB(t)
+			rows, err := db.Query(`SELECT i FROM range(3) t(i) ORDER BY i`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			e := echo.New()
+			e.JSONSerializer = caseSerializer{}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/metrics/timeseries", nil), rec)
+			n := 0
+			err = streamRows(c, rows, tt.maxRows, func() (any, error) {
+				var r row
+				if n == tt.failAt {
+					return nil, errors.New("scan failed")
+				}
+				n++
+				return r, rows.Scan(&r.I)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			var got []any
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("response is not a JSON array: %v\n%s", err, rec.Body)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamRowsErrorBeforeFirstRow(t *testing.T) {
+	db := openMemoryDB(t)
+	rows, err := db.Query(`SELECT 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/metrics/timeseries", nil), rec)
+	err = streamRows(c, rows, 0, func() (any, error) { return nil, errors.New("scan failed") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Trailer") != "" {
+		t.Errorf("status %d, Trailer %q; want a plain 500", rec.Code, rec.Header().Get("Trailer"))
+	}
+}
+
+// TestThroughputStreamsTruncationMarker runs a timeseries handler over a local
+// parquet file and checks the response stays valid JSON when capped.
+func TestThroughputStreamsTruncationMarker(t *testing.T) {
+	dir := t.TempDir()
+	hour := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	key := batchKey("checkout", hour, 1)
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, "telemetry", key)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openMemoryDB(t)
+	_, err := db.Exec(`COPY (
+		SELECT TIMESTAMP '2024-05-01 13:00:00' + INTERVAL (i) MINUTE AS timestamp, 'checkout' AS service
+		FROM range(5) t(i)
+	) TO ` + sqlString(filepath.Join(dir, "telemetry", key)) + ` (FORMAT parquet)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qe := listedEngine(key)
+	qe.db, qe.minioHTTP = db, dir
+
+	for _, tt := range []struct {
+		maxRows   int
+		wantRows  int
+		truncated bool
+	}{
+		{0, 5, false},
+		{3, 3, true},
+	} {
+		qe.maxRows = tt.maxRows
+		e := echo.New()
+		e.JSONSerializer = caseSerializer{}
+		req := httptest.NewRequest(http.MethodGet, "/metrics/throughput?from=2024-05-01T13:00:00Z&to=2024-05-01T14:00:00Z", nil)
+		rec := httptest.NewRecorder()
+		if err := qe.handleThroughput(e.NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("max_rows=%d: response is not a JSON array: %v\n%s", tt.maxRows, err, rec.Body)
+		}
+		rows := got
+		if tt.truncated {
+			last := got[len(got)-1]
+			if last["truncated"] != true || last["reason"] != "max_rows" {
+				t.Errorf("max_rows=%d: last element %v, want a truncation marker", tt.maxRows, last)
+			}
+			rows = got[:len(got)-1]
+		}
+		if len(rows) != tt.wantRows {
+			t.Errorf("max_rows=%d: %d rows, want %d", tt.maxRows, len(rows), tt.wantRows)
+		}
+		for _, r := range rows {
+			if _, ok := r["truncated"]; ok {
+				t.Errorf("max_rows=%d: row %v has a truncated key", tt.maxRows, r)
+			}
+		}
+	}
+}
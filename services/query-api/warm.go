@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// warm runs a cheap count over the last window of data every interval until
+// ctx ends, so DuckDB's object and HTTP metadata caches already hold the
+// recent parquet footers when a dashboard comes back after an idle period.
+func (qe *QueryEngine) warm(ctx context.Context, interval, window time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := qe.warmOnce(ctx, interval, window); err != nil && ctx.Err() == nil {
+			log.Printf("cache warm failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (qe *QueryEngine) warmOnce(ctx context.Context, interval, window time.Duration) error {
+	// A pass that outlasts the interval would only pile up behind itself
+	ctx, cancel := context.WithTimeout(ctx, interval)
+	defer cancel()
+
+	now := time.Now().UTC()
+	src, err := qe.tableSource(ctx, timeWindow{From: now.Add(-window), To: now})
+	if err != nil || src == "" {
+		return err
+	}
+	var n int64
+	return qe.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+src).Scan(&n)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// compactOptions controls the compaction loop started by `writer-consumer compact`.
+type compactOptions struct {
+	Interval     time.Duration // time between passes
+	Grace        time.Duration // how long after an hour ends before it is compacted
+	MaxFileBytes int64         // files at or above this size are left alone
+	MinFiles     int           // fewer small files than this isn't worth a rewrite
+}
+
+// compactStore is the part of *minio.Client the compactor uses, so a pass
+// can run against a fake.
+type compactStore interface {
+	objectStore
+	ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+	GetObjectTagging(ctx context.Context, bucketName, objectName string, opts minio.GetObjectTaggingOptions) (*tags.Tags, error)
+	FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	RemoveObjects(ctx context.Context, bucketName string, objectsCh <-chan minio.ObjectInfo, opts minio.RemoveObjectsOptions) <-chan minio.RemoveObjectError
+}
+
+// compactor merges the small files the consumer writes into one object per
+// closed hour partition, so query-api reads a handful of files instead of
+// hundreds. Run it as a single separate process: two compactors working on
+// the same partition would each merge and delete the same sources.
+type compactor struct {
+	minio compactStore
+	cfg   Config
+	opts  compactOptions
+}
+
+// run compacts every closed partition, then repeats every Interval until ctx ends.
+func (c *compactor) run(ctx context.Context) {
+	for {
+		if err := c.pass(ctx); err != nil {
+			log.Printf("compaction pass error: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.opts.Interval):
+		}
+	}
+}
+
+func (c *compactor) pass(ctx context.Context) error {
+	partitions := map[string][]minio.ObjectInfo{}
+	opts := minio.ListObjectsOptions{Prefix: "telemetry/parquet/", Recursive: true}
+	for obj := range c.minio.ListObjects(ctx, c.cfg.MinIOBucket, opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if !strings.HasSuffix(obj.Key, ".parquet") || obj.Size >= c.opts.MaxFileBytes {
+			continue
+		}
+		dir := path.Dir(obj.Key)
+		partitions[dir] = append(partitions[dir], obj)
+	}
+
+	dirs := make([]string, 0, len(partitions))
+	for dir := range partitions {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	cutoff := time.Now().UTC().Add(-c.opts.Grace)
+	for _, dir := range dirs {
+		start, ok := partitionHour(dir)
+		if !ok || start.Add(time.Hour).After(cutoff) {
+			// unpartitioned, or the consumer may still be writing to it
+			continue
+		}
+		if err := c.compactPartition(ctx, dir, partitions[dir]); err != nil {
+			log.Printf("compaction of %s failed: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// compactPartition merges one partition's small files. Files carry the
+// retention tag of the environment they came from, so each tag value is merged
+// separately and the merged object keeps it.
+func (c *compactor) compactPartition(ctx context.Context, dir string, objs []minio.ObjectInfo) error {
+	byTag := map[string][]string{}
+	for _, obj := range objs {
+		t, err := c.minio.GetObjectTagging(ctx, c.cfg.MinIOBucket, obj.Key, minio.GetObjectTaggingOptions{})
+		if err != nil {
+			return fmt.Errorf("get tags for %s: %w", obj.Key, err)
+		}
+		tag := t.ToMap()[retentionTag]
+		byTag[tag] = append(byTag[tag], obj.Key)
+	}
+
+	for tag, keys := range byTag {
+		if len(keys) < c.opts.MinFiles {
+			continue
+		}
+		sort.Strings(keys)
+		if err := c.merge(ctx, dir, tag, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge rewrites keys into a single object under dir. The merged object is
+// uploaded before any source is deleted, so a reader never sees the events
+// missing; until the deletes land it may briefly see them twice.
+func (c *compactor) merge(ctx context.Context, dir, tag string, keys []string) error {
+	tmpDir, err := os.MkdirTemp("", "tigerscope-compact-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	merged := filepath.Join(tmpDir, "merged.parquet")
+	rows, err := c.mergeFiles(ctx, tmpDir, merged, keys)
+	if err != nil {
+		return err
+	}
+
+	key := dir + "/compacted-" + randomHex(8) + ".parquet"
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	if tag != "" {
+		opts.UserTags = map[string]string{retentionTag: tag}
+	}
+	info, err := c.minio.FPutObject(ctx, c.cfg.MinIOBucket, key, merged, opts)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", key, err)
+	}
+	if err := c.updateManifests(ctx, dir, key, keys); err != nil {
+		// Sources stay in place, so the manifests still describe real files
+		return fmt.Errorf("update manifests in %s: %w", dir, err)
+	}
+
+	objects := make(chan minio.ObjectInfo, len(keys))
+	for _, k := range keys {
+		objects <- minio.ObjectInfo{Key: k}
+	}
+	close(objects)
+	for rerr := range c.minio.RemoveObjects(ctx, c.cfg.MinIOBucket, objects, minio.RemoveObjectsOptions{}) {
+		// The merged object is already in place; leftovers are duplicates a later pass will fold in
+		log.Printf("compaction: failed to delete %s: %v", rerr.ObjectName, rerr.Err)
+	}
+
+	log.Printf("compacted %d files (%d rows) -> s3://%s/%s (%d bytes)", len(keys), rows, c.cfg.MinIOBucket, key, info.Size)
+	return nil
+}
+
+// updateManifests records merged in a manifest of the compactor's own and
+// strips the replaced sources from every writer manifest in dir. Writers read
+// their stored manifest back before adding to it (see recordUpload), so a late
+// upload into the hour keeps the sources out.
+func (c *compactor) updateManifests(ctx context.Context, dir, merged string, sources []string) error {
+	replaced := make(map[string]bool, len(sources))
+	for _, k := range sources {
+		replaced[k] = true
+	}
+
+	id := "compactor-" + randomHex(4)
+	if err := c.putManifest(ctx, dir+"/_manifest-"+id+".json", partitionManifest{Writer: id, Updated: time.Now().UTC(), Files: []string{merged}}); err != nil {
+		return err
+	}
+
+	opts := minio.ListObjectsOptions{Prefix: dir + "/_manifest-"}
+	for obj := range c.minio.ListObjects(ctx, c.cfg.MinIOBucket, opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		m, err := readManifest(ctx, c.minio, c.cfg.MinIOBucket, obj.Key)
+		if err != nil {
+			return err
+		}
+
+		kept := m.Files[:0]
+		for _, f := range m.Files {
+			if !replaced[f] {
+				kept = append(kept, f)
+			}
+		}
+		if len(kept) == len(m.Files) {
+			continue
+		}
+		if len(kept) == 0 {
+			if err := c.minio.RemoveObject(ctx, c.cfg.MinIOBucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+				return err
+			}
+			continue
+		}
+		m.Files = kept
+		m.Updated = time.Now().UTC()
+		if err := c.putManifest(ctx, obj.Key, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compactor) putManifest(ctx context.Context, key string, m partitionManifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = c.minio.PutObject(ctx, c.cfg.MinIOBucket, key, bytes.NewReader(b), int64(len(b)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+// mergeFiles downloads each source and streams its rows into out.
+func (c *compactor) mergeFiles(ctx context.Context, tmpDir, out string, keys []string) (int64, error) {
+	fw, err := local.NewLocalFileWriter(out)
+	if err != nil {
+		return 0, err
+	}
+	defer fw.Close()
+
+	pw, err := writer.NewParquetWriter(fw, new(TelemetryEvent), 4)
+	if err != nil {
+		return 0, err
+	}
+	pw.RowGroupSize = c.cfg.Parquet.RowGroupSize
+	pw.PageSize = c.cfg.Parquet.PageSize
+	pw.CompressionType = c.cfg.Parquet.Compression
+	setSchemaVersion(pw)
+
+	var total int64
+	for i, key := range keys {
+		src := filepath.Join(tmpDir, fmt.Sprintf("src-%d.parquet", i))
+		if err := c.minio.FGetObject(ctx, c.cfg.MinIOBucket, key, src, minio.GetObjectOptions{}); err != nil {
+			return 0, fmt.Errorf("download %s: %w", key, err)
+		}
+		n, err := copyParquet(pw, src)
+		if err != nil {
+			return 0, fmt.Errorf("read %s: %w", key, err)
+		}
+		total += n
+		os.Remove(src)
+	}
+
+	if err := pw.WriteStop(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// copyParquet appends every row of the file at src to pw, in batches.
+func copyParquet(pw *writer.ParquetWriter, src string) (int64, error) {
+	fr, err := local.NewLocalFileReader(src)
+	if err != nil {
+		return 0, err
+	}
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, new(TelemetryEvent), 4)
+	if err != nil {
+		return 0, err
+	}
+	defer pr.ReadStop()
+
+	const batch = 10000
+	remaining := pr.GetNumRows()
+	for remaining > 0 {
+		n := min(remaining, batch)
+		events := make([]TelemetryEvent, n)
+		if err := pr.Read(&events); err != nil {
+			return 0, err
+		}
+		for _, ev := range events {
+			if err := pw.Write(ev); err != nil {
+				return 0, err
+			}
+		}
+		remaining -= n
+	}
+	return pr.GetNumRows(), nil
+}
+
+// partitionHour reads the date= and hour= segments of a partition directory.
+func partitionHour(dir string) (time.Time, bool) {
+	var date, hour string
+	for _, seg := range strings.Split(dir, "/") {
+		switch {
+		case strings.HasPrefix(seg, "date="):
+			date = strings.TrimPrefix(seg, "date=")
+		case strings.HasPrefix(seg, "hour="):
+			hour = strings.TrimPrefix(seg, "hour=")
+		}
+	}
+	t, err := time.Parse("2006-01-02 15", date+" "+hour)
+	return t, err == nil
+}
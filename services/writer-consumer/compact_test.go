@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+func (f *fakeUploader) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	f.mu.Lock()
+	var objs []minio.ObjectInfo
+	for key, b := range f.objects {
+		if strings.HasPrefix(key, opts.Prefix) {
+			objs = append(objs, minio.ObjectInfo{Key: key, Size: int64(len(b))})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+
+	ch := make(chan minio.ObjectInfo, len(objs))
+	for _, obj := range objs {
+		ch <- obj
+	}
+	close(ch)
+	return ch
+}
+
+func (f *fakeUploader) GetObjectTagging(ctx context.Context, bucket, key string, opts minio.GetObjectTaggingOptions) (*tags.Tags, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return tags.MapToObjectTags(f.tags[key])
+}
+
+func (f *fakeUploader) FPutObject(ctx context.Context, bucket, key, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return f.PutObject(ctx, bucket, key, bytes.NewReader(b), int64(len(b)), opts)
+}
+
+func (f *fakeUploader) RemoveObjects(ctx context.Context, bucket string, objects <-chan minio.ObjectInfo, opts minio.RemoveObjectsOptions) <-chan minio.RemoveObjectError {
+	for obj := range objects {
+		f.RemoveObject(ctx, bucket, obj.Key, minio.RemoveObjectOptions{})
+	}
+	errs := make(chan minio.RemoveObjectError)
+	close(errs)
+	return errs
+}
+
+// putParquet stores a parquet file of n events under key, tagged with
+// retention days.
+func putParquet(t *testing.T, up *fakeUploader, key, days string, n int) {
+	t.Helper()
+	events := make([]TelemetryEvent, n)
+	for i := range events {
+		events[i] = testEvent("checkout", time.Date(2024, 5, 1, 13, i, 0, 0, time.UTC))
+	}
+	tmp := filepath.Join(t.TempDir(), "batch.parquet")
+	if err := writeParquet(tmp, events, testConfig().Parquet); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putObject(t, up, key, b, days)
+}
+
+func putObject(t *testing.T, up *fakeUploader, key string, b []byte, days string) {
+	t.Helper()
+	var opts minio.PutObjectOptions
+	if days != "" {
+		opts.UserTags = map[string]string{retentionTag: days}
+	}
+	if _, err := up.PutObject(context.Background(), "telemetry", key, bytes.NewReader(b), int64(len(b)), opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keysIn returns the parquet keys directly under dir.
+func keysIn(up *fakeUploader, dir string) []string {
+	var keys []string
+	for _, key := range up.parquetKeys() {
+		if path.Dir(key) == dir {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// parquetRows reads the stored object at key back as events.
+func parquetRows(t *testing.T, up *fakeUploader, key string) []TelemetryEvent {
+	t.Helper()
+	b, _ := up.object(key)
+	tmp := filepath.Join(t.TempDir(), "read.parquet")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := readParquet(t, tmp)
+	return events
+}
+
+func testCompactor(up *fakeUploader) *compactor {
+	return &compactor{
+		minio: up,
+		cfg:   testConfig(),
+		opts:  compactOptions{Grace: 10 * time.Minute, MaxFileBytes: 1 << 20, MinFiles: 2},
+	}
+}
+
+func TestCompactPassSelectsPartitions(t *testing.T) {
+	up := &fakeUploader{}
+	now := time.Now().UTC()
+	var (
+		closed = "telemetry/parquet/service=checkout/date=2024-05-01/hour=13"
+		open   = fmt.Sprintf("telemetry/parquet/service=checkout/date=%s/hour=%02d", now.Format("2006-01-02"), now.Hour())
+		few    = "telemetry/parquet/service=search/date=2024-05-01/hour=13"
+		big    = "telemetry/parquet/service=auth/date=2024-05-01/hour=13"
+	)
+	putParquet(t, up, closed+"/batch-p0-a.parquet", "30", 2)
+	putParquet(t, up, closed+"/batch-p0-b.parquet", "30", 1)
+	putParquet(t, up, closed+"/batch-p1-c.parquet", "7", 1)
+	putParquet(t, up, closed+"/batch-p1-d.parquet", "7", 1)
+	putParquet(t, up, open+"/batch-p0-a.parquet", "30", 1)
+	putParquet(t, up, open+"/batch-p0-b.parquet", "30", 1)
+	putParquet(t, up, few+"/batch-p0-a.parquet", "30", 1)
+	putObject(t, up, big+"/batch-p0-a.parquet", make([]byte, 1<<20), "30")
+	putObject(t, up, big+"/batch-p0-b.parquet", make([]byte, 1<<20), "30")
+
+	if err := testCompactor(up).pass(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// One merged object per retention tag in the closed hour, sources gone
+	merged := keysIn(up, closed)
+	if len(merged) != 2 {
+		t.Fatalf("closed hour holds %v, want one compacted file per tag", merged)
+	}
+	rows := map[string]int{}
+	for _, key := range merged {
+		if !strings.Contains(key, "/compacted-") {
+			t.Errorf("source %s left in place", key)
+		}
+		up.mu.Lock()
+		tag := up.tags[key][retentionTag]
+		up.mu.Unlock()
+		rows[tag] += len(parquetRows(t, up, key))
+	}
+	if rows["30"] != 3 || rows["7"] != 2 {
+		t.Errorf("merged rows by tag = %v, want 3 kept 30 days and 2 kept 7", rows)
+	}
+
+	// The open hour, a lone small file and files over the size limit stay
+	for dir, want := range map[string]int{open: 2, few: 1, big: 2} {
+		if keys := keysIn(up, dir); len(keys) != want || slices.ContainsFunc(keys, func(k string) bool { return strings.Contains(k, "/compacted-") }) {
+			t.Errorf("%s holds %v, want its %d files untouched", dir, keys, want)
+		}
+	}
+}
+
+func TestCompactKeepsSourcesWhenUploadFails(t *testing.T) {
+	up := &fakeUploader{failOn: "/compacted-"}
+	h := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	ctx := context.Background()
+	dir := "telemetry/parquet/service=checkout/date=2024-05-01/hour=13"
+	sources := []string{dir + "/batch-p0-a.parquet", dir + "/batch-p0-b.parquet"}
+	for _, key := range sources {
+		putParquet(t, up, key, "30", 1)
+		h.recordUpload(ctx, key)
+	}
+
+	if err := testCompactor(up).pass(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := keysIn(up, dir); !slices.Equal(keys, sources) {
+		t.Errorf("partition holds %v after a failed merge upload, want the sources %v", keys, sources)
+	}
+	if got := storedManifest(t, h, up, dir); !slices.Equal(got, sources) {
+		t.Errorf("manifest = %v, want the sources kept", got)
+	}
+}
+
+func TestCompactRewritesManifests(t *testing.T) {
+	up := &fakeUploader{}
+	writer := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	other := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	ctx := context.Background()
+	dir := "telemetry/parquet/service=checkout/date=2024-05-01/hour=13"
+	large := dir + "/batch-p0-large.parquet"
+
+	putParquet(t, up, dir+"/batch-p0-a.parquet", "30", 1)
+	putParquet(t, up, dir+"/batch-p0-b.parquet", "30", 1)
+	putObject(t, up, large, make([]byte, 1<<20), "30")
+	putParquet(t, up, dir+"/batch-p1-c.parquet", "30", 1)
+	for _, key := range []string{dir + "/batch-p0-a.parquet", dir + "/batch-p0-b.parquet", large} {
+		writer.recordUpload(ctx, key)
+	}
+	other.recordUpload(ctx, dir+"/batch-p1-c.parquet")
+
+	if err := testCompactor(up).pass(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := storedManifest(t, writer, up, dir); !slices.Equal(got, []string{large}) {
+		t.Errorf("writer manifest = %v, want only the file that was not merged", got)
+	}
+	if _, ok := up.object(dir + "/_manifest-" + other.manifests.id + ".json"); ok {
+		t.Error("manifest listing only merged files was not removed")
+	}
+	var merged []string
+	for _, key := range keysIn(up, dir) {
+		if strings.Contains(key, "/compacted-") {
+			merged = append(merged, key)
+		}
+	}
+	var found bool
+	up.mu.Lock()
+	for key, b := range up.objects {
+		if !strings.HasPrefix(key, dir+"/_manifest-compactor-") {
+			continue
+		}
+		var m partitionManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		found = slices.Equal(m.Files, merged)
+	}
+	up.mu.Unlock()
+	if len(merged) != 1 || !found {
+		t.Errorf("no compactor manifest listing the merged file %v", merged)
+	}
+
+	// A late upload into the compacted hour must not bring the merged
+	// sources back into the writer's manifest
+	late := dir + "/batch-p0-late.parquet"
+	putParquet(t, up, late, "30", 1)
+	writer.recordUpload(ctx, late)
+	if got := storedManifest(t, writer, up, dir); !slices.Equal(got, []string{large, late}) {
+		t.Errorf("writer manifest after a late upload = %v, want %v", got, []string{large, late})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// formatHeader is the Kafka header producers may set to pick a decoder per message.
+const formatHeader = "format"
+
+// Deserializer turns a raw Kafka message into a TelemetryEvent.
+type Deserializer interface {
+	Decode(value []byte, headers []*sarama.RecordHeader) (TelemetryEvent, error)
+}
+
+// DeserializerFunc adapts a plain function to the Deserializer interface,
+// which is also handy as a stand-in when exercising ConsumeClaim.
+type DeserializerFunc func(value []byte, headers []*sarama.RecordHeader) (TelemetryEvent, error)
+
+func (f DeserializerFunc) Decode(value []byte, headers []*sarama.RecordHeader) (TelemetryEvent, error) {
+	return f(value, headers)
+}
+
+// jsonDeserializer decodes the JSON payloads published by ingestion-api.
+type jsonDeserializer struct{}
+
+func (jsonDeserializer) Decode(value []byte, _ []*sarama.RecordHeader) (TelemetryEvent, error) {
+	return parseKafkaJSON(value)
+}
+
+// deserializers lists the supported formats by name.
+var deserializers = map[string]Deserializer{
+	"json":     jsonDeserializer{},
+	"protobuf": protobufDeserializer{},
+}
+
+// formatDispatcher picks a Deserializer from the message's format header,
+// falling back to the configured default when the header is absent.
+type formatDispatcher struct {
+	fallback Deserializer
+}
+
+func newFormatDispatcher(defaultFormat string) (*formatDispatcher, error) {
+	d, ok := deserializers[strings.ToLower(defaultFormat)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported message format %q", defaultFormat)
+	}
+	return &formatDispatcher{fallback: d}, nil
+}
+
+func (f *formatDispatcher) Decode(value []byte, headers []*sarama.RecordHeader) (TelemetryEvent, error) {
+	for _, h := range headers {
+		if h == nil || string(h.Key) != formatHeader {
+			continue
+		}
+		d, ok := deserializers[strings.ToLower(string(h.Value))]
+		if !ok {
+			return TelemetryEvent{}, fmt.Errorf("unsupported message format %q", h.Value)
+		}
+		return d.Decode(value, headers)
+	}
+	return f.fallback.Decode(value, headers)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// stubDeserializers replaces the registered formats with doubles that report
+// which one decoded the message.
+func stubDeserializers(t *testing.T) {
+	saved := deserializers
+	t.Cleanup(func() { deserializers = saved })
+	deserializers = map[string]Deserializer{}
+	for _, name := range []string{"json", "protobuf"} {
+		deserializers[name] = DeserializerFunc(func(value []byte, _ []*sarama.RecordHeader) (TelemetryEvent, error) {
+			return TelemetryEvent{Service: name}, nil
+		})
+	}
+}
+
+func formatHeaders(kv ...string) []*sarama.RecordHeader {
+	var hs []*sarama.RecordHeader
+	for i := 0; i < len(kv); i += 2 {
+		hs = append(hs, &sarama.RecordHeader{Key: []byte(kv[i]), Value: []byte(kv[i+1])})
+	}
+	return hs
+}
+
+func TestFormatDispatcher(t *testing.T) {
+	stubDeserializers(t)
+	tests := []struct {
+		name     string
+		fallback string
+		headers  []*sarama.RecordHeader
+		want     string // decoding format, "" for an error
+	}{
+		{"no headers", "json", nil, "json"},
+		{"default protobuf", "protobuf", nil, "protobuf"},
+		{"other headers only", "json", formatHeaders("trace", "abc"), "json"},
+		{"nil header skipped", "json", append([]*sarama.RecordHeader{nil}, formatHeaders("format", "protobuf")...), "protobuf"},
+		{"header overrides default", "json", formatHeaders("format", "protobuf"), "protobuf"},
+		{"header case-insensitive", "protobuf", formatHeaders("format", "JSON"), "json"},
+		{"unknown format", "json", formatHeaders("format", "avro"), ""},
+		{"empty format", "json", formatHeaders("format", ""), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newFormatDispatcher(tt.fallback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev, err := d.Decode([]byte("{}"), tt.headers)
+			switch {
+			case tt.want == "" && err == nil:
+				t.Errorf("decoded with %q, want an unsupported format error", ev.Service)
+			case tt.want != "" && err != nil:
+				t.Errorf("Decode: %v", err)
+			case ev.Service != tt.want:
+				t.Errorf("decoded with %q, want %q", ev.Service, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFormatDispatcherRejectsUnknownDefault(t *testing.T) {
+	if _, err := newFormatDispatcher("avro"); err == nil {
+		t.Error("newFormatDispatcher accepted an unsupported default format")
+	}
+}
+
+func TestConsumeClaimSkipsUndecodableMessages(t *testing.T) {
+	decoder := DeserializerFunc(func(value []byte, _ []*sarama.RecordHeader) (TelemetryEvent, error) {
+		if string(value) == "bad" {
+			return TelemetryEvent{}, errors.New("undecodable")
+		}
+		return testEvent("checkout", time.Now()), nil
+	})
+	h := NewWriterHandler(&fakeUploader{}, decoder, testConfig())
+
+	claim := fakeClaim{msgs: make(chan *sarama.ConsumerMessage, 3)}
+	for i, v := range []string{"bad", "good", "bad"} {
+		claim.msgs <- &sarama.ConsumerMessage{Topic: "telemetry", Partition: 4, Offset: int64(i), Value: []byte(v)}
+	}
+	close(claim.msgs)
+	sess := &markSession{fakeSession: fakeSession{ctx: context.Background()}, marks: map[topicPartition]int64{}}
+	if err := h.ConsumeClaim(sess, claim); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bad messages are released straight away, the good one stays held
+	// until its event is uploaded
+	if got := sess.marks[topicPartition{"telemetry", 4}]; got != 1 {
+		t.Errorf("marked offset %d, want 1 (the buffered message)", got)
+	}
+	if n := len(h.buffers[bufferKey{env: "prod", topic: "telemetry", partition: 4}].events); n != 1 {
+		t.Errorf("%d events buffered, want the one good message", n)
+	}
+}
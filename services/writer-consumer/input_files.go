@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileInputTopic stands in for the Kafka topic in buffer keys and offsets when
+// events come from INPUT_DIR. Every file is read as partition 0.
+const fileInputTopic = "files"
+
+// consumeFiles feeds the .json, .jsonl and .ndjson files in dir through
+// parseKafkaJSON, one event per line, buffering and flushing them as the Kafka
+// path does, except that a failed flush is retried before reading on. Files
+// are read in name order; lines that fail to parse are logged and skipped. It returns the number of events read; the error is
+// set if the final flush left any of them unwritten.
+func (h *WriterHandler) consumeFiles(ctx context.Context, dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".json", ".jsonl", ".ndjson":
+			if !e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+
+	// Offsets number the lines across all files, so the tracker sees one
+	// monotonically increasing partition
+	var offset int64
+	loaded := 0
+	for _, name := range names {
+		n, err := h.consumeFile(ctx, filepath.Join(dir, name), &offset)
+		loaded += n
+		if err != nil {
+			return loaded, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if _, err := h.flushAll(ctx); err != nil {
+		return loaded, err
+	}
+	return loaded, nil
+}
+
+func (h *WriterHandler) consumeFile(ctx context.Context, path string, offset *int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	n, line := 0, 0
+	for sc.Scan() {
+		line++
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		ev, err := parseKafkaJSON(b)
+		if err != nil {
+			log.Printf("bad event (skipping) %s:%d: %v", path, line, err)
+			continue
+		}
+
+		src := msgSource{topic: fileInputTopic, offset: *offset}
+		*offset++
+		key := bufferKey{env: ev.Environment, topic: fileInputTopic}
+		h.mu.Lock()
+		full := h.add(key, ev, src, len(b))
+		h.mu.Unlock()
+		if full {
+			if err := h.flushRetrying(ctx, key); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, sc.Err()
+}
+
+// flushRetrying flushes key until it succeeds. File mode has no ticker to
+// retry a failed flush, and add stops reporting the buffer full while a retry
+// is due, so carrying on would read the rest of the directory into memory;
+// reading waits here instead, backing off between attempts.
+func (h *WriterHandler) flushRetrying(ctx context.Context, key bufferKey) error {
+	backoff := max(time.Duration(h.cfg.UploadBackoffMs)*time.Millisecond, time.Millisecond)
+	for {
+		_, err := h.flush(ctx, key)
+		if err == nil {
+			return nil
+		}
+		log.Printf("flush error: %v (retrying in %s)", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeInputFile writes n events for svc, one JSON object per line.
+func writeInputFile(t *testing.T, dir, name, svc string, n int) {
+	t.Helper()
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, `{"timestamp":"2024-05-01T13:%02d:00Z","service":%q,"endpoint":"/pay","method":"POST","status_code":200,"environment":"prod"}`+"\n", i, svc)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumeFilesRetriesFailedFlush(t *testing.T) {
+	dir := t.TempDir()
+	writeInputFile(t, dir, "a.jsonl", "checkout", 3)
+	writeInputFile(t, dir, "b.ndjson", "checkout", 3)
+	writeInputFile(t, dir, "c.json", "checkout", 3)
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not events\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first flush fails outright, leaving its events to retry
+	up := &flakyUploader{failures: 1}
+	cfg := testConfig()
+	cfg.FlushEveryN = 2
+	cfg.UploadBackoffMs = 1
+	h := NewWriterHandler(up, jsonDeserializer{}, cfg)
+
+	n, err := h.consumeFiles(context.Background(), dir)
+	if err != nil || n != 9 {
+		t.Fatalf("consumeFiles = %d, %v; want 9 events and no error", n, err)
+	}
+	total := 0
+	for _, key := range up.parquetKeys() {
+		rows := len(parquetRows(t, &up.fakeUploader, key))
+		if rows > cfg.FlushEveryN {
+			t.Errorf("%s holds %d events; reading went on past a failed flush", key, rows)
+		}
+		total += rows
+	}
+	if total != 9 {
+		t.Errorf("uploaded %d events, want 9", total)
+	}
+}
+
+func TestConsumeFilesStopsRetryingOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	writeInputFile(t, dir, "a.jsonl", "checkout", 3)
+
+	cfg := testConfig()
+	cfg.FlushEveryN = 2
+	cfg.UploadBackoffMs = 1
+	h := NewWriterHandler(&fakeUploader{failOn: ".parquet"}, jsonDeserializer{}, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if _, err := h.consumeFiles(ctx, dir); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("consumeFiles err = %v; want to stop at the failing flush once cancelled", err)
+	}
+}
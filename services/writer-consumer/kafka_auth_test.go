@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/xdg-go/scram"
+)
+
+func TestKafkaAuthFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    kafkaAuth
+		wantErr bool
+	}{
+		{name: "unset", env: nil, want: kafkaAuth{}},
+		{name: "tls only", env: map[string]string{"KAFKA_TLS_ENABLE": "true"}, want: kafkaAuth{tls: true}},
+		{
+			name: "plain",
+			env:  map[string]string{"KAFKA_SASL_MECHANISM": "PLAIN", "KAFKA_SASL_USER": "u", "KAFKA_SASL_PASSWORD": "p"},
+			want: kafkaAuth{mechanism: "PLAIN", user: "u", password: "p"},
+		},
+		{
+			name: "scram, lower case",
+			env:  map[string]string{"KAFKA_SASL_MECHANISM": " scram-sha-512 ", "KAFKA_SASL_USER": "u", "KAFKA_SASL_PASSWORD": "p", "KAFKA_TLS_ENABLE": "true"},
+			want: kafkaAuth{mechanism: "SCRAM-SHA-512", user: "u", password: "p", tls: true},
+		},
+		{name: "unknown mechanism", env: map[string]string{"KAFKA_SASL_MECHANISM": "GSSAPI", "KAFKA_SASL_USER": "u", "KAFKA_SASL_PASSWORD": "p"}, wantErr: true},
+		{name: "missing password", env: map[string]string{"KAFKA_SASL_MECHANISM": "SCRAM-SHA-256", "KAFKA_SASL_USER": "u"}, wantErr: true},
+		{name: "missing user", env: map[string]string{"KAFKA_SASL_MECHANISM": "PLAIN", "KAFKA_SASL_PASSWORD": "p"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"KAFKA_SASL_MECHANISM", "KAFKA_SASL_USER", "KAFKA_SASL_PASSWORD", "KAFKA_TLS_ENABLE"} {
+				t.Setenv(k, tt.env[k])
+			}
+			got, err := kafkaAuthFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKafkaAuthApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		auth      kafkaAuth
+		wantSASL  bool
+		wantTLS   bool
+		wantScram bool
+	}{
+		{"plaintext", kafkaAuth{}, false, false, false},
+		{"tls", kafkaAuth{tls: true}, false, true, false},
+		{"plain", kafkaAuth{mechanism: sarama.SASLTypePlaintext, user: "u", password: "p"}, true, false, false},
+		{"scram-sha-256", kafkaAuth{mechanism: sarama.SASLTypeSCRAMSHA256, user: "u", password: "p"}, true, false, true},
+		{"scram-sha-512 over tls", kafkaAuth{mechanism: sarama.SASLTypeSCRAMSHA512, user: "u", password: "p", tls: true}, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := sarama.NewConfig()
+			tt.auth.apply(cfg)
+			if cfg.Net.SASL.Enable != tt.wantSASL || cfg.Net.TLS.Enable != tt.wantTLS {
+				t.Fatalf("sasl=%v tls=%v, want sasl=%v tls=%v", cfg.Net.SASL.Enable, cfg.Net.TLS.Enable, tt.wantSASL, tt.wantTLS)
+			}
+			if (cfg.Net.SASL.SCRAMClientGeneratorFunc != nil) != tt.wantScram {
+				t.Errorf("scram client generator set = %v, want %v", cfg.Net.SASL.SCRAMClientGeneratorFunc != nil, tt.wantScram)
+			}
+			if tt.wantSASL && (cfg.Net.SASL.User != "u" || string(cfg.Net.SASL.Mechanism) != tt.auth.mechanism) {
+				t.Errorf("sasl user %q mechanism %q", cfg.Net.SASL.User, cfg.Net.SASL.Mechanism)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Errorf("sarama rejects the config: %v", err)
+			}
+		})
+	}
+}
+
+// TestScramClientHandshake runs the sarama-facing SCRAM client against an
+// xdg-go/scram server standing in for the broker.
+func TestScramClientHandshake(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		hash      scram.HashGeneratorFcn
+		password  string
+		wantValid bool
+	}{
+		{sarama.SASLTypeSCRAMSHA256, scram.SHA256, "secret", true},
+		{sarama.SASLTypeSCRAMSHA512, scram.SHA512, "secret", true},
+		{sarama.SASLTypeSCRAMSHA256, scram.SHA256, "wrong", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mechanism+"/"+tt.password, func(t *testing.T) {
+			// The broker knows the user's real password
+			known, err := tt.hash.NewClient("svc", "secret", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			creds := known.GetStoredCredentials(scram.KeyFactors{Salt: "tigerscope-salt", Iters: 4096})
+			server, err := tt.hash.NewServer(func(user string) (scram.StoredCredentials, error) { return creds, nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			conv := server.NewConversation()
+
+			cfg := sarama.NewConfig()
+			kafkaAuth{mechanism: tt.mechanism, user: "svc", password: tt.password}.apply(cfg)
+			client := cfg.Net.SASL.SCRAMClientGeneratorFunc()
+			if err := client.Begin(cfg.Net.SASL.User, cfg.Net.SASL.Password, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := client.Step("")
+			for err == nil && !client.Done() {
+				var challenge string
+				if challenge, err = conv.Step(msg); err != nil {
+					break
+				}
+				msg, err = client.Step(challenge)
+			}
+			if tt.wantValid && (err != nil || !conv.Valid()) {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if !tt.wantValid && err == nil && conv.Valid() {
+				t.Fatal("handshake succeeded with the wrong password")
+			}
+		})
+	}
+}
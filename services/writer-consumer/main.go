@@ -5,58 +5,78 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
 
-	"github.com/xitongsys/parquet-go/parquet"
 	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
 	"github.com/xitongsys/parquet-go/writer"
+	"golang.org/x/sync/errgroup"
 )
 
+// TelemetryEvent is one stored row. customer_id and error repeat heavily
+// within a batch, so they are dictionary-encoded: smaller files, and DuckDB can
+// test filters against the dictionary. trace_id is nearly unique per row, where
+// a dictionary only adds overhead, and parquet-go writes no bloom filters, so
+// it stays plain.
 type TelemetryEvent struct {
-	Timestamp   int64             `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS" json:"timestamp"`
-	Service     string            `parquet:"name=service, type=BYTE_ARRAY, convertedtype=UTF8" json:"service"`
-	CustomerID  string            `parquet:"name=customer_id, type=BYTE_ARRAY, convertedtype=UTF8" json:"customer_id"`
-	Endpoint    string            `parquet:"name=endpoint, type=BYTE_ARRAY, convertedtype=UTF8" json:"endpoint"`
-	Method      string            `parquet:"name=method, type=BYTE_ARRAY, convertedtype=UTF8" json:"method"`
-	StatusCode  int32             `parquet:"name=status_code, type=INT32" json:"status_code"`
-	LatencyMs   int32             `parquet:"name=latency_ms, type=INT32" json:"latency_ms"`
-	TraceID     string            `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8" json:"trace_id"`
-	Error       string            `parquet:"name=error, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL" json:"error,omitempty"`
-	Environment string            `parquet:"name=environment, type=BYTE_ARRAY, convertedtype=UTF8" json:"environment"`
-	SchemaVer   int32             `parquet:"name=schema_version, type=INT32" json:"schema_version"`
-	IngestedAt  int64             `parquet:"name=ingested_at, type=INT64, convertedtype=TIMESTAMP_MILLIS" json:"ingested_at"`
-	// NOTE: attributes map omitted for now (we’ll add later as a “wow” improvement)
+	Timestamp    int64             `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS" json:"timestamp"`
+	Service      string            `parquet:"name=service, type=BYTE_ARRAY, convertedtype=UTF8" json:"service"`
+	CustomerID   string            `parquet:"name=customer_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY" json:"customer_id"`
+	Endpoint     string            `parquet:"name=endpoint, type=BYTE_ARRAY, convertedtype=UTF8" json:"endpoint"`
+	Method       string            `parquet:"name=method, type=BYTE_ARRAY, convertedtype=UTF8" json:"method"`
+	StatusCode   int32             `parquet:"name=status_code, type=INT32" json:"status_code"`
+	LatencyMs    int32             `parquet:"name=latency_ms, type=INT32" json:"latency_ms"`
+	TraceID      string            `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8" json:"trace_id"`
+	Error        string            `parquet:"name=error, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL" json:"error,omitempty"`
+	Environment  string            `parquet:"name=environment, type=BYTE_ARRAY, convertedtype=UTF8" json:"environment"`
+	SchemaVer    int32             `parquet:"name=schema_version, type=INT32" json:"schema_version"`
+	IngestedAt   int64             `parquet:"name=ingested_at, type=INT64, convertedtype=TIMESTAMP_MILLIS" json:"ingested_at"`
+	SamplingRate float64           `parquet:"name=sampling_rate, type=DOUBLE" json:"sampling_rate"`
+	Attributes   map[string]string `parquet:"name=attributes, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8" json:"attributes,omitempty"`
+	RequestID    string            `parquet:"name=request_id, type=BYTE_ARRAY, convertedtype=UTF8" json:"request_id"`
 }
 
 type rawEvent struct {
-	Timestamp   string            `json:"timestamp"`
-	Service     string            `json:"service"`
-	CustomerID  string            `json:"customer_id"`
-	Endpoint    string            `json:"endpoint"`
-	Method      string            `json:"method"`
-	StatusCode  int32             `json:"status_code"`
-	LatencyMs   int32             `json:"latency_ms"`
-	TraceID     string            `json:"trace_id"`
-	Error       string            `json:"error,omitempty"`
-	Environment string            `json:"environment"`
-	SchemaVer   int32             `json:"schema_version"`
-	IngestedAt  string            `json:"ingested_at"`
-	Attributes  map[string]string `json:"attributes,omitempty"`
+	Timestamp    string            `json:"timestamp"`
+	Service      string            `json:"service"`
+	CustomerID   string            `json:"customer_id"`
+	Endpoint     string            `json:"endpoint"`
+	Method       string            `json:"method"`
+	StatusCode   int32             `json:"status_code"`
+	LatencyMs    int32             `json:"latency_ms"`
+	TraceID      string            `json:"trace_id"`
+	Error        string            `json:"error,omitempty"`
+	Environment  string            `json:"environment"`
+	SchemaVer    int32             `json:"schema_version"`
+	IngestedAt   string            `json:"ingested_at"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	SamplingRate float64           `json:"sampling_rate"`
+	RequestID    string            `json:"request_id"`
 }
 
 type Config struct {
 	KafkaBrokers string
-	KafkaTopic   string
+	KafkaTopics  []string
 	KafkaGroup   string
+	DLQTopic     string // empty disables the dead-letter topic
 
 	MinIOEndpoint  string
 	MinIOAccessKey string
@@ -64,15 +84,94 @@ type Config struct {
 	MinIOBucket    string
 	MinIOUseSSL    bool
 
+	// Default decoder for messages without a format header
+	MessageFormat string
+
+	Parquet parquetOptions
+
 	FlushEveryN    int
 	FlushEverySecs int
+	RetentionDays  int
+
+	// Flush once the buffered Kafka message payloads add up to this many
+	// bytes; 0 disables the size trigger. Parquet output is typically several
+	// times smaller than the JSON it was decoded from.
+	FlushEveryBytes int64
+
+	// Upper bound on the final flush when the consumer shuts down
+	ShutdownTimeoutSecs int
+
+	MetricsPort string
+
+	// PutObject attempts per flush and the initial backoff between them
+	UploadMaxAttempts int
+	UploadBackoffMs   int
+	// How many of a flush's files are written and uploaded at once
+	UploadParallelism int
+
+	// Per-environment overrides, keyed by the event's environment field
+	EnvRules map[string]EnvRule
+
+	// Stop consuming once this many events are buffered across all
+	// environments (e.g. while MinIO is down); 0 means unbounded
+	MaxBufferedEvents int
+
+	// Local directory for parquet files that failed to upload; empty disables
+	// spilling. Put it on a persistent volume, since spilled events count as
+	// flushed and their Kafka offsets are committed.
+	SpillDir       string
+	SpillMaxBytes  int64
+	SpillDrainSecs int
+
+	// How long after an hour ends before its partitions get a _SUCCESS marker
+	ManifestSealGraceSecs int
+}
+
+// EnvRule overrides the global flush/retention settings for one environment.
+// Zero fields fall back to the global Config values.
+type EnvRule struct {
+	FlushEveryN     int   `json:"flush_every_n"`
+	FlushEverySecs  int   `json:"flush_every_secs"`
+	FlushEveryBytes int64 `json:"flush_every_bytes"`
+	RetentionDays   int   `json:"retention_days"`
+}
+
+// ruleFor returns the effective settings for an environment.
+func (c Config) ruleFor(env string) EnvRule {
+	r := c.EnvRules[env]
+	if r.FlushEveryN <= 0 {
+		r.FlushEveryN = c.FlushEveryN
+	}
+	if r.FlushEverySecs <= 0 {
+		r.FlushEverySecs = c.FlushEverySecs
+	}
+	if r.FlushEveryBytes <= 0 {
+		r.FlushEveryBytes = c.FlushEveryBytes
+	}
+	if r.RetentionDays <= 0 {
+		r.RetentionDays = c.RetentionDays
+	}
+	return r
+}
+
+// parseEnvRules reads ENV_RULES, a JSON object such as
+// {"prod":{"flush_every_n":2000,"retention_days":30},"staging":{"retention_days":7}}
+func parseEnvRules(v string) (map[string]EnvRule, error) {
+	rules := map[string]EnvRule{}
+	if strings.TrimSpace(v) == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(v), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
 }
 
 func main() {
 	cfg := Config{
 		KafkaBrokers:   getenv("KAFKA_BROKERS", "localhost:9092"),
-		KafkaTopic:     getenv("KAFKA_TOPIC", "telemetry.events"),
 		KafkaGroup:     getenv("KAFKA_GROUP", "tigerscope-writer"),
+		DLQTopic:       os.Getenv("DLQ_TOPIC"),
 		MinIOEndpoint:  getenv("MINIO_ENDPOINT", "localhost:9000"),
 		MinIOAccessKey: getenv("MINIO_ACCESS_KEY", "minioadmin"),
 		MinIOSecretKey: getenv("MINIO_SECRET_KEY", "minioadmin"),
@@ -80,8 +179,53 @@ func main() {
 		MinIOUseSSL:    getenv("MINIO_USE_SSL", "false") == "true",
 		FlushEveryN:    getenvInt("FLUSH_EVERY_N", 500),
 		FlushEverySecs: getenvInt("FLUSH_EVERY_SECS", 5),
+		MessageFormat:  getenv("MESSAGE_FORMAT", "json"),
+		RetentionDays:  getenvInt("RETENTION_DAYS", 0),
+
+		FlushEveryBytes: int64(getenvInt("FLUSH_EVERY_BYTES", 0)),
+
+		ShutdownTimeoutSecs: getenvInt("SHUTDOWN_TIMEOUT_SECS", 30),
+		MetricsPort:         getenv("METRICS_PORT", "9100"),
+		UploadMaxAttempts:   getenvInt("UPLOAD_MAX_ATTEMPTS", 5),
+		UploadBackoffMs:     getenvInt("UPLOAD_BACKOFF_MS", 200),
+		UploadParallelism:   getenvInt("UPLOAD_PARALLELISM", 4),
+		MaxBufferedEvents:   getenvInt("MAX_BUFFERED_EVENTS", 100000),
+		SpillDir:            os.Getenv("SPILL_DIR"),
+		SpillMaxBytes:       int64(getenvInt("SPILL_MAX_BYTES", 1<<30)),
+		SpillDrainSecs:      getenvInt("SPILL_DRAIN_SECS", 30),
+
+		ManifestSealGraceSecs: getenvInt("MANIFEST_SEAL_GRACE_SECS", 300),
+	}
+
+	codec, err := parseCompression(getenv("PARQUET_COMPRESSION", "snappy"))
+	if err != nil {
+		log.Fatalf("invalid PARQUET_COMPRESSION: %v", err)
+	}
+	cfg.Parquet.Compression = codec
+	cfg.Parquet.RowGroupSize = int64(getenvInt("PARQUET_ROW_GROUP_SIZE", 8*1024*1024))
+	cfg.Parquet.PageSize = int64(getenvInt("PARQUET_PAGE_SIZE", 8*1024))
+	if cfg.Parquet.RowGroupSize <= 0 || cfg.Parquet.PageSize <= 0 {
+		log.Fatalf("PARQUET_ROW_GROUP_SIZE and PARQUET_PAGE_SIZE must be positive")
 	}
 
+	// KAFKA_TOPICS lists every topic to consume, e.g. one per environment;
+	// KAFKA_TOPIC is still honoured for single-topic deployments
+	cfg.KafkaTopics = splitList(getenv("KAFKA_TOPICS", getenv("KAFKA_TOPIC", "telemetry.events")))
+	if len(cfg.KafkaTopics) == 0 {
+		log.Fatalf("KAFKA_TOPICS must name at least one topic")
+	}
+	for _, t := range cfg.KafkaTopics {
+		if t == cfg.DLQTopic {
+			log.Fatalf("DLQ_TOPIC %q is also in KAFKA_TOPICS; dead letters would be consumed again", t)
+		}
+	}
+
+	envRules, err := parseEnvRules(os.Getenv("ENV_RULES"))
+	if err != nil {
+		log.Fatalf("invalid ENV_RULES: %v", err)
+	}
+	cfg.EnvRules = envRules
+
 	minioClient, err := minio.New(cfg.MinIOEndpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(cfg.MinIOAccessKey, cfg.MinIOSecretKey, ""),
 		Secure: cfg.MinIOUseSSL,
@@ -90,7 +234,9 @@ func main() {
 		log.Fatalf("minio client error: %v", err)
 	}
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	exists, err := minioClient.BucketExists(ctx, cfg.MinIOBucket)
 	if err != nil {
 		log.Fatalf("bucket check error: %v", err)
@@ -101,98 +247,546 @@ func main() {
 		}
 	}
 
-	log.Printf("writer-consumer(parquet) starting: kafka=%s topic=%s group=%s minio=%s bucket=%s",
-		cfg.KafkaBrokers, cfg.KafkaTopic, cfg.KafkaGroup, cfg.MinIOEndpoint, cfg.MinIOBucket)
+	if err := applyRetention(ctx, minioClient, cfg); err != nil {
+		log.Fatalf("bucket lifecycle error: %v", err)
+	}
+
+	// `writer-consumer compact` runs the small-file compactor instead of consuming
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		c := &compactor{
+			minio: minioClient,
+			cfg:   cfg,
+			opts: compactOptions{
+				Interval:     time.Duration(getenvInt("COMPACTION_INTERVAL_SECS", 300)) * time.Second,
+				Grace:        time.Duration(getenvInt("COMPACTION_GRACE_SECS", 600)) * time.Second,
+				MaxFileBytes: int64(getenvInt("COMPACTION_MAX_FILE_BYTES", 64*1024*1024)),
+				MinFiles:     max(getenvInt("COMPACTION_MIN_FILES", 2), 2),
+			},
+		}
+		log.Printf("compactor starting: minio=%s bucket=%s interval=%s", cfg.MinIOEndpoint, cfg.MinIOBucket, c.opts.Interval)
+		c.run(ctx)
+		return
+	}
+
+	// INPUT_MODE=files loads newline-delimited JSON events from INPUT_DIR
+	// instead of consuming Kafka, for local testing and one-off backfills
+	switch mode := getenv("INPUT_MODE", "kafka"); mode {
+	case "kafka":
+	case "files":
+		dir := os.Getenv("INPUT_DIR")
+		if dir == "" {
+			log.Fatalf("INPUT_MODE=files requires INPUT_DIR")
+		}
+		log.Printf("writer-consumer(parquet) loading files: dir=%s minio=%s bucket=%s", dir, cfg.MinIOEndpoint, cfg.MinIOBucket)
+		n, err := NewWriterHandler(minioClient, nil, cfg).consumeFiles(ctx, dir)
+		log.Printf("loaded %d events from %s", n, dir)
+		if err != nil {
+			log.Fatalf("file input failed: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("invalid INPUT_MODE %q (want kafka or files)", mode)
+	}
+
+	auth, err := kafkaAuthFromEnv()
+	if err != nil {
+		log.Fatalf("invalid kafka auth config: %v", err)
+	}
+
+	// `writer-consumer replay -from ... -topic ...` republishes stored events
+	// to Kafka, e.g. to backfill a new topic or consumer
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		opts, err := parseReplayFlags(os.Args[2:])
+		if err != nil {
+			log.Fatalf("replay: %v", err)
+		}
+		producer, err := sarama.NewSyncProducer(strings.Split(cfg.KafkaBrokers, ","), dlqProducerConfig(auth))
+		if err != nil {
+			log.Fatalf("replay producer error: %v", err)
+		}
+
+		r := &replayer{minio: minioClient, producer: producer, cfg: cfg, opts: opts}
+		sent, err := r.run(ctx)
+		_ = producer.Close()
+		log.Printf("replay: published %d events to topic=%s", sent, opts.Topic)
+		if err != nil {
+			log.Fatalf("replay failed: %v", err)
+		}
+		return
+	}
+
+	log.Printf("writer-consumer(parquet) starting: kafka=%s topics=%s group=%s minio=%s bucket=%s",
+		cfg.KafkaBrokers, strings.Join(cfg.KafkaTopics, ","), cfg.KafkaGroup, cfg.MinIOEndpoint, cfg.MinIOBucket)
+	strategy, err := parseRebalanceStrategy(getenv("KAFKA_REBALANCE_STRATEGY", "range"))
+	if err != nil {
+		log.Fatalf("invalid KAFKA_REBALANCE_STRATEGY: %v", err)
+	}
+	initialOffset, err := parseInitialOffset(getenv("KAFKA_INITIAL_OFFSET", "newest"))
+	if err != nil {
+		log.Fatalf("invalid KAFKA_INITIAL_OFFSET: %v", err)
+	}
 
-	consumerGroup, err := sarama.NewConsumerGroup(strings.Split(cfg.KafkaBrokers, ","), cfg.KafkaGroup, saramaConfig())
+	consumerGroup, err := sarama.NewConsumerGroup(strings.Split(cfg.KafkaBrokers, ","), cfg.KafkaGroup, saramaConfig(auth, strategy, initialOffset))
 	if err != nil {
 		log.Fatalf("kafka consumer group error: %v", err)
 	}
 	defer func() { _ = consumerGroup.Close() }()
 
-	handler := NewWriterHandler(minioClient, cfg)
+	decoder, err := newFormatDispatcher(cfg.MessageFormat)
+	if err != nil {
+		log.Fatalf("invalid MESSAGE_FORMAT: %v", err)
+	}
+
+	handler := NewWriterHandler(minioClient, decoder, cfg)
+	handler.pauser = consumerGroup
+
+	if cfg.DLQTopic != "" {
+		dlq, err := sarama.NewSyncProducer(strings.Split(cfg.KafkaBrokers, ","), dlqProducerConfig(auth))
+		if err != nil {
+			log.Fatalf("dlq producer error: %v", err)
+		}
+		defer func() { _ = dlq.Close() }()
+		handler.dlq = dlq
+		log.Printf("undecodable events will be sent to dlq topic=%s", cfg.DLQTopic)
+	}
+
+	go handler.sealPartitions(ctx)
 
+	if cfg.SpillDir != "" {
+		if err := os.MkdirAll(cfg.SpillDir, 0o755); err != nil {
+			log.Fatalf("spill dir error: %v", err)
+		}
+		go handler.drainSpill(ctx, time.Duration(max(cfg.SpillDrainSecs, 1))*time.Second)
+		log.Printf("failed uploads will spill to %s (max %d bytes)", cfg.SpillDir, cfg.SpillMaxBytes)
+	}
+
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler())
+		mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+			defer cancel()
+			ok, err := minioClient.BucketExists(ctx, cfg.MinIOBucket)
+			if err == nil && !ok {
+				err = fmt.Errorf("bucket %q does not exist", cfg.MinIOBucket)
+			}
+			if err != nil {
+				http.Error(w, "minio: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok"))
+		})
+		log.Printf("metrics and readiness listening on :%s", cfg.MetricsPort)
+		if err := http.ListenAndServe(":"+cfg.MetricsPort, mux); err != nil {
+			log.Printf("metrics server error: %v", err)
+		}
+	}()
+
+	// Consume returns once ctx is cancelled; sarama runs Cleanup first, which
+	// flushes whatever is still buffered.
 	for {
-		if err := consumerGroup.Consume(ctx, []string{cfg.KafkaTopic}, handler); err != nil {
+		if err := consumerGroup.Consume(ctx, cfg.KafkaTopics, handler); err != nil {
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				break
+			}
 			log.Printf("consume error: %v", err)
 			time.Sleep(1 * time.Second)
 		}
+		if ctx.Err() != nil {
+			break
+		}
 	}
+	log.Printf("writer-consumer shutting down")
 }
 
-func saramaConfig() *sarama.Config {
+func saramaConfig(auth kafkaAuth, strategy sarama.BalanceStrategy, initialOffset int64) *sarama.Config {
 	cfg := sarama.NewConfig()
 	cfg.Version = sarama.V2_8_0_0
-	cfg.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
-	cfg.Consumer.Offsets.Initial = sarama.OffsetNewest
+	cfg.Consumer.Group.Rebalance.Strategy = strategy
+	// Only applies when the group has no committed offset yet
+	cfg.Consumer.Offsets.Initial = initialOffset
 	cfg.Consumer.Return.Errors = true
 	cfg.ChannelBufferSize = 256
+	auth.apply(cfg)
+	return cfg
+}
+
+// parseRebalanceStrategy maps KAFKA_REBALANCE_STRATEGY onto sarama's strategies.
+func parseRebalanceStrategy(v string) (sarama.BalanceStrategy, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "range":
+		return sarama.BalanceStrategyRange, nil
+	case "roundrobin":
+		return sarama.BalanceStrategyRoundRobin, nil
+	case "sticky":
+		return sarama.BalanceStrategySticky, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q (want range, roundrobin or sticky)", v)
+	}
+}
+
+// parseInitialOffset maps KAFKA_INITIAL_OFFSET onto sarama's offset sentinels.
+func parseInitialOffset(v string) (int64, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "newest":
+		return sarama.OffsetNewest, nil
+	case "oldest":
+		return sarama.OffsetOldest, nil
+	default:
+		return 0, fmt.Errorf("unknown offset %q (want newest or oldest)", v)
+	}
+}
+
+func dlqProducerConfig(auth kafkaAuth) *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_8_0_0
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Retry.Max = 5
+	cfg.Producer.Return.Successes = true
+	auth.apply(cfg)
 	return cfg
 }
 
+// retentionTag is set on every uploaded object so lifecycle rules can expire
+// each environment's files on its own schedule.
+const retentionTag = "retention_days"
+
+// applyRetention installs one expiration rule per distinct retention period
+// in use, matching objects by their retention tag. It leaves the bucket alone
+// when exactly those rules are already installed.
+func applyRetention(ctx context.Context, client *minio.Client, cfg Config) error {
+	days := map[int]bool{}
+	if cfg.RetentionDays > 0 {
+		days[cfg.RetentionDays] = true
+	}
+	for env := range cfg.EnvRules {
+		if d := cfg.ruleFor(env).RetentionDays; d > 0 {
+			days[d] = true
+		}
+	}
+	if len(days) == 0 {
+		return nil
+	}
+
+	periods := make([]int, 0, len(days))
+	for d := range days {
+		periods = append(periods, d)
+	}
+	sort.Ints(periods)
+
+	// Rules set up outside tigerscope are kept; ours are recognised by ID
+	lc := lifecycle.NewConfiguration()
+	existing := map[string]bool{}
+	current, err := client.GetBucketLifecycle(ctx, cfg.MinIOBucket)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+		return err
+	}
+	if current != nil {
+		for _, r := range current.Rules {
+			if strings.HasPrefix(r.ID, retentionRulePrefix) {
+				existing[r.ID] = true
+				continue
+			}
+			lc.Rules = append(lc.Rules, r)
+		}
+	}
+
+	upToDate := len(existing) == len(periods)
+	for _, d := range periods {
+		if !existing[retentionRuleID(d)] {
+			upToDate = false
+		}
+	}
+	if upToDate {
+		log.Printf("retention rules already in place: days=%v", periods)
+		return nil
+	}
+
+	for _, d := range periods {
+		lc.Rules = append(lc.Rules, lifecycle.Rule{
+			ID:     retentionRuleID(d),
+			Status: "Enabled",
+			RuleFilter: lifecycle.Filter{
+				And: lifecycle.And{
+					Prefix: "telemetry/parquet/",
+					Tags:   []lifecycle.Tag{{Key: retentionTag, Value: strconv.Itoa(d)}},
+				},
+			},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(d)},
+		})
+	}
+
+	if err := client.SetBucketLifecycle(ctx, cfg.MinIOBucket, lc); err != nil {
+		return err
+	}
+	log.Printf("retention rules applied: expire objects under telemetry/parquet/ tagged %s=N after N days, for N in %v", retentionTag, periods)
+	return nil
+}
+
+const retentionRulePrefix = "tigerscope-expire-"
+
+func retentionRuleID(days int) string {
+	return fmt.Sprintf("%s%dd", retentionRulePrefix, days)
+}
+
 // --- Consumer Handler ---
 
-type WriterHandler struct {
-	minio *minio.Client
-	cfg   Config
+// bufferKey identifies one buffer. Events are buffered per environment (for
+// its flush rules) and per Kafka partition, so each claim flushes only what it
+// consumed and every file holds rows from a single partition.
+type bufferKey struct {
+	env       string
+	topic     string
+	partition int32
+}
 
+// partitionBuffer holds the pending events of one bufferKey.
+type partitionBuffer struct {
 	events    []TelemetryEvent
+	sources   []msgSource // sources[i] is the message events[i] was decoded from
+	sizes     []int       // sizes[i] is that message's payload size
+	bytes     int64       // sum of sizes
 	lastFlush time.Time
+
+	// flushing is set while flush has taken the events out for upload;
+	// inflight counts them, so the buffer limit still sees them.
+	flushing bool
+	inflight int
+
+	// retrying is set after a failed flush; the ticker retries it rather than
+	// every event added in the meantime.
+	retrying bool
+}
+
+// objectStore is the part of *minio.Client the handler uses, so uploads and
+// manifest reads can be swapped out for a fake.
+type objectStore interface {
+	PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	FGetObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.GetObjectOptions) error
+	RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error
+}
+
+// partitionPauser is the part of sarama.ConsumerGroup used to stop fetching
+// while the buffer is full.
+type partitionPauser interface {
+	Pause(partitions map[string][]int32)
+	Resume(partitions map[string][]int32)
 }
 
-func NewWriterHandler(minioClient *minio.Client, cfg Config) *WriterHandler {
+type WriterHandler struct {
+	minio   objectStore
+	decoder Deserializer
+	cfg     Config
+
+	// dlq receives messages that fail to decode; nil means they are dropped
+	dlq sarama.SyncProducer
+
+	// pauser stops fetching for partitions over MaxBufferedEvents; nil
+	// disables the limit
+	pauser partitionPauser
+
+	// Serialises spills from concurrent uploads, so the size check holds
+	spillMu sync.Mutex
+
+	// ConsumeClaim runs once per partition in its own goroutine
+	mu        sync.Mutex
+	buffers   map[bufferKey]*partitionBuffer
+	offsets   *offsetTracker
+	manifests *manifestTracker
+}
+
+func NewWriterHandler(minioClient objectStore, decoder Deserializer, cfg Config) *WriterHandler {
 	return &WriterHandler{
-		minio:      minioClient,
-		cfg:        cfg,
-		lastFlush:  time.Now(),
-		events:     make([]TelemetryEvent, 0, cfg.FlushEveryN),
+		minio:     minioClient,
+		decoder:   decoder,
+		cfg:       cfg,
+		buffers:   make(map[bufferKey]*partitionBuffer),
+		offsets:   newOffsetTracker(),
+		manifests: newManifestTracker(),
 	}
 }
 
 func (h *WriterHandler) Setup(s sarama.ConsumerGroupSession) error {
 	log.Printf("consumer setup: claims=%v", s.Claims())
-	h.lastFlush = time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, buf := range h.buffers {
+		buf.lastFlush = time.Now()
+	}
 	return nil
 }
 
 func (h *WriterHandler) Cleanup(s sarama.ConsumerGroupSession) error {
-	return h.flush(context.Background())
+	// The session context is already cancelled by now (rebalance or shutdown),
+	// so give the final upload its own bounded deadline.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(s.Context()), time.Duration(h.cfg.ShutdownTimeoutSecs)*time.Second)
+	defer cancel()
+
+	n, err := h.flushAll(ctx)
+	log.Printf("consumer cleanup: flushed %d buffered events", n)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Partitions may move to another member; keep only what failed to upload
+	for key, buf := range h.buffers {
+		if len(buf.events) == 0 && !buf.flushing {
+			delete(h.buffers, key)
+		}
+	}
+	// Sarama commits once more after Cleanup, so this captures the final flush
+	h.offsets.mark(s)
+	return err
+}
+
+// buffer returns the buffer for key, creating it on first use. Callers must hold h.mu.
+func (h *WriterHandler) buffer(key bufferKey) *partitionBuffer {
+	buf, ok := h.buffers[key]
+	if !ok {
+		buf = &partitionBuffer{
+			events:    make([]TelemetryEvent, 0, h.cfg.ruleFor(key.env).FlushEveryN),
+			sources:   make([]msgSource, 0, h.cfg.ruleFor(key.env).FlushEveryN),
+			lastFlush: time.Now(),
+		}
+		h.buffers[key] = buf
+	}
+	return buf
+}
+
+// updateBufferedGauge sets the buffered-events gauge for env, summed over its
+// partitions. Callers must hold h.mu.
+func (h *WriterHandler) updateBufferedGauge(env string) {
+	n := 0
+	for key, buf := range h.buffers {
+		if key.env == env {
+			n += len(buf.events) + buf.inflight
+		}
+	}
+	bufferedEvents.WithLabelValues(env).Set(float64(n))
+}
+
+// bufferFull reports whether MaxBufferedEvents is reached across all environments.
+func (h *WriterHandler) bufferFull() bool {
+	if h.cfg.MaxBufferedEvents <= 0 {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, buf := range h.buffers {
+		n += len(buf.events) + buf.inflight
+	}
+	return n >= h.cfg.MaxBufferedEvents
+}
+
+// tickInterval is the shortest time-based flush period across all environments.
+func (h *WriterHandler) tickInterval() time.Duration {
+	secs := h.cfg.FlushEverySecs
+	for env := range h.cfg.EnvRules {
+		if s := h.cfg.ruleFor(env).FlushEverySecs; s < secs {
+			secs = s
+		}
+	}
+	if secs <= 0 {
+		secs = 1
+	}
+	return time.Duration(secs) * time.Second
 }
 
 func (h *WriterHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	ticker := time.NewTicker(time.Duration(h.cfg.FlushEverySecs) * time.Second)
+	ticker := time.NewTicker(h.tickInterval())
 	defer ticker.Stop()
 
+	partition := map[string][]int32{claim.Topic(): {claim.Partition()}}
+	pausedLabels := []string{claim.Topic(), strconv.Itoa(int(claim.Partition()))}
+	paused := false
+	defer func() {
+		if paused {
+			h.pauser.Resume(partition)
+		}
+		consumerPaused.DeleteLabelValues(pausedLabels...)
+	}()
 	for {
+		// Over the buffer limit, pause fetching for this partition; the
+		// ticker keeps retrying flushes until there is room again. Messages
+		// already fetched still arrive, so the buffer can overshoot the limit
+		// by up to the channel's capacity.
+		if full := h.pauser != nil && h.bufferFull(); full != paused {
+			paused = full
+			if paused {
+				h.pauser.Pause(partition)
+				log.Printf("buffer limit %d reached; pausing partition %d", h.cfg.MaxBufferedEvents, claim.Partition())
+			} else {
+				h.pauser.Resume(partition)
+				log.Printf("buffer below limit; resuming partition %d", claim.Partition())
+			}
+			consumerPaused.WithLabelValues(pausedLabels...).Set(boolGauge(paused))
+		}
+
 		select {
 		case msg, ok := <-claim.Messages():
 			if !ok {
 				return nil
 			}
 
-			ev, err := parseKafkaJSON(msg.Value)
+			src := msgSource{topic: msg.Topic, partition: msg.Partition, offset: msg.Offset}
+
+			ev, err := h.decoder.Decode(msg.Value, msg.Headers)
 			if err != nil {
-				// Skip bad events but don't crash the pipeline
-				log.Printf("bad event json (skipping): %v", err)
-				sess.MarkMessage(msg, "")
+				if h.dlq == nil {
+					// Skip bad events but don't crash the pipeline
+					log.Printf("bad event (skipping): %v", err)
+				} else {
+					if dlqErr := h.deadLetter(msg, err); dlqErr != nil {
+						// Leave the offset unmarked; ending the claim makes the
+						// message redeliver once the session restarts.
+						return fmt.Errorf("dead-letter %s/%d@%d: %w", msg.Topic, msg.Partition, msg.Offset, dlqErr)
+					}
+					log.Printf("bad event sent to dlq (offset %d): %v", msg.Offset, err)
+				}
+				h.mu.Lock()
+				h.offsets.release(src)
+				h.offsets.mark(sess)
+				h.mu.Unlock()
 				continue
 			}
 
-			h.events = append(h.events, ev)
-			sess.MarkMessage(msg, "")
-
-			if len(h.events) >= h.cfg.FlushEveryN {
-				if err := h.flush(sess.Context()); err != nil {
+			// The offset is only marked once the event has been uploaded
+			key := bufferKey{env: ev.Environment, topic: msg.Topic, partition: msg.Partition}
+			h.mu.Lock()
+			full := h.add(key, ev, src, len(msg.Value))
+			h.mu.Unlock()
+			if full {
+				if _, err := h.flush(sess.Context(), key); err != nil {
 					log.Printf("flush error: %v", err)
 				}
+				h.mu.Lock()
+				h.offsets.mark(sess)
+				h.mu.Unlock()
 			}
 
 		case <-ticker.C:
-			if time.Since(h.lastFlush) >= time.Duration(h.cfg.FlushEverySecs)*time.Second && len(h.events) > 0 {
-				if err := h.flush(sess.Context()); err != nil {
+			// Other partitions' buffers are flushed by their own claims
+			var due []bufferKey
+			h.mu.Lock()
+			for key, buf := range h.buffers {
+				if key.topic != claim.Topic() || key.partition != claim.Partition() {
+					continue
+				}
+				every := time.Duration(h.cfg.ruleFor(key.env).FlushEverySecs) * time.Second
+				if time.Since(buf.lastFlush) >= every && len(buf.events) > 0 {
+					due = append(due, key)
+				}
+			}
+			h.mu.Unlock()
+			for _, key := range due {
+				if _, err := h.flush(sess.Context(), key); err != nil {
 					log.Printf("flush error: %v", err)
 				}
 			}
+			h.mu.Lock()
+			h.offsets.mark(sess)
+			h.mu.Unlock()
 
 		case <-sess.Context().Done():
 			return nil
@@ -200,49 +794,351 @@ func (h *WriterHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sar
 	}
 }
 
-func (h *WriterHandler) flush(ctx context.Context) error {
-	if len(h.events) == 0 {
-		return nil
+// add buffers ev, decoded from a size-byte message at src, and reports
+// whether the buffer has reached the count or size threshold for its
+// environment, so the caller should flush it once h.mu is released. After a
+// failed flush it reports false until the ticker's retry succeeds. Callers
+// must hold h.mu.
+func (h *WriterHandler) add(key bufferKey, ev TelemetryEvent, src msgSource, size int) bool {
+	h.offsets.hold(src)
+	buf := h.buffer(key)
+	buf.events = append(buf.events, ev)
+	buf.sources = append(buf.sources, src)
+	buf.sizes = append(buf.sizes, size)
+	buf.bytes += int64(size)
+	h.updateBufferedGauge(key.env)
+
+	if buf.retrying || buf.flushing {
+		return false
+	}
+	rule := h.cfg.ruleFor(key.env)
+	return len(buf.events) >= rule.FlushEveryN || (rule.FlushEveryBytes > 0 && buf.bytes >= rule.FlushEveryBytes)
+}
+
+// deadLetter republishes an undecodable message unchanged, with headers
+// describing where it came from and why it was rejected.
+func (h *WriterHandler) deadLetter(msg *sarama.ConsumerMessage, cause error) error {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+4)
+	for _, hdr := range msg.Headers {
+		if hdr != nil {
+			headers = append(headers, *hdr)
+		}
 	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte("dlq_error"), Value: []byte(cause.Error())},
+		sarama.RecordHeader{Key: []byte("dlq_topic"), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte("dlq_partition"), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte("dlq_offset"), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+	)
 
+	_, _, err := h.dlq.SendMessage(&sarama.ProducerMessage{
+		Topic:   h.cfg.DLQTopic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	})
+	return err
+}
+
+// flushAll flushes every buffer and reports how many events were uploaded.
+// Callers must not hold h.mu.
+func (h *WriterHandler) flushAll(ctx context.Context) (int, error) {
+	h.mu.Lock()
+	keys := make([]bufferKey, 0, len(h.buffers))
+	for key := range h.buffers {
+		keys = append(keys, key)
+	}
+	h.mu.Unlock()
+
+	var (
+		flushed  int
+		firstErr error
+	)
+	for _, key := range keys {
+		n, err := h.flush(ctx, key)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		flushed += n
+	}
+	return flushed, firstErr
+}
+
+// flush writes one buffer to MinIO and reports how many events were uploaded.
+// The events are taken out of the buffer under h.mu, then written and
+// uploaded without it, so other partitions keep consuming meanwhile. Callers
+// must not hold h.mu.
+func (h *WriterHandler) flush(ctx context.Context, key bufferKey) (int, error) {
+	h.mu.Lock()
+	buf := h.buffers[key]
+	if buf == nil || buf.flushing || len(buf.events) == 0 {
+		h.mu.Unlock()
+		return 0, nil
+	}
+	events, sources, sizes := buf.events, buf.sources, buf.sizes
+	buf.events = make([]TelemetryEvent, 0, cap(events))
+	buf.sources = make([]msgSource, 0, cap(sources))
+	buf.sizes = make([]int, 0, cap(sizes))
+	buf.bytes = 0
+	buf.flushing, buf.inflight = true, len(events)
+	h.mu.Unlock()
+
+	// One file per service and event hour, so queries filtered by service
+	// only read its partition and window pruning can trust the hour= segment
 	now := time.Now().UTC()
-	key := fmt.Sprintf("telemetry/parquet/date=%04d-%02d-%02d/hour=%02d/batch-%s.parquet",
-		now.Year(), now.Month(), now.Day(), now.Hour(), randomHex(8))
+	byFile := make(map[filePartition][]int)
+	for i, ev := range events {
+		fp := filePartition{service: partitionValue(ev.Service), hour: eventHour(ev, now)}
+		byFile[fp] = append(byFile[fp], i)
+	}
+	files := make([]filePartition, 0, len(byFile))
+	for fp := range byFile {
+		files = append(files, fp)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].service != files[j].service {
+			return files[i].service < files[j].service
+		}
+		return files[i].hour.Before(files[j].hour)
+	})
+
+	// Files are written and uploaded UPLOAD_PARALLELISM at a time. Each
+	// upload reports into its own slot, so the bookkeeping below (offsets,
+	// the retry buffer) happens once, back under h.mu.
+	uploaded := make([]string, len(files))
+	errs := make([]error, len(files))
+	var g errgroup.Group
+	g.SetLimit(max(h.cfg.UploadParallelism, 1))
+	for n, fp := range files {
+		idx := byFile[fp]
+		batch := make([]TelemetryEvent, len(idx))
+		for j, i := range idx {
+			batch[j] = events[i]
+		}
+		g.Go(func() error {
+			uploaded[n], errs[n] = h.writeBatch(ctx, key, fp.service, fp.hour, batch)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	// Manifests are MinIO round-trips too, so they are updated before taking
+	// h.mu back, and before the offsets below are released
+	for n := range files {
+		if errs[n] == nil && uploaded[n] != "" {
+			h.recordUpload(ctx, uploaded[n])
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var (
+		failed        []TelemetryEvent
+		failedSources []msgSource
+		failedSizes   []int
+		failedBytes   int64
+	)
+	for n, fp := range files {
+		idx := byFile[fp]
+		if errs[n] != nil {
+			// Uploaded files are dropped from the buffer; only failures are retried
+			for _, i := range idx {
+				failed = append(failed, events[i])
+				failedSources = append(failedSources, sources[i])
+				failedSizes = append(failedSizes, sizes[i])
+				failedBytes += int64(sizes[i])
+			}
+			continue
+		}
+		for _, i := range idx {
+			h.offsets.release(sources[i])
+		}
+	}
+
+	// Failures go back ahead of whatever was buffered in the meantime
+	buf.events = append(failed, buf.events...)
+	buf.sources = append(failedSources, buf.sources...)
+	buf.sizes = append(failedSizes, buf.sizes...)
+	buf.bytes += failedBytes
+	buf.flushing, buf.inflight = false, 0
+	h.updateBufferedGauge(key.env)
+	err := errors.Join(errs...)
+	buf.retrying = err != nil
+	if err == nil {
+		buf.lastFlush = time.Now()
+	}
+	return len(events) - len(failed), err
+}
+
+// filePartition is the service and event hour (UTC) of one flushed file.
+type filePartition struct {
+	service string
+	hour    time.Time
+}
+
+// eventHour is the UTC hour ev happened in. query-api prunes files on their
+// hour= segment, so it has to come from the event rather than the flush time,
+// or events from just before an hour boundary would land in the next hour.
+// Events without a timestamp fall back to now.
+func eventHour(ev TelemetryEvent, now time.Time) time.Time {
+	t := now
+	if ev.Timestamp > 0 {
+		t = time.UnixMilli(ev.Timestamp)
+	}
+	return t.UTC().Truncate(time.Hour)
+}
+
+// writeBatch writes one service's events from a single hour to a parquet file
+// and uploads it under
+// telemetry/parquet/service=<svc>/date=.../hour=.../batch-p<partition>-x.parquet.
+// It returns the object key once uploaded, or "" when the file was spilled
+// instead. flush runs several at once, so it must not touch state guarded by
+// h.mu.
+func (h *WriterHandler) writeBatch(ctx context.Context, bk bufferKey, svc string, hour time.Time, events []TelemetryEvent) (string, error) {
+	key := fmt.Sprintf("telemetry/parquet/service=%s/date=%04d-%02d-%02d/hour=%02d/batch-p%d-%s.parquet",
+		svc, hour.Year(), hour.Month(), hour.Day(), hour.Hour(), bk.partition, randomHex(8))
 
 	tmpDir := os.TempDir()
 	tmpFile := filepath.Join(tmpDir, "tigerscope-"+randomHex(6)+".parquet")
 
-	if err := writeParquet(tmpFile, h.events); err != nil {
-		return fmt.Errorf("write parquet: %w", err)
+	defer os.Remove(tmpFile)
+
+	if err := writeParquet(tmpFile, events, h.cfg.Parquet); err != nil {
+		return "", fmt.Errorf("write parquet: %w", err)
 	}
 
 	fi, err := os.Stat(tmpFile)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	f, err := os.Open(tmpFile)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer f.Close()
 
-	_, err = h.minio.PutObject(ctx, h.cfg.MinIOBucket, key, f, fi.Size(), minio.PutObjectOptions{
+	opts := minio.PutObjectOptions{
 		ContentType: "application/octet-stream",
-	})
-	if err != nil {
-		return fmt.Errorf("upload to minio: %w", err)
+	}
+	if days := h.cfg.ruleFor(bk.env).RetentionDays; days > 0 {
+		opts.UserTags = map[string]string{retentionTag: strconv.Itoa(days)}
+	}
+
+	// On failure the file is spilled to disk if SPILL_DIR is set; otherwise (or
+	// if the spill dir is full) the events stay buffered, so the next size or
+	// ticker flush retries them
+	if err := h.upload(ctx, key, f, fi.Size(), opts); err != nil {
+		if h.cfg.SpillDir == "" {
+			return "", fmt.Errorf("upload to minio: %w", err)
+		}
+		if serr := h.spill(tmpFile, key, opts.UserTags, fi.Size()); serr != nil {
+			return "", fmt.Errorf("upload to minio: %w (spill failed: %v)", err, serr)
+		}
+		log.Printf("upload of %s failed, spilled %d events to %s: %v", key, len(events), h.cfg.SpillDir, err)
+		return "", nil
 	}
 
-	log.Printf("flushed %d events -> s3://%s/%s (%d bytes)", len(h.events), h.cfg.MinIOBucket, key, fi.Size())
+	log.Printf("flushed %d events (env=%s topic=%s partition=%d) -> s3://%s/%s (%d bytes)", len(events), bk.env, bk.topic, bk.partition, h.cfg.MinIOBucket, key, fi.Size())
 
-	_ = os.Remove(tmpFile)
-	h.events = h.events[:0]
-	h.lastFlush = time.Now()
-	return nil
+	flushedBatches.Inc()
+	flushedEvents.Add(float64(len(events)))
+	parquetFileBytes.Observe(float64(fi.Size()))
+	return key, nil
+}
+
+// partitionValue makes a service name safe to use as an object key segment:
+// anything outside [A-Za-z0-9_-] becomes '_', and an empty name maps to "unknown".
+func partitionValue(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// upload puts f to MinIO, retrying with exponential backoff up to
+// UploadMaxAttempts times.
+func (h *WriterHandler) upload(ctx context.Context, key string, f *os.File, size int64, opts minio.PutObjectOptions) error {
+	backoff := time.Duration(h.cfg.UploadBackoffMs) * time.Millisecond
+	attempts := max(h.cfg.UploadMaxAttempts, 1)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = h.minio.PutObject(ctx, h.cfg.MinIOBucket, key, f, size, opts); err == nil {
+			return nil
+		}
+		uploadFailures.Inc()
+		if attempt == attempts {
+			break
+		}
+
+		log.Printf("upload attempt %d/%d for %s failed: %v (retrying in %s)", attempt, attempts, key, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+	return err
+}
+
+// parquetOptions tunes the files produced by writeParquet.
+type parquetOptions struct {
+	Compression parquet.CompressionCodec
+
+	// Batches are small (FLUSH_EVERY_N defaults to 500), so every file fits in
+	// a single row group either way. Keeping the row group modest (8MiB) and
+	// pages small (8KiB) gives readers finer-grained min/max stats to skip on.
+	RowGroupSize int64
+	PageSize     int64
+}
+
+// The layout of TelemetryEvent as written to parquet is versioned in each
+// file's key-value metadata, so readers can tell which columns to expect.
+// Bump parquetSchemaVersion whenever a column is added, removed or retyped.
+// Files written before the key existed carry no version and may lack the
+// newer columns.
+const (
+	parquetSchemaKey     = "tigerscope.schema_version"
+	parquetSchemaVersion = 1
+)
+
+// setSchemaVersion records parquetSchemaVersion in the file footer. Call it
+// before WriteStop, which is when the footer is written.
+func setSchemaVersion(pw *writer.ParquetWriter) {
+	v := strconv.Itoa(parquetSchemaVersion)
+	pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata, &parquet.KeyValue{Key: parquetSchemaKey, Value: &v})
+}
+
+// parseCompression maps PARQUET_COMPRESSION values onto parquet-go codecs.
+func parseCompression(name string) (parquet.CompressionCodec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "snappy":
+		return parquet.CompressionCodec_SNAPPY, nil
+	case "zstd":
+		return parquet.CompressionCodec_ZSTD, nil
+	case "gzip":
+		return parquet.CompressionCodec_GZIP, nil
+	case "uncompressed", "none":
+		return parquet.CompressionCodec_UNCOMPRESSED, nil
+	default:
+		return 0, fmt.Errorf("unknown codec %q (want snappy, zstd, gzip or uncompressed)", name)
+	}
 }
 
-func writeParquet(path string, events []TelemetryEvent) error {
+func writeParquet(path string, events []TelemetryEvent, opts parquetOptions) error {
 	fw, err := local.NewLocalFileWriter(path)
 	if err != nil {
 		return err
@@ -253,9 +1149,10 @@ func writeParquet(path string, events []TelemetryEvent) error {
 	if err != nil {
 		return err
 	}
-	pw.RowGroupSize = 128 * 1024 * 1024
-	pw.PageSize = 8 * 1024
-	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	pw.RowGroupSize = opts.RowGroupSize
+	pw.PageSize = opts.PageSize
+	pw.CompressionType = opts.Compression
+	setSchemaVersion(pw)
 
 	for _, ev := range events {
 		if err := pw.Write(ev); err != nil {
@@ -268,12 +1165,33 @@ func writeParquet(path string, events []TelemetryEvent) error {
 	return nil
 }
 
+// parseKafkaJSON decodes an ingestion-api event and maps it onto the single
+// parquet schema, branching on schema_version. Events from before versioning
+// (schema_version absent) are treated as v1.
 func parseKafkaJSON(b []byte) (TelemetryEvent, error) {
 	var r rawEvent
 	if err := json.Unmarshal(b, &r); err != nil {
 		return TelemetryEvent{}, err
 	}
+	return parseRaw(r)
+}
+
+// parseRaw maps a decoded event onto the parquet schema; every message format
+// decodes into rawEvent and ends up here.
+func parseRaw(r rawEvent) (TelemetryEvent, error) {
+	switch r.SchemaVer {
+	case 0, 1:
+		return parseV1(r), nil
+	case 2:
+		return parseV2(r)
+	default:
+		return TelemetryEvent{}, fmt.Errorf("unsupported schema_version %d", r.SchemaVer)
+	}
+}
 
+// parseV1 is lenient: v1 producers predate sampling and attributes, and a
+// malformed timestamp falls back to the time the event was consumed.
+func parseV1(r rawEvent) TelemetryEvent {
 	// parse timestamps (RFC3339 from ingestion-api)
 	ts, err := time.Parse(time.RFC3339Nano, r.Timestamp)
 	if err != nil {
@@ -284,8 +1202,53 @@ func parseKafkaJSON(b []byte) (TelemetryEvent, error) {
 		ing = time.Now().UTC()
 	}
 
+	// events produced before sampling existed were never sampled
+	rate := r.SamplingRate
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+
+	ev := baseEvent(r)
+	ev.SchemaVer = 1
+	ev.Timestamp = ts.UnixMilli()
+	ev.IngestedAt = ing.UnixMilli()
+	ev.SamplingRate = rate
+	return ev
+}
+
+// parseV2 expects sampling_rate and both timestamps to be set by the
+// producer; an event missing them is rejected so it lands in the DLQ rather
+// than being silently re-stamped.
+func parseV2(r rawEvent) (TelemetryEvent, error) {
+	ts, err := time.Parse(time.RFC3339Nano, r.Timestamp)
+	if err != nil {
+		return TelemetryEvent{}, fmt.Errorf("v2 timestamp: %w", err)
+	}
+	ing, err := time.Parse(time.RFC3339Nano, r.IngestedAt)
+	if err != nil {
+		return TelemetryEvent{}, fmt.Errorf("v2 ingested_at: %w", err)
+	}
+	if r.SamplingRate <= 0 || r.SamplingRate > 1 {
+		return TelemetryEvent{}, fmt.Errorf("v2 sampling_rate %v outside (0, 1]", r.SamplingRate)
+	}
+
+	ev := baseEvent(r)
+	ev.SchemaVer = 2
+	ev.Timestamp = ts.UnixMilli()
+	ev.IngestedAt = ing.UnixMilli()
+	ev.SamplingRate = r.SamplingRate
+	return ev, nil
+}
+
+// baseEvent copies the fields whose layout is shared by every schema version.
+func baseEvent(r rawEvent) TelemetryEvent {
+	// parquet-go expects a non-nil map for the MAP column
+	attrs := r.Attributes
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+
 	return TelemetryEvent{
-		Timestamp:   ts.UnixMilli(),
 		Service:     r.Service,
 		CustomerID:  r.CustomerID,
 		Endpoint:    r.Endpoint,
@@ -295,9 +1258,9 @@ func parseKafkaJSON(b []byte) (TelemetryEvent, error) {
 		TraceID:     r.TraceID,
 		Error:       r.Error,
 		Environment: r.Environment,
-		SchemaVer:   r.SchemaVer,
-		IngestedAt:  ing.UnixMilli(),
-	}, nil
+		Attributes:  attrs,
+		RequestID:   r.RequestID,
+	}
 }
 
 func randomHex(nBytes int) string {
@@ -326,3 +1289,14 @@ func getenvInt(key string, def int) int {
 	}
 	return n
 }
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,875 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/minio/minio-go/v7"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// fakeUploader keeps uploaded objects in memory. Keys containing failOn are
+// rejected.
+type fakeUploader struct {
+	failOn string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	tags    map[string]map[string]string // user tags by key
+	puts    int
+}
+
+func (f *fakeUploader) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts++
+	if f.failOn != "" && strings.Contains(key, f.failOn) {
+		return minio.UploadInfo{}, errors.New("injected failure")
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if f.objects == nil {
+		f.objects, f.tags = map[string][]byte{}, map[string]map[string]string{}
+	}
+	f.objects[key] = b
+	f.tags[key] = opts.UserTags
+	return minio.UploadInfo{Key: key, Size: int64(len(b))}, nil
+}
+
+func (f *fakeUploader) FGetObject(ctx context.Context, bucket, key, filePath string, opts minio.GetObjectOptions) error {
+	f.mu.Lock()
+	b, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		return minio.ErrorResponse{Code: "NoSuchKey", StatusCode: http.StatusNotFound}
+	}
+	return os.WriteFile(filePath, b, 0o644)
+}
+
+func (f *fakeUploader) RemoveObject(ctx context.Context, bucket, key string, opts minio.RemoveObjectOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, key)
+	delete(f.tags, key)
+	return nil
+}
+
+// object returns the stored object at key, and whether there is one.
+func (f *fakeUploader) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[key]
+	return b, ok
+}
+
+// parquetKeys returns the uploaded batch files, sorted.
+func (f *fakeUploader) parquetKeys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasSuffix(key, ".parquet") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testConfig() Config {
+	return Config{
+		MinIOBucket:       "telemetry",
+		FlushEveryN:       100,
+		FlushEverySecs:    60,
+		UploadMaxAttempts: 1,
+		UploadParallelism: 2,
+		Parquet: parquetOptions{
+			Compression:  parquet.CompressionCodec_SNAPPY,
+			RowGroupSize: 8 << 20,
+			PageSize:     8 << 10,
+		},
+	}
+}
+
+func testEvent(svc string, ts time.Time) TelemetryEvent {
+	return TelemetryEvent{
+		Timestamp:   ts.UnixMilli(),
+		Service:     svc,
+		Endpoint:    "/checkout",
+		Method:      "GET",
+		StatusCode:  200,
+		LatencyMs:   12,
+		Environment: "prod",
+		SchemaVer:   2,
+		IngestedAt:  ts.UnixMilli(),
+	}
+}
+
+// addEvents buffers events under key as size-byte messages with offsets
+// numbered from 0.
+func addEvents(h *WriterHandler, key bufferKey, size int, events ...TelemetryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, ev := range events {
+		h.add(key, ev, msgSource{topic: key.topic, partition: key.partition, offset: int64(i)}, size)
+	}
+}
+
+func TestFlushUploadsOneFilePerService(t *testing.T) {
+	up := &fakeUploader{}
+	h := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	key := bufferKey{env: "prod", topic: "telemetry", partition: 3}
+	now := time.Now()
+
+	addEvents(h, key, 100, testEvent("checkout", now), testEvent("search", now), testEvent("checkout", now), testEvent("pay ments", now))
+	n, err := h.flush(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := len(h.buffers[key].events); n != 4 || remaining != 0 {
+		t.Errorf("flushed %d events, %d still buffered; want all 4 flushed", n, remaining)
+	}
+
+	keys := up.parquetKeys()
+	if len(keys) != 3 {
+		t.Fatalf("uploaded %v, want one file per service", keys)
+	}
+	for i, svc := range []string{"checkout", "pay_ments", "search"} {
+		if !strings.HasPrefix(keys[i], "telemetry/parquet/service="+svc+"/date=") {
+			t.Errorf("key %q, want it under service=%s", keys[i], svc)
+		}
+		if !strings.Contains(keys[i], "/batch-p3-") {
+			t.Errorf("key %q does not name partition 3", keys[i])
+		}
+	}
+}
+
+func TestFlushKeepsFailedServicesBuffered(t *testing.T) {
+	up := &fakeUploader{failOn: "service=search/"}
+	h := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	key := bufferKey{env: "prod", topic: "telemetry", partition: 0}
+	now := time.Now()
+
+	addEvents(h, key, 100, testEvent("checkout", now), testEvent("search", now), testEvent("search", now))
+	if n, err := h.flush(context.Background(), key); err == nil || n != 1 {
+		t.Fatalf("flush = %d, %v; want 1 event uploaded and an error", n, err)
+	}
+
+	buf := h.buffers[key]
+	if len(buf.events) != 2 || buf.bytes != 200 {
+		t.Fatalf("buffered %d events / %d bytes, want the 2 search events / 200 bytes", len(buf.events), buf.bytes)
+	}
+	for _, ev := range buf.events {
+		if ev.Service != "search" {
+			t.Errorf("buffered a %s event, want only search", ev.Service)
+		}
+	}
+	if keys := up.parquetKeys(); len(keys) != 1 || !strings.Contains(keys[0], "service=checkout/") {
+		t.Errorf("uploaded %v, want only the checkout file", keys)
+	}
+}
+
+func TestUploadRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		wantErr   bool
+		wantPuts  int
+		failUntil int
+	}{
+		{"first try", 3, false, 1, 0},
+		{"succeeds on retry", 3, false, 3, 2},
+		{"gives up", 2, true, 2, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := &flakyUploader{failures: tt.failUntil}
+			cfg := testConfig()
+			cfg.UploadMaxAttempts = tt.attempts
+			cfg.UploadBackoffMs = 1
+			h := NewWriterHandler(up, jsonDeserializer{}, cfg)
+
+			f := writeTempFile(t, "payload")
+			err := h.upload(context.Background(), "k", f, 7, minio.PutObjectOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if up.puts != tt.wantPuts {
+				t.Errorf("PutObject called %d times, want %d", up.puts, tt.wantPuts)
+			}
+			if !tt.wantErr && up.last != "payload" {
+				t.Errorf("uploaded %q, want the whole file on every attempt", up.last)
+			}
+		})
+	}
+}
+
+// flakyUploader fails its first failures calls.
+type flakyUploader struct {
+	fakeUploader
+	failures int
+	puts     int
+	last     string
+}
+
+func (f *flakyUploader) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	f.puts++
+	b, _ := io.ReadAll(r)
+	if f.puts <= f.failures {
+		return minio.UploadInfo{}, errors.New("injected failure")
+	}
+	f.last = string(b)
+	return f.fakeUploader.PutObject(ctx, bucket, key, bytes.NewReader(b), size, opts)
+}
+
+func writeTempFile(t *testing.T, content string) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "upload-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// readParquet reads back a file written by writeParquet.
+func readParquet(t *testing.T, path string) ([]TelemetryEvent, *reader.ParquetReader) {
+	t.Helper()
+	fr, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fr.Close() })
+	pr, err := reader.NewParquetReader(fr, new(TelemetryEvent), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pr.ReadStop)
+	events := make([]TelemetryEvent, pr.GetNumRows())
+	if err := pr.Read(&events); err != nil {
+		t.Fatal(err)
+	}
+	return events, pr
+}
+
+func TestWriteParquetAttributesRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	in := []TelemetryEvent{testEvent("checkout", ts), testEvent("checkout", ts), testEvent("search", ts)}
+	in[0].Attributes = map[string]string{"region": "eu-west-1", "build": "1234"}
+	in[1].Attributes = map[string]string{"region": "us-east-1"}
+	// in[2] has none
+
+	path := filepath.Join(t.TempDir(), "batch.parquet")
+	if err := writeParquet(path, in, testConfig().Parquet); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := readParquet(t, path)
+	if len(out) != len(in) {
+		t.Fatalf("read %d rows, want %d", len(out), len(in))
+	}
+	for i := range in {
+		if len(in[i].Attributes) == 0 && len(out[i].Attributes) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(out[i].Attributes, in[i].Attributes) {
+			t.Errorf("row %d attributes = %v, want %v", i, out[i].Attributes, in[i].Attributes)
+		}
+	}
+}
+
+func TestParseKafkaJSONAttributes(t *testing.T) {
+	ev, err := parseKafkaJSON([]byte(`{"timestamp":"2024-05-01T13:00:00Z","service":"checkout","customer_id":"c1","endpoint":"/pay","method":"POST","status_code":200,"latency_ms":5,"attributes":{"region":"eu-west-1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Attributes["region"] != "eu-west-1" {
+		t.Errorf("attributes = %v, want region=eu-west-1", ev.Attributes)
+	}
+}
+
+func TestFlushPartitionsByEventHour(t *testing.T) {
+	up := &fakeUploader{}
+	h := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	key := bufferKey{env: "prod", topic: "telemetry"}
+	boundary := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+
+	addEvents(h, key, 10,
+		testEvent("checkout", boundary.Add(-time.Second)), testEvent("checkout", boundary), testEvent("checkout", boundary.Add(time.Second)))
+	if _, err := h.flush(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := up.parquetKeys()
+	if len(keys) != 2 {
+		t.Fatalf("uploaded %v, want one file per event hour", keys)
+	}
+	if !strings.Contains(keys[0], "/date=2024-05-01/hour=13/") || !strings.Contains(keys[1], "/date=2024-05-01/hour=14/") {
+		t.Errorf("keys = %v, want hour=13 and hour=14 partitions", keys)
+	}
+}
+
+func TestEventHour(t *testing.T) {
+	now := time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		ts   int64
+		want time.Time
+	}{
+		{"event time", time.Date(2024, 4, 30, 23, 59, 59, 999e6, time.UTC).UnixMilli(), time.Date(2024, 4, 30, 23, 0, 0, 0, time.UTC)},
+		{"on the hour", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC).UnixMilli(), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"missing timestamp", 0, time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventHour(TelemetryEvent{Timestamp: tt.ts}, now); !got.Equal(tt.want) {
+				t.Errorf("eventHour = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlushRetriesAfterFailedUpload(t *testing.T) {
+	up := &fakeUploader{failOn: "service=checkout/"}
+	cfg := testConfig()
+	cfg.UploadMaxAttempts = 3
+	cfg.UploadBackoffMs = 1
+	h := NewWriterHandler(up, jsonDeserializer{}, cfg)
+	key := bufferKey{env: "prod", topic: "telemetry"}
+
+	addEvents(h, key, 10, testEvent("checkout", time.Now()))
+	buf := h.buffers[key]
+	before := buf.lastFlush
+
+	if _, err := h.flush(context.Background(), key); err == nil {
+		t.Fatal("flush succeeded while MinIO fails")
+	}
+	if up.puts != cfg.UploadMaxAttempts {
+		t.Errorf("PutObject called %d times, want %d attempts", up.puts, cfg.UploadMaxAttempts)
+	}
+	if len(buf.events) != 1 || !buf.lastFlush.Equal(before) {
+		t.Fatalf("after a failed flush: %d events buffered, lastFlush moved %v; want the event kept and lastFlush unchanged",
+			len(buf.events), !buf.lastFlush.Equal(before))
+	}
+
+	// MinIO recovers; the next ticker flush uploads the same events once
+	up.failOn = ""
+	if _, err := h.flush(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if len(buf.events) != 0 || !buf.lastFlush.After(before) {
+		t.Errorf("after recovery: %d events buffered, lastFlush reset %v", len(buf.events), buf.lastFlush.After(before))
+	}
+	if keys := up.parquetKeys(); len(keys) != 1 {
+		t.Errorf("uploaded %v, want exactly one file", keys)
+	}
+}
+
+// benchBatch is a FLUSH_EVERY_N-sized batch with the cardinality we see in
+// production: a handful of services and endpoints, many customers.
+func benchBatch(n int) []TelemetryEvent {
+	rng := rand.New(rand.NewSource(1))
+	services := []string{"checkout", "search", "payments", "auth", "catalog"}
+	endpoints := []string{"/pay", "/search", "/login", "/items", "/cart", "/refund"}
+	statuses := []int32{200, 200, 200, 200, 201, 204, 400, 404, 500, 503}
+	start := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	events := make([]TelemetryEvent, n)
+	for i := range events {
+		ev := testEvent(services[rng.Intn(len(services))], start.Add(time.Duration(i)*time.Millisecond))
+		ev.CustomerID = fmt.Sprintf("cust-%04d", rng.Intn(2000))
+		ev.Endpoint = endpoints[rng.Intn(len(endpoints))]
+		ev.StatusCode = statuses[rng.Intn(len(statuses))]
+		ev.LatencyMs = int32(rng.ExpFloat64() * 40)
+		ev.TraceID = fmt.Sprintf("%016x%016x", rng.Uint64(), rng.Uint64())
+		events[i] = ev
+	}
+	return events
+}
+
+func BenchmarkWriteParquet(b *testing.B) {
+	events := benchBatch(500)
+	for _, name := range []string{"uncompressed", "snappy", "gzip", "zstd"} {
+		codec, err := parseCompression(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		opts := testConfig().Parquet
+		opts.Compression = codec
+		b.Run(name, func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "batch.parquet")
+			for i := 0; i < b.N; i++ {
+				if err := writeParquet(path, events, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+			st, err := os.Stat(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(st.Size()), "file-bytes")
+		})
+	}
+}
+
+func BenchmarkFlush(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	events := benchBatch(500)
+	for _, name := range []string{"uncompressed", "snappy", "gzip", "zstd"} {
+		cfg := testConfig()
+		cfg.FlushEveryN = len(events)
+		codec, err := parseCompression(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		cfg.Parquet.Compression = codec
+		b.Run(name, func(b *testing.B) {
+			up := &fakeUploader{}
+			h := NewWriterHandler(up, jsonDeserializer{}, cfg)
+			key := bufferKey{env: "prod", topic: "telemetry"}
+			for i := 0; i < b.N; i++ {
+				addEvents(h, key, 100, events...)
+				if _, err := h.flush(context.Background(), key); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var size int
+			for _, key := range up.parquetKeys() {
+				size += len(up.objects[key])
+			}
+			b.ReportMetric(float64(size)/float64(b.N), "uploaded-bytes/op")
+		})
+	}
+}
+
+func TestWriteParquetOptions(t *testing.T) {
+	events := make([]TelemetryEvent, 2000)
+	for i := range events {
+		events[i] = testEvent(fmt.Sprintf("svc-%d", i%7), time.Now())
+		events[i].TraceID = randomHex(16)
+	}
+	tests := []struct {
+		name          string
+		opts          parquetOptions
+		wantCodec     parquet.CompressionCodec
+		wantRowGroups func(n int) bool
+	}{
+		{"defaults", parquetOptions{Compression: parquet.CompressionCodec_SNAPPY, RowGroupSize: 8 << 20, PageSize: 8 << 10},
+			parquet.CompressionCodec_SNAPPY, func(n int) bool { return n == 1 }},
+		{"small row groups", parquetOptions{Compression: parquet.CompressionCodec_ZSTD, RowGroupSize: 16 << 10, PageSize: 1 << 10},
+			parquet.CompressionCodec_ZSTD, func(n int) bool { return n > 1 }},
+		{"uncompressed", parquetOptions{Compression: parquet.CompressionCodec_UNCOMPRESSED, RowGroupSize: 8 << 20, PageSize: 8 << 10},
+			parquet.CompressionCodec_UNCOMPRESSED, func(n int) bool { return n == 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "batch.parquet")
+			if err := writeParquet(path, events, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			out, pr := readParquet(t, path)
+			if len(out) != len(events) {
+				t.Fatalf("read %d rows, want %d", len(out), len(events))
+			}
+			groups := pr.Footer.RowGroups
+			if !tt.wantRowGroups(len(groups)) {
+				t.Errorf("%d row groups with RowGroupSize %d", len(groups), tt.opts.RowGroupSize)
+			}
+			for _, rg := range groups {
+				for _, col := range rg.Columns {
+					if col.MetaData.Codec != tt.wantCodec {
+						t.Fatalf("column %v uses %s, want %s", col.MetaData.PathInSchema, col.MetaData.Codec, tt.wantCodec)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    parquet.CompressionCodec
+		wantErr bool
+	}{
+		{"snappy", parquet.CompressionCodec_SNAPPY, false},
+		{" ZSTD ", parquet.CompressionCodec_ZSTD, false},
+		{"gzip", parquet.CompressionCodec_GZIP, false},
+		{"none", parquet.CompressionCodec_UNCOMPRESSED, false},
+		{"uncompressed", parquet.CompressionCodec_UNCOMPRESSED, false},
+		{"lz4", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCompression(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCompression(%q) = %s, %v; want %s, wantErr %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseKafkaJSONVersions(t *testing.T) {
+	const (
+		ts  = "2024-05-01T13:00:00.250Z"
+		ing = "2024-05-01T13:00:01Z"
+	)
+	tsMs := time.Date(2024, 5, 1, 13, 0, 0, 250e6, time.UTC).UnixMilli()
+	ingMs := time.Date(2024, 5, 1, 13, 0, 1, 0, time.UTC).UnixMilli()
+	tests := []struct {
+		name    string
+		payload string
+		want    TelemetryEvent
+		wantErr bool
+	}{
+		{
+			name:    "unversioned is v1",
+			payload: `{"timestamp":"` + ts + `","ingested_at":"` + ing + `","service":"checkout","status_code":200}`,
+			want:    TelemetryEvent{SchemaVer: 1, Timestamp: tsMs, IngestedAt: ingMs, Service: "checkout", StatusCode: 200, SamplingRate: 1},
+		},
+		{
+			name:    "v1 defaults sampling rate",
+			payload: `{"schema_version":1,"timestamp":"` + ts + `","ingested_at":"` + ing + `","service":"checkout","sampling_rate":0}`,
+			want:    TelemetryEvent{SchemaVer: 1, Timestamp: tsMs, IngestedAt: ingMs, Service: "checkout", SamplingRate: 1},
+		},
+		{
+			name:    "v2",
+			payload: `{"schema_version":2,"timestamp":"` + ts + `","ingested_at":"` + ing + `","service":"checkout","sampling_rate":0.25,"attributes":{"region":"eu"}}`,
+			want: TelemetryEvent{SchemaVer: 2, Timestamp: tsMs, IngestedAt: ingMs, Service: "checkout", SamplingRate: 0.25,
+				Attributes: map[string]string{"region": "eu"}},
+		},
+		{name: "v2 without timestamp", payload: `{"schema_version":2,"ingested_at":"` + ing + `","sampling_rate":1}`, wantErr: true},
+		{name: "v2 without ingested_at", payload: `{"schema_version":2,"timestamp":"` + ts + `","sampling_rate":1}`, wantErr: true},
+		{name: "v2 without sampling rate", payload: `{"schema_version":2,"timestamp":"` + ts + `","ingested_at":"` + ing + `"}`, wantErr: true},
+		{name: "unknown version", payload: `{"schema_version":3}`, wantErr: true},
+		{name: "not json", payload: `{`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKafkaJSON([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.want.Attributes == nil {
+				tt.want.Attributes = map[string]string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseV1BadTimestampFallsBackToNow(t *testing.T) {
+	before := time.Now().UnixMilli()
+	ev, err := parseKafkaJSON([]byte(`{"schema_version":1,"timestamp":"yesterday"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Timestamp < before || ev.Timestamp > time.Now().UnixMilli() {
+		t.Errorf("timestamp %d, want the time of parsing", ev.Timestamp)
+	}
+}
+
+// fakeSession and fakeClaim drive ConsumeClaim without a broker.
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	ctx context.Context
+}
+
+func (s fakeSession) Context() context.Context                              { return s.ctx }
+func (s fakeSession) MarkOffset(topic string, p int32, off int64, m string) {}
+
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+	msgs chan *sarama.ConsumerMessage
+}
+
+func (c fakeClaim) Topic() string                            { return "telemetry" }
+func (c fakeClaim) Partition() int32                         { return 4 }
+func (c fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.msgs }
+
+// fakePauser records Pause and Resume calls as "pause telemetry/4" and
+// "resume telemetry/4".
+type fakePauser struct{ calls chan string }
+
+func (p fakePauser) Pause(partitions map[string][]int32)  { p.record("pause", partitions) }
+func (p fakePauser) Resume(partitions map[string][]int32) { p.record("resume", partitions) }
+
+func (p fakePauser) record(op string, partitions map[string][]int32) {
+	for topic, ps := range partitions {
+		for _, part := range ps {
+			p.calls <- fmt.Sprintf("%s %s/%d", op, topic, part)
+		}
+	}
+}
+
+func TestConsumeClaimPausesWhenBufferFull(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxBufferedEvents = 2
+	h := NewWriterHandler(&fakeUploader{}, jsonDeserializer{}, cfg)
+	pauser := fakePauser{calls: make(chan string, 4)}
+	h.pauser = pauser
+
+	ctx, cancel := context.WithCancel(context.Background())
+	claim := fakeClaim{msgs: make(chan *sarama.ConsumerMessage, 3)}
+	for i := range 2 {
+		value := []byte(`{"timestamp":"2024-05-01T13:00:00Z","service":"checkout","endpoint":"/pay","method":"POST","status_code":200,"environment":"prod"}`)
+		claim.msgs <- &sarama.ConsumerMessage{Topic: "telemetry", Partition: 4, Offset: int64(i), Value: value}
+	}
+	done := make(chan error)
+	go func() { done <- h.ConsumeClaim(fakeSession{ctx: ctx}, claim) }()
+
+	select {
+	case call := <-pauser.calls:
+		if call != "pause telemetry/4" {
+			t.Fatalf("got %q, want the partition paused", call)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("partition not paused with the buffer at its limit")
+	}
+	// The gauge is set just after Pause returns
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Equal(pausedSeries(t), []string{"telemetry/4=1"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("paused gauge = %v, want telemetry/4 at 1", pausedSeries(t))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ending the claim resumes the partition for whoever claims it next
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if call := <-pauser.calls; call != "resume telemetry/4" {
+		t.Errorf("got %q on exit, want the partition resumed", call)
+	}
+	if got := pausedSeries(t); len(got) != 0 {
+		t.Errorf("paused gauge = %v after the claim ended, want no series", got)
+	}
+}
+
+// pausedSeries lists the partition paused gauge as "topic/partition=value".
+func pausedSeries(t *testing.T) []string {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	for _, mf := range families {
+		if mf.GetName() != "tigerscope_writer_partition_paused" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			series = append(series, fmt.Sprintf("%s/%s=%g", labels["topic"], labels["partition"], m.GetGauge().GetValue()))
+		}
+	}
+	return series
+}
+
+func TestWriteParquetSchemaVersionMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.parquet")
+	if err := writeParquet(path, []TelemetryEvent{testEvent("checkout", time.Now())}, testConfig().Parquet); err != nil {
+		t.Fatal(err)
+	}
+	_, pr := readParquet(t, path)
+	var found []string
+	for _, kv := range pr.Footer.KeyValueMetadata {
+		if kv.Key == parquetSchemaKey && kv.Value != nil {
+			found = append(found, *kv.Value)
+		}
+	}
+	if want := strconv.Itoa(parquetSchemaVersion); len(found) != 1 || found[0] != want {
+		t.Errorf("%s = %v, want exactly [%s]", parquetSchemaKey, found, want)
+	}
+}
+
+// blockingUploader holds every PutObject of a key ending in suffix until
+// release is closed.
+type blockingUploader struct {
+	fakeUploader
+	suffix  string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingUploader) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	if strings.HasSuffix(key, b.suffix) {
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return b.fakeUploader.PutObject(ctx, bucket, key, r, size, opts)
+}
+
+func TestFlushUploadsWithoutHoldingLock(t *testing.T) {
+	up := &blockingUploader{suffix: ".parquet", started: make(chan struct{}, 1), release: make(chan struct{})}
+	cfg := testConfig()
+	cfg.MaxBufferedEvents = 4
+	h := NewWriterHandler(up, jsonDeserializer{}, cfg)
+	key := bufferKey{env: "prod", topic: "telemetry", partition: 1}
+	other := bufferKey{env: "prod", topic: "telemetry", partition: 2}
+	now := time.Now()
+	addEvents(h, key, 10, testEvent("checkout", now), testEvent("checkout", now))
+
+	done := make(chan error)
+	go func() {
+		_, err := h.flush(context.Background(), key)
+		done <- err
+	}()
+	<-up.started
+
+	// With the upload stuck, other partitions (and this one) still buffer
+	added := make(chan struct{})
+	go func() {
+		addEvents(h, other, 10, testEvent("search", now))
+		addEvents(h, key, 10, testEvent("checkout", now))
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("add blocked behind an upload")
+	}
+	if !h.bufferFull() {
+		t.Error("bufferFull does not count the 2 events being uploaded")
+	}
+
+	close(up.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if buf := h.buffers[key]; len(buf.events) != 1 || buf.flushing || buf.inflight != 0 {
+		t.Errorf("buffer after flush: %d events, flushing=%v inflight=%d; want the event added during the upload", len(buf.events), buf.flushing, buf.inflight)
+	}
+	if keys := up.parquetKeys(); len(keys) != 1 {
+		t.Errorf("uploaded %v, want one file", keys)
+	}
+}
+
+func TestAddLeavesRetriesToTicker(t *testing.T) {
+	up := &fakeUploader{failOn: "service=checkout/"}
+	cfg := testConfig()
+	cfg.FlushEveryN = 2
+	h := NewWriterHandler(up, jsonDeserializer{}, cfg)
+	key := bufferKey{env: "prod", topic: "telemetry"}
+	now := time.Now()
+
+	add := func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.add(key, testEvent("checkout", now), msgSource{topic: "telemetry"}, 10)
+	}
+	if add() || !add() {
+		t.Fatal("add should report the buffer full at FLUSH_EVERY_N")
+	}
+	if _, err := h.flush(context.Background(), key); err == nil {
+		t.Fatal("flush succeeded despite a failed upload")
+	}
+	if add() {
+		t.Error("add asked for a flush right after one failed")
+	}
+
+	// The ticker's retry succeeds and add resumes size-based flushes
+	up.failOn = ""
+	if _, err := h.flush(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if add() || !add() {
+		t.Error("add did not resume after a successful flush")
+	}
+}
+
+// slowUploader stands in for MinIO with a fixed round-trip latency.
+type slowUploader struct {
+	fakeUploader
+	latency time.Duration
+}
+
+func (s *slowUploader) PutObject(ctx context.Context, bucket, key string, r io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	time.Sleep(s.latency)
+	return s.fakeUploader.PutObject(ctx, bucket, key, r, size, opts)
+}
+
+// BenchmarkFlushParallelUpload flushes a batch spanning eight services, so
+// eight files, against a store with 20ms uploads.
+func BenchmarkFlushParallelUpload(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	events := benchBatch(500)
+	for i := range events {
+		events[i].Service = fmt.Sprintf("svc-%d", i%8)
+	}
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		cfg := testConfig()
+		cfg.FlushEveryN = len(events)
+		cfg.UploadParallelism = parallelism
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			h := NewWriterHandler(&slowUploader{latency: 20 * time.Millisecond}, jsonDeserializer{}, cfg)
+			key := bufferKey{env: "prod", topic: "telemetry"}
+			for i := 0; i < b.N; i++ {
+				addEvents(h, key, 100, events...)
+				if _, err := h.flush(context.Background(), key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteParquetColumnEncodings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.parquet")
+	if err := writeParquet(path, benchBatch(1000), testConfig().Parquet); err != nil {
+		t.Fatal(err)
+	}
+	_, pr := readParquet(t, path)
+
+	// Check the column chunks actually written, not just the struct tags. The
+	// reader reports PathInSchema with the Go field names.
+	dictionary := map[string]bool{}
+	for _, col := range pr.Footer.RowGroups[0].Columns {
+		name := strings.Join(col.MetaData.PathInSchema, ".")
+		dictionary[name] = col.MetaData.DictionaryPageOffset != nil &&
+			slices.Contains(col.MetaData.Encodings, parquet.Encoding_PLAIN_DICTIONARY)
+	}
+	for col, want := range map[string]bool{"CustomerID": true, "Error": true, "TraceID": false} {
+		got, ok := dictionary[col]
+		if !ok {
+			t.Fatalf("no %s column chunk in %v", col, dictionary)
+		}
+		if got != want {
+			t.Errorf("%s dictionary-encoded = %v, want %v", col, got, want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Partition manifests let batch consumers (Spark, Athena, ...) see which
+// parquet files in a service/date/hour partition are committed. Each writer
+// process owns one manifest per partition, _manifest-<id>.json, so concurrent
+// writers never contend. The union of all manifests in a partition is its
+// committed file set. Once an hour has been closed for
+// MANIFEST_SEAL_GRACE_SECS the writer also drops an empty _SUCCESS marker.
+//
+// A manifest is updated by reading the stored object back and adding to it,
+// never rewritten from memory: the compactor strips merged files from it, and
+// late events, retries and spill drains keep uploading into hours that were
+// already sealed. An upload into a closed hour removes its _SUCCESS first, and
+// the hour is sealed again on the next pass with the new file listed.
+type manifestTracker struct {
+	id string
+
+	// mu serialises manifest updates, each a read-modify-write of the stored
+	// object. It is never held together with h.mu.
+	mu sync.Mutex
+	// partition dir -> keys uploaded since the dir was last sealed that are
+	// not in the stored manifest yet. An entry, even an empty one, marks the
+	// dir for sealing.
+	unsealed map[string][]string
+}
+
+type partitionManifest struct {
+	Writer  string    `json:"writer"`
+	Updated time.Time `json:"updated"`
+	Files   []string  `json:"files"`
+}
+
+func newManifestTracker() *manifestTracker {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "writer"
+	}
+	// The random suffix keeps a restarted process from overwriting the
+	// manifest of its previous incarnation, which it no longer remembers.
+	return &manifestTracker{
+		id:       host + "-" + randomHex(4),
+		unsealed: make(map[string][]string),
+	}
+}
+
+// recordUpload adds key to its partition's manifest. A failed manifest update
+// is only logged: the key stays pending and goes in with the next upload to
+// the partition, or before it is sealed. Callers must not hold h.mu.
+func (h *WriterHandler) recordUpload(ctx context.Context, key string) {
+	m := h.manifests
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir := path.Dir(key)
+	if sealDue(dir, h.sealCutoff()) {
+		// The hour may already be sealed, by this writer or another; it is no
+		// longer complete until the new file is listed and it is sealed again
+		err := h.minio.RemoveObject(ctx, h.cfg.MinIOBucket, dir+"/_SUCCESS", minio.RemoveObjectOptions{})
+		if err != nil {
+			log.Printf("removing _SUCCESS for %s failed: %v", dir, err)
+		}
+	}
+	m.unsealed[dir] = append(m.unsealed[dir], key)
+	if err := h.syncManifest(ctx, dir); err != nil {
+		log.Printf("manifest update for %s failed: %v", dir, err)
+	}
+}
+
+// syncManifest merges dir's pending keys into its stored manifest. Callers
+// must hold h.manifests.mu.
+func (h *WriterHandler) syncManifest(ctx context.Context, dir string) error {
+	m := h.manifests
+	pending := m.unsealed[dir]
+	if len(pending) == 0 {
+		return nil
+	}
+	key := dir + "/_manifest-" + m.id + ".json"
+	stored, err := readManifest(ctx, h.minio, h.cfg.MinIOBucket, key)
+	if err != nil {
+		return err
+	}
+
+	files := append(stored.Files, pending...)
+	sort.Strings(files)
+	files = slices.Compact(files)
+	b, err := json.Marshal(partitionManifest{Writer: m.id, Updated: time.Now().UTC(), Files: files})
+	if err != nil {
+		return err
+	}
+	_, err = h.minio.PutObject(ctx, h.cfg.MinIOBucket, key, bytes.NewReader(b), int64(len(b)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	if err != nil {
+		return err
+	}
+	m.unsealed[dir] = nil
+	return nil
+}
+
+// readManifest returns the manifest stored at key, or an empty one if there
+// is none yet.
+func readManifest(ctx context.Context, store objectStore, bucket, key string) (partitionManifest, error) {
+	var m partitionManifest
+	tmpDir, err := os.MkdirTemp("", "tigerscope-manifest-")
+	if err != nil {
+		return m, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile := filepath.Join(tmpDir, "manifest.json")
+	err = store.FGetObject(ctx, bucket, key, tmpFile, minio.GetObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	b, err := os.ReadFile(tmpFile)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", key, err)
+	}
+	return m, nil
+}
+
+// sealCutoff is the end time an hour must be older than to be sealed.
+func (h *WriterHandler) sealCutoff() time.Time {
+	return time.Now().UTC().Add(-time.Duration(h.cfg.ManifestSealGraceSecs) * time.Second)
+}
+
+// sealDue reports whether the hour partition dir ended before cutoff.
+func sealDue(dir string, cutoff time.Time) bool {
+	start, ok := partitionHour(dir)
+	return ok && !start.Add(time.Hour).After(cutoff)
+}
+
+// sealPartitions seals the partitions this process wrote to once a minute
+// until ctx ends.
+func (h *WriterHandler) sealPartitions(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.sealPass(ctx, h.sealCutoff())
+	}
+}
+
+// sealPass writes _SUCCESS into every partition this process wrote to whose
+// hour ended before cutoff, once its pending keys are in the manifest, then
+// forgets the partition.
+func (h *WriterHandler) sealPass(ctx context.Context, cutoff time.Time) {
+	m := h.manifests
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := range m.unsealed {
+		if !sealDue(dir, cutoff) {
+			continue
+		}
+		if err := h.syncManifest(ctx, dir); err != nil {
+			log.Printf("manifest update for %s failed: %v", dir, err)
+			continue
+		}
+		_, err := h.minio.PutObject(ctx, h.cfg.MinIOBucket, dir+"/_SUCCESS", bytes.NewReader(nil), 0,
+			minio.PutObjectOptions{ContentType: "application/octet-stream"})
+		if err != nil {
+			log.Printf("writing _SUCCESS for %s failed: %v", dir, err)
+			continue
+		}
+		delete(m.unsealed, dir)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// storedManifest decodes this writer's manifest for dir, failing the test if
+// there is none.
+func storedManifest(t *testing.T, h *WriterHandler, up *fakeUploader, dir string) []string {
+	t.Helper()
+	b, ok := up.object(dir + "/_manifest-" + h.manifests.id + ".json")
+	if !ok {
+		t.Fatalf("no manifest in %s", dir)
+	}
+	var m partitionManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Files
+}
+
+func TestManifestSurvivesSeal(t *testing.T) {
+	up := &fakeUploader{}
+	cfg := testConfig()
+	cfg.ManifestSealGraceSecs = 300
+	h := NewWriterHandler(up, jsonDeserializer{}, cfg)
+	ctx := context.Background()
+	dir := "telemetry/parquet/service=checkout/date=2024-05-01/hour=13"
+
+	h.recordUpload(ctx, dir+"/batch-p0-a.parquet")
+	h.sealPass(ctx, time.Now())
+	if _, ok := up.object(dir + "/_SUCCESS"); !ok {
+		t.Fatal("closed hour not sealed")
+	}
+
+	// A late upload into the sealed hour unseals it, and must not drop the
+	// files committed before the seal
+	h.recordUpload(ctx, dir+"/batch-p0-b.parquet")
+	if _, ok := up.object(dir + "/_SUCCESS"); ok {
+		t.Error("_SUCCESS kept after a file was added to the hour")
+	}
+	want := []string{dir + "/batch-p0-a.parquet", dir + "/batch-p0-b.parquet"}
+	if got := storedManifest(t, h, up, dir); !slices.Equal(got, want) {
+		t.Errorf("manifest = %v, want %v", got, want)
+	}
+
+	h.sealPass(ctx, time.Now())
+	if _, ok := up.object(dir + "/_SUCCESS"); !ok {
+		t.Error("hour not sealed again after the late upload")
+	}
+}
+
+func TestSealPassSkipsOpenHours(t *testing.T) {
+	up := &fakeUploader{}
+	h := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	ctx := context.Background()
+	hour := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	dir := "telemetry/parquet/service=checkout/date=2024-05-01/hour=13"
+	h.recordUpload(ctx, dir+"/batch-p0-a.parquet")
+
+	h.sealPass(ctx, hour.Add(59*time.Minute))
+	if _, ok := up.object(dir + "/_SUCCESS"); ok {
+		t.Fatal("sealed an hour that had not ended before the cutoff")
+	}
+	h.sealPass(ctx, hour.Add(time.Hour))
+	if _, ok := up.object(dir + "/_SUCCESS"); !ok {
+		t.Fatal("hour not sealed once it ended before the cutoff")
+	}
+}
+
+func TestManifestFailedWriteStaysPending(t *testing.T) {
+	up := &fakeUploader{failOn: "_manifest-"}
+	h := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	ctx := context.Background()
+	dir := "telemetry/parquet/service=checkout/date=2024-05-01/hour=13"
+
+	h.recordUpload(ctx, dir+"/batch-p0-a.parquet")
+	h.sealPass(ctx, time.Now())
+	if _, ok := up.object(dir + "/_SUCCESS"); ok {
+		t.Fatal("sealed an hour whose manifest could not be written")
+	}
+
+	up.mu.Lock()
+	up.failOn = ""
+	up.mu.Unlock()
+	h.sealPass(ctx, time.Now())
+	if got := storedManifest(t, h, up, dir); !slices.Equal(got, []string{dir + "/batch-p0-a.parquet"}) {
+		t.Errorf("manifest = %v, want the key whose first write failed", got)
+	}
+	if _, ok := up.object(dir + "/_SUCCESS"); !ok {
+		t.Error("hour not sealed once its manifest was written")
+	}
+}
+
+func TestFlushWritesManifestWithoutHoldingLock(t *testing.T) {
+	up := &blockingUploader{suffix: ".json", started: make(chan struct{}, 1), release: make(chan struct{})}
+	h := NewWriterHandler(up, jsonDeserializer{}, testConfig())
+	key := bufferKey{env: "prod", topic: "telemetry", partition: 1}
+	addEvents(h, key, 10, testEvent("checkout", time.Now()))
+
+	done := make(chan error)
+	go func() {
+		_, err := h.flush(context.Background(), key)
+		done <- err
+	}()
+	<-up.started
+
+	if !h.mu.TryLock() {
+		t.Error("h.mu held while the manifest is written")
+	} else {
+		h.mu.Unlock()
+	}
+	close(up.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
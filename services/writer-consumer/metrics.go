@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	bufferedEvents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tigerscope_writer_buffered_events",
+		Help: "Events held in memory waiting for the next flush.",
+	}, []string{"environment"})
+	flushedBatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tigerscope_writer_flushed_batches_total",
+		Help: "Parquet files uploaded to MinIO.",
+	})
+	flushedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tigerscope_writer_flushed_events_total",
+		Help: "Events written to uploaded parquet files.",
+	})
+	parquetFileBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tigerscope_writer_parquet_file_bytes",
+		Help:    "Size of uploaded parquet files.",
+		Buckets: prometheus.ExponentialBuckets(4*1024, 4, 8), // 4KiB .. 64MiB
+	})
+	uploadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tigerscope_writer_upload_failures_total",
+		Help: "Failed parquet uploads to MinIO.",
+	})
+	spilledFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tigerscope_writer_spilled_files_total",
+		Help: "Parquet files written to SPILL_DIR after an upload failed.",
+	})
+	spillBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tigerscope_writer_spill_bytes",
+		Help: "Bytes waiting in SPILL_DIR to be uploaded.",
+	})
+	consumerPaused = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tigerscope_writer_partition_paused",
+		Help: "1 while a partition is paused because MAX_BUFFERED_EVENTS is reached.",
+	}, []string{"topic", "partition"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(bufferedEvents, flushedBatches, flushedEvents, parquetFileBytes, uploadFailures, spilledFiles, spillBytes, consumerPaused)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
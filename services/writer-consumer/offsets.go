@@ -0,0 +1,71 @@
+package main
+
+import "github.com/IBM/sarama"
+
+// msgSource identifies the Kafka message a buffered event came from.
+type msgSource struct {
+	topic     string
+	partition int32
+	offset    int64
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// offsetTracker keeps offsets uncommitted until their events are in MinIO.
+// A partition is marked no further than its oldest message that is still only
+// held in memory, which gives at-least-once delivery: a crash re-consumes (and
+// may duplicate) anything not yet uploaded, but never loses it.
+//
+// offsetTracker is not safe for concurrent use; WriterHandler guards it with h.mu.
+type offsetTracker struct {
+	pending map[topicPartition]map[int64]struct{}
+	next    map[topicPartition]int64 // one past the highest offset seen
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		pending: make(map[topicPartition]map[int64]struct{}),
+		next:    make(map[topicPartition]int64),
+	}
+}
+
+// hold records a consumed message whose event has not been uploaded yet.
+func (t *offsetTracker) hold(src msgSource) {
+	tp := topicPartition{src.topic, src.partition}
+	if t.pending[tp] == nil {
+		t.pending[tp] = make(map[int64]struct{})
+	}
+	t.pending[tp][src.offset] = struct{}{}
+	t.seen(src)
+}
+
+// release marks a held message as durably handled.
+func (t *offsetTracker) release(src msgSource) {
+	tp := topicPartition{src.topic, src.partition}
+	delete(t.pending[tp], src.offset)
+	t.seen(src)
+}
+
+func (t *offsetTracker) seen(src msgSource) {
+	tp := topicPartition{src.topic, src.partition}
+	if n, ok := t.next[tp]; !ok || src.offset+1 > n {
+		t.next[tp] = src.offset + 1
+	}
+}
+
+// mark advances the session's offsets as far as every partition allows.
+// Offsets only move forward, so re-marking an unchanged position is harmless.
+func (t *offsetTracker) mark(sess sarama.ConsumerGroupSession) {
+	for tp, next := range t.next {
+		commit := next
+		for off := range t.pending[tp] {
+			if off < commit {
+				commit = off
+			}
+		}
+		sess.MarkOffset(tp.topic, tp.partition, commit, "")
+	}
+}
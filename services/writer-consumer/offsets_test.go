@@ -0,0 +1,86 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+// markSession records the last offset marked per partition.
+type markSession struct {
+	fakeSession
+	marks map[topicPartition]int64
+}
+
+func (s *markSession) MarkOffset(topic string, p int32, off int64, m string) {
+	s.marks[topicPartition{topic, p}] = off
+}
+
+func TestOffsetTrackerMark(t *testing.T) {
+	type step struct {
+		release bool // hold otherwise
+		src     msgSource
+	}
+	hold := func(topic string, p int32, offs ...int64) []step {
+		var steps []step
+		for _, off := range offs {
+			steps = append(steps, step{false, msgSource{topic, p, off}})
+		}
+		return steps
+	}
+	release := func(topic string, p int32, offs ...int64) []step {
+		steps := hold(topic, p, offs...)
+		for i := range steps {
+			steps[i].release = true
+		}
+		return steps
+	}
+	seq := func(parts ...[]step) []step {
+		var steps []step
+		for _, p := range parts {
+			steps = append(steps, p...)
+		}
+		return steps
+	}
+	t0 := topicPartition{"telemetry", 0}
+	t1 := topicPartition{"telemetry", 1}
+	other := topicPartition{"audit", 0}
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  map[topicPartition]int64
+	}{
+		{"nothing uploaded", hold("telemetry", 0, 0, 1, 2), map[topicPartition]int64{t0: 0}},
+		{"low offsets uploaded", seq(hold("telemetry", 0, 0, 1, 2), release("telemetry", 0, 0, 1)), map[topicPartition]int64{t0: 2}},
+		{"everything uploaded", seq(hold("telemetry", 0, 0, 1, 2), release("telemetry", 0, 0, 1, 2)), map[topicPartition]int64{t0: 3}},
+		// a later file uploaded first must not move the mark past the
+		// earlier file still in memory
+		{"later file first", seq(hold("telemetry", 0, 0, 1, 2, 3, 4), release("telemetry", 0, 2, 3)), map[topicPartition]int64{t0: 0}},
+		{"gap left by later file", seq(hold("telemetry", 0, 0, 1, 2, 3, 4), release("telemetry", 0, 3, 4, 0, 1)), map[topicPartition]int64{t0: 2}},
+		{"gap filled", seq(hold("telemetry", 0, 0, 1, 2, 3, 4), release("telemetry", 0, 3, 4, 0, 1, 2)), map[topicPartition]int64{t0: 5}},
+		// undecodable messages are released without ever being held
+		{"skipped message behind held ones", seq(hold("telemetry", 0, 3, 4), release("telemetry", 0, 5)), map[topicPartition]int64{t0: 3}},
+		{"only skipped messages", release("telemetry", 0, 7, 8), map[topicPartition]int64{t0: 9}},
+		{"partitions independent", seq(hold("telemetry", 0, 0, 1), hold("telemetry", 1, 0, 1), release("telemetry", 1, 0, 1)),
+			map[topicPartition]int64{t0: 0, t1: 2}},
+		{"topics independent", seq(hold("telemetry", 0, 4), hold("audit", 0, 4), release("audit", 0, 4)),
+			map[topicPartition]int64{t0: 4, other: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ot := newOffsetTracker()
+			for _, s := range tt.steps {
+				if s.release {
+					ot.release(s.src)
+				} else {
+					ot.hold(s.src)
+				}
+			}
+			sess := &markSession{marks: map[topicPartition]int64{}}
+			ot.mark(sess)
+			if !maps.Equal(sess.marks, tt.want) {
+				t.Errorf("marked %v, want %v", sess.marks, tt.want)
+			}
+		})
+	}
+}
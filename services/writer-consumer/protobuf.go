@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/proto"
+
+	"tigerscope/writer-consumer/gen/telemetryv1"
+)
+
+//go:generate protoc -I../../proto --go_out=. --go_opt=module=tigerscope/writer-consumer --go_opt=Mtelemetry/v1/event.proto=tigerscope/writer-consumer/gen/telemetryv1 telemetry/v1/event.proto
+
+// protobufDeserializer decodes the tigerscope.telemetry.v1.TelemetryEvent
+// messages ingestion-api publishes with MESSAGE_FORMAT=protobuf.
+type protobufDeserializer struct{}
+
+func (protobufDeserializer) Decode(value []byte, _ []*sarama.RecordHeader) (TelemetryEvent, error) {
+	r, err := unmarshalProtobuf(value)
+	if err != nil {
+		return TelemetryEvent{}, err
+	}
+	return parseRaw(r)
+}
+
+// unmarshalProtobuf decodes into rawEvent so both formats share parseRaw's
+// schema_version handling. Timestamps are rendered back to RFC3339; an unset
+// one is left empty, which parseRaw treats like a missing JSON timestamp.
+// Unknown fields are skipped, so producers may add fields first.
+func unmarshalProtobuf(b []byte) (rawEvent, error) {
+	var pb telemetryv1.TelemetryEvent
+	if err := proto.Unmarshal(b, &pb); err != nil {
+		return rawEvent{}, err
+	}
+	return rawEvent{
+		Timestamp:    formatMillis(pb.GetTimestampMs()),
+		Service:      pb.GetService(),
+		CustomerID:   pb.GetCustomerId(),
+		Endpoint:     pb.GetEndpoint(),
+		Method:       pb.GetMethod(),
+		StatusCode:   pb.GetStatusCode(),
+		LatencyMs:    pb.GetLatencyMs(),
+		TraceID:      pb.GetTraceId(),
+		Error:        pb.GetError(),
+		Environment:  pb.GetEnvironment(),
+		SchemaVer:    pb.GetSchemaVersion(),
+		IngestedAt:   formatMillis(pb.GetIngestedAtMs()),
+		Attributes:   pb.GetAttributes(),
+		SamplingRate: pb.GetSamplingRate(),
+		RequestID:    pb.GetRequestId(),
+	}, nil
+}
+
+func formatMillis(ms int64) string {
+	if ms == 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339Nano)
+}
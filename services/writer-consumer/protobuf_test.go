@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"tigerscope/writer-consumer/gen/telemetryv1"
+)
+
+// TestProtobufMatchesJSON decodes the same event from both formats, the way
+// ingestion-api publishes them, and expects identical rows.
+func TestProtobufMatchesJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		event rawEvent
+	}{
+		{"full", rawEvent{
+			Timestamp: "2024-05-01T13:00:00.123Z", Service: "checkout", CustomerID: "c1",
+			Endpoint: "/pay", Method: "POST", StatusCode: 502, LatencyMs: 931, TraceID: "t-1",
+			Error: "upstream timeout", Environment: "prod", SchemaVer: 2,
+			IngestedAt: "2024-05-01T13:00:01Z", SamplingRate: 0.25, RequestID: "r-1",
+			Attributes: map[string]string{"region": "eu-west-1", "build": "1234"},
+		}},
+		{"minimal", rawEvent{
+			Timestamp: "2024-05-01T13:00:00Z", Service: "search", Endpoint: "/q", Method: "GET",
+			StatusCode: 200, SchemaVer: 2, IngestedAt: "2024-05-01T13:00:00Z", SamplingRate: 1,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js, err := json.Marshal(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromJSON, err := jsonDeserializer{}.Decode(js, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pb, err := proto.Marshal(&telemetryv1.TelemetryEvent{
+				TimestampMs:   fromJSON.Timestamp,
+				Service:       tt.event.Service,
+				CustomerId:    tt.event.CustomerID,
+				Endpoint:      tt.event.Endpoint,
+				Method:        tt.event.Method,
+				StatusCode:    tt.event.StatusCode,
+				LatencyMs:     tt.event.LatencyMs,
+				TraceId:       tt.event.TraceID,
+				Error:         tt.event.Error,
+				Attributes:    tt.event.Attributes,
+				RequestId:     tt.event.RequestID,
+				IngestedAtMs:  fromJSON.IngestedAt,
+				SchemaVersion: tt.event.SchemaVer,
+				Environment:   tt.event.Environment,
+				SamplingRate:  tt.event.SamplingRate,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromProto, err := protobufDeserializer{}.Decode(pb, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fromProto, fromJSON) {
+				t.Errorf("protobuf decoded\n%+v\nJSON decoded\n%+v", fromProto, fromJSON)
+			}
+		})
+	}
+}
+
+func TestUnmarshalProtobufSkipsUnknownFields(t *testing.T) {
+	b, err := proto.Marshal(&telemetryv1.TelemetryEvent{Service: "checkout", StatusCode: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A field from a newer producer
+	b = protowire.AppendTag(b, 99, protowire.BytesType)
+	b = protowire.AppendString(b, "future")
+
+	r, err := unmarshalProtobuf(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Service != "checkout" || r.StatusCode != 200 {
+		t.Errorf("decoded %+v", r)
+	}
+}
+
+func TestUnmarshalProtobufRejectsGarbage(t *testing.T) {
+	if _, err := unmarshalProtobuf([]byte{0x0a, 0xff}); err == nil {
+		t.Error("decoded a truncated message without error")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/minio/minio-go/v7"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// replayOptions are the flags of `writer-consumer replay`.
+type replayOptions struct {
+	From, To time.Time
+	Topic    string
+	Service  string  // optional exact service filter
+	Rate     float64 // events per second; 0 means as fast as Kafka accepts
+}
+
+func parseReplayFlags(args []string) (replayOptions, error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := fs.String("from", "", "start of the range, RFC3339 (required)")
+	to := fs.String("to", "", "end of the range, RFC3339 (default now)")
+	topic := fs.String("topic", "", "Kafka topic to publish to (required)")
+	service := fs.String("service", "", "only replay this service")
+	rate := fs.Float64("rate", 1000, "events per second (0 = unlimited)")
+	if err := fs.Parse(args); err != nil {
+		return replayOptions{}, err
+	}
+
+	opts := replayOptions{Topic: *topic, Service: *service, Rate: *rate, To: time.Now().UTC()}
+	if *from == "" || *topic == "" {
+		return opts, fmt.Errorf("-from and -topic are required")
+	}
+	var err error
+	if opts.From, err = time.Parse(time.RFC3339, *from); err != nil {
+		return opts, fmt.Errorf("-from: %w", err)
+	}
+	if *to != "" {
+		if opts.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return opts, fmt.Errorf("-to: %w", err)
+		}
+	}
+	if !opts.From.Before(opts.To) {
+		return opts, fmt.Errorf("-from must be before -to")
+	}
+	return opts, nil
+}
+
+// replayer publishes stored events back to Kafka in the JSON layout
+// ingestion-api produces, keeping their original timestamps and request IDs.
+// Events replayed while the originals are still stored show up twice;
+// query-api's ?dedup=true collapses them by request_id.
+type replayer struct {
+	minio    *minio.Client
+	producer sarama.SyncProducer
+	cfg      Config
+	opts     replayOptions
+}
+
+func (r *replayer) run(ctx context.Context) (int, error) {
+	keys, err := r.files(ctx)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("replay: %d files overlap %s - %s", len(keys), r.opts.From.Format(time.RFC3339), r.opts.To.Format(time.RFC3339))
+
+	tmpDir, err := os.MkdirTemp("", "tigerscope-replay-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	start := time.Now()
+	sent := 0
+	for _, key := range keys {
+		n, err := r.replayFile(ctx, tmpDir, key, start, sent)
+		sent += n
+		if err != nil {
+			return sent, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return sent, nil
+}
+
+// files lists the parquet objects whose hour partition overlaps the range.
+func (r *replayer) files(ctx context.Context) ([]string, error) {
+	first := r.opts.From.UTC().Truncate(time.Hour)
+	var keys []string
+	opts := minio.ListObjectsOptions{Prefix: "telemetry/parquet/", Recursive: true}
+	for obj := range r.minio.ListObjects(ctx, r.cfg.MinIOBucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if !strings.HasSuffix(obj.Key, ".parquet") {
+			continue
+		}
+		hour, ok := partitionHour(path.Dir(obj.Key))
+		if !ok || hour.Before(first) || hour.After(r.opts.To) {
+			continue
+		}
+		if r.opts.Service != "" && !strings.Contains(obj.Key, "/service="+partitionValue(r.opts.Service)+"/") {
+			continue
+		}
+		keys = append(keys, obj.Key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// replayFile publishes the in-range rows of one object, pacing against the
+// whole run so -rate holds across files.
+func (r *replayer) replayFile(ctx context.Context, tmpDir, key string, start time.Time, sentBefore int) (int, error) {
+	src := filepath.Join(tmpDir, "replay.parquet")
+	if err := r.minio.FGetObject(ctx, r.cfg.MinIOBucket, key, src, minio.GetObjectOptions{}); err != nil {
+		return 0, err
+	}
+	defer os.Remove(src)
+
+	fr, err := local.NewLocalFileReader(src)
+	if err != nil {
+		return 0, err
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(TelemetryEvent), 4)
+	if err != nil {
+		return 0, err
+	}
+	defer pr.ReadStop()
+
+	from, to := r.opts.From.UnixMilli(), r.opts.To.UnixMilli()
+	const batch = 500
+	sent := 0
+	remaining := pr.GetNumRows()
+	for remaining > 0 {
+		n := min(remaining, batch)
+		events := make([]TelemetryEvent, n)
+		if err := pr.Read(&events); err != nil {
+			return sent, err
+		}
+		remaining -= n
+
+		var msgs []*sarama.ProducerMessage
+		for _, ev := range events {
+			if ev.Timestamp < from || ev.Timestamp > to {
+				continue
+			}
+			if r.opts.Service != "" && ev.Service != r.opts.Service {
+				continue
+			}
+			msg, err := r.message(ev)
+			if err != nil {
+				return sent, err
+			}
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		if err := r.pace(ctx, start, sentBefore+sent+len(msgs)); err != nil {
+			return sent, err
+		}
+		if err := r.producer.SendMessages(msgs); err != nil {
+			return sent, err
+		}
+		sent += len(msgs)
+	}
+	return sent, nil
+}
+
+// pace waits until publishing total events since start stays within -rate.
+func (r *replayer) pace(ctx context.Context, start time.Time, total int) error {
+	if r.opts.Rate <= 0 {
+		return ctx.Err()
+	}
+	due := start.Add(time.Duration(float64(total) / r.opts.Rate * float64(time.Second)))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(due)):
+		return nil
+	}
+}
+
+// message rebuilds the Kafka record ingestion-api would have produced.
+func (r *replayer) message(ev TelemetryEvent) (*sarama.ProducerMessage, error) {
+	raw := rawEvent{
+		Timestamp:    time.UnixMilli(ev.Timestamp).UTC().Format(time.RFC3339Nano),
+		Service:      ev.Service,
+		CustomerID:   ev.CustomerID,
+		Endpoint:     ev.Endpoint,
+		Method:       ev.Method,
+		StatusCode:   ev.StatusCode,
+		LatencyMs:    ev.LatencyMs,
+		TraceID:      ev.TraceID,
+		Error:        ev.Error,
+		Environment:  ev.Environment,
+		SchemaVer:    ev.SchemaVer,
+		IngestedAt:   time.UnixMilli(ev.IngestedAt).UTC().Format(time.RFC3339Nano),
+		Attributes:   ev.Attributes,
+		SamplingRate: ev.SamplingRate,
+		RequestID:    ev.RequestID,
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.ProducerMessage{
+		Topic: r.opts.Topic,
+		Key:   sarama.StringEncoder(ev.CustomerID),
+		Value: sarama.ByteEncoder(b),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("service"), Value: []byte(ev.Service)},
+			{Key: []byte("env"), Value: []byte(ev.Environment)},
+			{Key: []byte(formatHeader), Value: []byte("json")},
+			{Key: []byte("replayed"), Value: []byte("true")},
+		},
+	}, nil
+}
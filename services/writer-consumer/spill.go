@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// spillMeta is stored next to each spilled parquet file so the drainer can
+// upload it under its original key and tags.
+type spillMeta struct {
+	Key  string            `json:"key"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// spill moves a parquet file that could not be uploaded into SPILL_DIR, as
+// <id>.parquet plus <id>.json. The metadata is written first and the parquet
+// file moved in last, so the drainer never sees a file without its key.
+// Spilling fails once the directory holds SpillMaxBytes, leaving the events
+// buffered in memory (and, past MAX_BUFFERED_EVENTS, pausing consumption).
+func (h *WriterHandler) spill(src, key string, tags map[string]string, size int64) error {
+	h.spillMu.Lock()
+	defer h.spillMu.Unlock()
+	used, err := dirSize(h.cfg.SpillDir)
+	if err != nil {
+		return err
+	}
+	if used+size > h.cfg.SpillMaxBytes {
+		return fmt.Errorf("spill dir full (%d of %d bytes used)", used, h.cfg.SpillMaxBytes)
+	}
+
+	id := fmt.Sprintf("%d-%s", time.Now().UnixNano(), randomHex(4))
+	meta, err := json.Marshal(spillMeta{Key: key, Tags: tags})
+	if err != nil {
+		return err
+	}
+	metaPath := filepath.Join(h.cfg.SpillDir, id+".json")
+	if err := os.WriteFile(metaPath, meta, 0o644); err != nil {
+		return err
+	}
+	if err := moveFile(src, filepath.Join(h.cfg.SpillDir, id+".parquet")); err != nil {
+		os.Remove(metaPath)
+		return err
+	}
+
+	spilledFiles.Inc()
+	spillBytes.Set(float64(used + size))
+	return nil
+}
+
+// drainSpill uploads spilled files, oldest first, every interval until ctx
+// ends. A failed upload stops the pass; the next one retries from there.
+func (h *WriterHandler) drainSpill(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := h.drainSpillOnce(ctx); err != nil {
+			log.Printf("spill drain stopped after %d files: %v", n, err)
+		} else if n > 0 {
+			log.Printf("spill drain uploaded %d files", n)
+		}
+		if used, err := dirSize(h.cfg.SpillDir); err == nil {
+			spillBytes.Set(float64(used))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainSpillOnce uploads every spilled file, oldest first, and reports how many
+// went up before the first failure. It runs without h.mu, so consumers keep
+// buffering while it works through a backlog.
+func (h *WriterHandler) drainSpillOnce(ctx context.Context) (int, error) {
+	files, err := filepath.Glob(filepath.Join(h.cfg.SpillDir, "*.parquet"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(files) // ids start with a timestamp
+
+	uploaded := 0
+	for _, path := range files {
+		metaPath := strings.TrimSuffix(path, ".parquet") + ".json"
+		b, err := os.ReadFile(metaPath)
+		if err != nil {
+			return uploaded, err
+		}
+		var meta spillMeta
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return uploaded, fmt.Errorf("%s: %w", metaPath, err)
+		}
+
+		opts := minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			UserTags:    meta.Tags,
+		}
+		if err := h.putFile(ctx, meta.Key, path, opts); err != nil {
+			return uploaded, err
+		}
+		// Recorded before the spilled copy goes, so a crash in between
+		// re-uploads the same key rather than leaving it out of the manifest
+		h.recordUpload(ctx, meta.Key)
+		os.Remove(path)
+		os.Remove(metaPath)
+		uploaded++
+	}
+	return uploaded, nil
+}
+
+// putFile makes a single upload attempt; drain passes are the retry loop.
+func (h *WriterHandler) putFile(ctx context.Context, key, path string, opts minio.PutObjectOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = h.minio.PutObject(ctx, h.cfg.MinIOBucket, key, f, fi.Size(), opts)
+	return err
+}
+
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+// moveFile renames src to dst, falling back to copy-and-delete when they are on
+// different filesystems (the temp dir usually isn't the spill volume).
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".partial"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func spillConfig(t *testing.T) Config {
+	cfg := testConfig()
+	cfg.SpillDir = t.TempDir()
+	cfg.SpillMaxBytes = 1 << 20
+	return cfg
+}
+
+// spillSource writes a file of size bytes to be spilled.
+func spillSource(t *testing.T, size int) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "batch.parquet")
+	if err := os.WriteFile(src, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+// spilled returns the names in the spill dir, sorted.
+func spilled(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestSpillMovesFileWithMeta(t *testing.T) {
+	h := NewWriterHandler(&fakeUploader{}, jsonDeserializer{}, spillConfig(t))
+	src := spillSource(t, 100)
+	tags := map[string]string{retentionTag: "7"}
+	if err := h.spill(src, "telemetry/parquet/k.parquet", tags, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still in place after spilling (stat err %v)", err)
+	}
+	names := spilled(t, h.cfg.SpillDir)
+	if len(names) != 2 || !strings.HasSuffix(names[0], ".json") || !strings.HasSuffix(names[1], ".parquet") ||
+		strings.TrimSuffix(names[0], ".json") != strings.TrimSuffix(names[1], ".parquet") {
+		t.Fatalf("spill dir holds %v, want one <id>.parquet and its <id>.json", names)
+	}
+	b, err := os.ReadFile(filepath.Join(h.cfg.SpillDir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta spillMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Key != "telemetry/parquet/k.parquet" || meta.Tags[retentionTag] != "7" {
+		t.Errorf("meta = %+v, want the original key and tags", meta)
+	}
+}
+
+func TestSpillRefusedPastCap(t *testing.T) {
+	cfg := spillConfig(t)
+	cfg.SpillMaxBytes = 150
+	h := NewWriterHandler(&fakeUploader{}, jsonDeserializer{}, cfg)
+	if err := h.spill(spillSource(t, 100), "k1", nil, 100); err != nil {
+		t.Fatal(err)
+	}
+	before := spilled(t, cfg.SpillDir)
+
+	src := spillSource(t, 100)
+	if err := h.spill(src, "k2", nil, 100); err == nil {
+		t.Fatal("spill past SpillMaxBytes succeeded")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("refused spill lost its source: %v", err)
+	}
+	if after := spilled(t, cfg.SpillDir); !slices.Equal(after, before) {
+		t.Errorf("spill dir changed from %v to %v on a refused spill", before, after)
+	}
+}
+
+func TestFlushSpillsFailedUploads(t *testing.T) {
+	up := &fakeUploader{failOn: ".parquet"}
+	h := NewWriterHandler(up, jsonDeserializer{}, spillConfig(t))
+	key := bufferKey{env: "prod", topic: "telemetry", partition: 1}
+	addEvents(h, key, 10, testEvent("checkout", time.Now()), testEvent("checkout", time.Now()))
+
+	// A spilled file counts as flushed: the events are on disk, not in memory
+	n, err := h.flush(context.Background(), key)
+	if err != nil || n != 2 {
+		t.Fatalf("flush = %d, %v; want 2 events and no error", n, err)
+	}
+	if len(h.buffers[key].events) != 0 {
+		t.Errorf("%d events still buffered after spilling", len(h.buffers[key].events))
+	}
+	if names := spilled(t, h.cfg.SpillDir); len(names) != 2 {
+		t.Errorf("spill dir holds %v, want one spilled file and its meta", names)
+	}
+}
+
+func TestDrainSpillOnce(t *testing.T) {
+	up := &fakeUploader{}
+	h := NewWriterHandler(up, jsonDeserializer{}, spillConfig(t))
+	dir := "telemetry/parquet/service=checkout/date=2024-05-01/hour=13"
+	keys := []string{dir + "/batch-p0-a.parquet", dir + "/batch-p0-b.parquet", dir + "/batch-p1-c.parquet"}
+	for _, key := range keys {
+		if err := h.spill(spillSource(t, 10), key, map[string]string{retentionTag: "7"}, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed upload stops the pass, oldest first, leaving the rest spilled
+	up.failOn = "batch-p0-b"
+	n, err := h.drainSpillOnce(context.Background())
+	if err == nil || n != 1 {
+		t.Fatalf("drain = %d, %v; want 1 upload then the injected failure", n, err)
+	}
+	if got := spilled(t, h.cfg.SpillDir); len(got) != 4 {
+		t.Errorf("spill dir holds %v after a failed drain, want the 2 files not uploaded", got)
+	}
+
+	up.mu.Lock()
+	up.failOn = ""
+	up.mu.Unlock()
+	if n, err := h.drainSpillOnce(context.Background()); err != nil || n != 2 {
+		t.Fatalf("drain = %d, %v; want the remaining 2 files", n, err)
+	}
+	if got := spilled(t, h.cfg.SpillDir); len(got) != 0 {
+		t.Errorf("spill dir holds %v after draining", got)
+	}
+	if got := up.parquetKeys(); !slices.Equal(got, keys) {
+		t.Errorf("uploaded %v, want %v", got, keys)
+	}
+	up.mu.Lock()
+	tag := up.tags[keys[0]][retentionTag]
+	up.mu.Unlock()
+	if tag != "7" {
+		t.Errorf("drained file tagged %q, want its spilled retention tag", tag)
+	}
+	if got := storedManifest(t, h, up, dir); !slices.Equal(got, keys) {
+		t.Errorf("manifest = %v, want the drained files", got)
+	}
+}
+
+func TestDrainSpillWithoutHoldingLock(t *testing.T) {
+	for _, suffix := range []string{".parquet", ".json"} {
+		t.Run(suffix, func(t *testing.T) {
+			up := &blockingUploader{suffix: suffix, started: make(chan struct{}, 1), release: make(chan struct{})}
+			h := NewWriterHandler(up, jsonDeserializer{}, spillConfig(t))
+			if err := h.spill(spillSource(t, 10), "telemetry/parquet/date=2024-05-01/hour=13/k.parquet", nil, 10); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error)
+			go func() {
+				_, err := h.drainSpillOnce(context.Background())
+				done <- err
+			}()
+			<-up.started
+			if !h.mu.TryLock() {
+				t.Errorf("h.mu held while the drain waits on a %s upload", suffix)
+			} else {
+				h.mu.Unlock()
+			}
+			close(up.release)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}